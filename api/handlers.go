@@ -0,0 +1,280 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/events"
+	"enssat.tv/autovodsaver/health"
+	"enssat.tv/autovodsaver/metrics"
+	"enssat.tv/autovodsaver/watchdog"
+)
+
+const eventsBufferSize = 100
+
+type videoResponse struct {
+	Id            string                `json:"id"`
+	ChannelId     string                `json:"channelId"`
+	Title         string                `json:"title"`
+	Description   string                `json:"description"`
+	PublishedAt   time.Time             `json:"publishedAt"`
+	LengthSeconds uint                  `json:"lengthSeconds"`
+	Status        constants.VideoStatus `json:"status"`
+}
+
+type channelRequest struct {
+	ChannelId string `json:"channelId"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /channels", s.handleListChannels)
+	mux.HandleFunc("POST /channels", s.handleAddChannel)
+	mux.HandleFunc("DELETE /channels/{channel}", s.handleRemoveChannel)
+	mux.HandleFunc("GET /channels/{channel}/videos", s.handleListVideos)
+	mux.HandleFunc("GET /channels/{channel}/videos/{video}", s.handleGetVideo)
+	mux.HandleFunc("POST /channels/{channel}/videos/{video}/enqueue", s.handleVideoAction(ManagedWatchdog.EnqueueVideo))
+	mux.HandleFunc("POST /channels/{channel}/videos/{video}/retry", s.handleVideoAction(ManagedWatchdog.RetryVideo))
+	mux.HandleFunc("POST /channels/{channel}/videos/{video}/cancel", s.handleVideoAction(ManagedWatchdog.CancelVideo))
+	mux.HandleFunc("POST /channels/{channel}/videos/{video}/bump", s.handleBumpVideo)
+	mux.HandleFunc("GET /channels/{channel}/queue", s.handleQueue)
+	mux.HandleFunc("GET /videos", s.handleListAllVideos)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.Handle("GET /metrics", metrics.Default.Handler())
+	mux.Handle("GET /healthz", s.Health.Handler(health.Liveness))
+	mux.Handle("GET /readyz", s.Health.Handler(health.Readiness))
+	return mux
+}
+
+func (s *Server) handleListChannels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Channels())
+}
+
+func (s *Server) handleAddChannel(w http.ResponseWriter, r *http.Request) {
+	var body channelRequest
+	if decodeError := json.NewDecoder(r.Body).Decode(&body); decodeError != nil || body.ChannelId == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "body must be a json object with a channelId"})
+		return
+	}
+	if addError := s.AddChannel(body.ChannelId); addError != nil {
+		writeError(w, addError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, body)
+}
+
+func (s *Server) handleRemoveChannel(w http.ResponseWriter, r *http.Request) {
+	if removeError := s.RemoveChannel(r.PathValue("channel")); removeError != nil {
+		writeError(w, removeError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListVideos(w http.ResponseWriter, r *http.Request) {
+	wd, watchdogError := s.watchdog(r.PathValue("channel"))
+	if watchdogError != nil {
+		writeError(w, watchdogError)
+		return
+	}
+	filter, filterError := parseFilter(r)
+	if filterError != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: filterError.Error()})
+		return
+	}
+	videos, listError := wd.ListVideos(filter)
+	if listError != nil {
+		writeError(w, listError)
+		return
+	}
+	writeJSON(w, http.StatusOK, toVideoResponses(videos))
+}
+
+func (s *Server) handleListAllVideos(w http.ResponseWriter, r *http.Request) {
+	filter, filterError := parseFilter(r)
+	if filterError != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: filterError.Error()})
+		return
+	}
+	responses := make([]videoResponse, 0)
+	for _, channelId := range s.Channels() {
+		wd, watchdogError := s.watchdog(channelId)
+		if watchdogError != nil {
+			// Removed in the meantime
+			continue
+		}
+		videos, listError := wd.ListVideos(filter)
+		if listError != nil {
+			writeError(w, listError)
+			return
+		}
+		responses = append(responses, toVideoResponses(videos)...)
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+func (s *Server) handleGetVideo(w http.ResponseWriter, r *http.Request) {
+	wd, watchdogError := s.watchdog(r.PathValue("channel"))
+	if watchdogError != nil {
+		writeError(w, watchdogError)
+		return
+	}
+	video, getError := wd.GetVideo(r.PathValue("video"))
+	if getError != nil {
+		writeError(w, getError)
+		return
+	}
+	writeJSON(w, http.StatusOK, toVideoResponse(video))
+}
+
+func (s *Server) handleVideoAction(action func(ManagedWatchdog, string) (constants.VideoWatched, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wd, watchdogError := s.watchdog(r.PathValue("channel"))
+		if watchdogError != nil {
+			writeError(w, watchdogError)
+			return
+		}
+		video, actionError := action(wd, r.PathValue("video"))
+		if actionError != nil {
+			writeError(w, actionError)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, toVideoResponse(video))
+	}
+}
+
+// Move a video ahead in the download queue by the number of days given by the levels parameter, one by default
+func (s *Server) handleBumpVideo(w http.ResponseWriter, r *http.Request) {
+	levels := 1
+	if value := r.URL.Query().Get("levels"); value != "" {
+		parsed, parseError := strconv.Atoi(value)
+		if parseError != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "levels must be an integer"})
+			return
+		}
+		levels = parsed
+	}
+	s.handleVideoAction(func(wd ManagedWatchdog, videoId string) (constants.VideoWatched, error) {
+		return wd.BumpPriority(videoId, levels)
+	})(w, r)
+}
+
+func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
+	wd, watchdogError := s.watchdog(r.PathValue("channel"))
+	if watchdogError != nil {
+		writeError(w, watchdogError)
+		return
+	}
+	responses := make([]videoResponse, 0)
+	for _, video := range wd.QueuedVideos() {
+		responses = append(responses, toVideoResponse(*video))
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+// Stream the watchdog updates as server-sent events
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if s.Events == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "events are not available"})
+		return
+	}
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "streaming is not supported"})
+		return
+	}
+
+	subscription := s.Events.Subscribe("api "+r.RemoteAddr, eventsBufferSize, events.DropOldest)
+	defer subscription.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case msg, open := <-subscription.C:
+			if !open {
+				return
+			}
+			data, marshalError := json.Marshal(toVideoResponse(msg.VideoWatched))
+			if marshalError != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Kind, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func parseFilter(r *http.Request) (watchdog.VideoFilter, error) {
+	query := r.URL.Query()
+	filter := watchdog.VideoFilter{
+		Status: constants.VideoStatus(query.Get("status")),
+	}
+	if publishedAfter := query.Get("published_after"); publishedAfter != "" {
+		date, parseError := time.Parse(time.RFC3339, publishedAfter)
+		if parseError != nil {
+			return filter, errors.New("published_after must be a RFC3339 date")
+		}
+		filter.PublishedAfter = date
+	}
+	if limit := query.Get("limit"); limit != "" {
+		value, parseError := strconv.Atoi(limit)
+		if parseError != nil || value < 0 {
+			return filter, errors.New("limit must be a positive integer")
+		}
+		filter.Limit = value
+	}
+	return filter, nil
+}
+
+func toVideoResponse(video constants.VideoWatched) videoResponse {
+	return videoResponse{
+		Id:            video.Id,
+		ChannelId:     video.ChannelId,
+		Title:         video.Title,
+		Description:   video.Description,
+		PublishedAt:   video.PublishedAt,
+		LengthSeconds: video.LengthSeconds,
+		Status:        video.Status,
+	}
+}
+
+func toVideoResponses(videos []constants.VideoWatched) []videoResponse {
+	responses := make([]videoResponse, 0, len(videos))
+	for _, video := range videos {
+		responses = append(responses, toVideoResponse(video))
+	}
+	return responses
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrChannelNotFound), errors.Is(err, watchdog.ErrVideoNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrChannelExists), errors.Is(err, watchdog.ErrInvalidTransition), errors.Is(err, watchdog.ErrForeignVideo):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,413 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/events"
+	"enssat.tv/autovodsaver/health"
+	"enssat.tv/autovodsaver/twitch"
+	"enssat.tv/autovodsaver/watchdog"
+	"github.com/rs/zerolog"
+)
+
+var published = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// Watchdog keeping its videos in a map, the status transitions follow the ones of the real watchdog
+type fakeWatchdog struct {
+	channelId string
+	mu        *sync.Mutex
+	videos    map[string]*constants.VideoWatched
+	running   bool
+}
+
+func newFakeWatchdog(channelId string) *fakeWatchdog {
+	wd := &fakeWatchdog{channelId: channelId, mu: &sync.Mutex{}, videos: make(map[string]*constants.VideoWatched)}
+	for i, status := range []constants.VideoStatus{constants.VideoStatusQueued, constants.VideoStatusExpired, constants.VideoStatusArchived, constants.VideoStatusMissing} {
+		id := strings.ToLower(strings.TrimPrefix(string(status), "VIDEO_STATUS_"))
+		wd.videos[id] = &constants.VideoWatched{
+			Video:     twitch.Video{Id: id, Title: id, PublishedAt: published.Add(-time.Duration(i) * time.Hour)},
+			ChannelId: channelId,
+			Status:    status,
+		}
+	}
+	return wd
+}
+
+func (wd *fakeWatchdog) Run() error {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.running = true
+	return nil
+}
+
+func (wd *fakeWatchdog) Stop() error {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.running = false
+	return nil
+}
+
+func (wd *fakeWatchdog) isRunning() bool {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	return wd.running
+}
+
+func (wd *fakeWatchdog) ListVideos(filter watchdog.VideoFilter) ([]constants.VideoWatched, error) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	videos := make([]constants.VideoWatched, 0)
+	for _, video := range wd.videos {
+		if (filter.Status == "" || video.Status == filter.Status) && !video.PublishedAt.Before(filter.PublishedAfter) {
+			videos = append(videos, *video)
+		}
+	}
+	slices.SortFunc(videos, func(a constants.VideoWatched, b constants.VideoWatched) int {
+		return b.PublishedAt.Compare(a.PublishedAt)
+	})
+	if filter.Limit > 0 && len(videos) > filter.Limit {
+		videos = videos[:filter.Limit]
+	}
+	return videos, nil
+}
+
+func (wd *fakeWatchdog) GetVideo(videoId string) (constants.VideoWatched, error) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	video, found := wd.videos[videoId]
+	if !found {
+		return constants.VideoWatched{}, watchdog.ErrVideoNotFound
+	}
+	return *video, nil
+}
+
+// Move the video to the status when its current status is one of from
+func (wd *fakeWatchdog) transition(videoId string, to constants.VideoStatus, from ...constants.VideoStatus) (constants.VideoWatched, error) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	video, found := wd.videos[videoId]
+	if !found {
+		return constants.VideoWatched{}, watchdog.ErrVideoNotFound
+	}
+	if !slices.Contains(from, video.Status) {
+		return *video, fmt.Errorf("%w: video %s is %s", watchdog.ErrInvalidTransition, videoId, video.Status)
+	}
+	video.Status = to
+	return *video, nil
+}
+
+// Videos whose id starts with "foreign" are published by another channel
+func (wd *fakeWatchdog) EnqueueVideo(videoId string) (constants.VideoWatched, error) {
+	if strings.HasPrefix(videoId, "foreign") {
+		return constants.VideoWatched{}, fmt.Errorf("%w: video %s is published by another channel", watchdog.ErrForeignVideo, videoId)
+	}
+	if video, getError := wd.GetVideo(videoId); getError == nil && video.Status == constants.VideoStatusQueued {
+		return video, nil
+	}
+	return wd.transition(videoId, constants.VideoStatusQueued, constants.VideoStatusMissing)
+}
+
+func (wd *fakeWatchdog) RetryVideo(videoId string) (constants.VideoWatched, error) {
+	return wd.transition(videoId, constants.VideoStatusQueued, constants.VideoStatusExpired, constants.VideoStatusCancelled)
+}
+
+func (wd *fakeWatchdog) CancelVideo(videoId string) (constants.VideoWatched, error) {
+	return wd.transition(videoId, constants.VideoStatusCancelled, constants.VideoStatusQueued)
+}
+
+func (wd *fakeWatchdog) BumpPriority(videoId string, levels int) (constants.VideoWatched, error) {
+	return wd.transition(videoId, constants.VideoStatusQueued, constants.VideoStatusQueued)
+}
+
+func (wd *fakeWatchdog) QueuedVideos() []*constants.VideoWatched {
+	videos, _ := wd.ListVideos(watchdog.VideoFilter{Status: constants.VideoStatusQueued})
+	queued := make([]*constants.VideoWatched, 0, len(videos))
+	for i := range videos {
+		queued = append(queued, &videos[i])
+	}
+	return queued
+}
+
+func (wd *fakeWatchdog) HealthChecks() []health.Check {
+	return nil
+}
+
+// Server watching the channel "channel" with fake watchdogs, its handler is served by the returned test server
+func newTestServer(t *testing.T, token string) (*Server, *httptest.Server, map[string]*fakeWatchdog) {
+	t.Helper()
+	logger := zerolog.Nop()
+	ctx := context.WithValue(context.Background(), constants.LoggerKey, &logger)
+
+	mu := &sync.Mutex{}
+	watchdogs := make(map[string]*fakeWatchdog)
+	server := NewServerWithContext(ctx, "127.0.0.1:0", func(ctx context.Context, channelId string) ManagedWatchdog {
+		mu.Lock()
+		defer mu.Unlock()
+		wd := newFakeWatchdog(channelId)
+		watchdogs[channelId] = wd
+		return wd
+	})
+	server.Token = token
+	server.ChannelStore = watchdog.NewMemoryRepositoryWithContext(ctx)
+	if restoreError := server.RestoreChannels("channel"); restoreError != nil {
+		t.Fatal(restoreError)
+	}
+	httpServer := httptest.NewServer(server.httpServer.Handler)
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Stop()
+	})
+	return server, httpServer, watchdogs
+}
+
+// Send the request with the token when it is not empty, the response body is decoded into result when it is not nil
+func request(t *testing.T, httpServer *httptest.Server, method string, path string, body string, token string, result any) *http.Response {
+	t.Helper()
+	req, requestError := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+	if requestError != nil {
+		t.Fatal(requestError)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, doError := httpServer.Client().Do(req)
+	if doError != nil {
+		t.Fatal(doError)
+	}
+	defer res.Body.Close()
+	if result != nil {
+		if decodeError := json.NewDecoder(res.Body).Decode(result); decodeError != nil {
+			t.Fatalf("%s %s: %v", method, path, decodeError)
+		}
+	}
+	return res
+}
+
+func videoIds(videos []videoResponse) []string {
+	ids := make([]string, 0, len(videos))
+	for _, video := range videos {
+		ids = append(ids, video.Id)
+	}
+	return ids
+}
+
+func TestListVideos(t *testing.T) {
+	_, httpServer, _ := newTestServer(t, "")
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		ids    []string
+	}{
+		{name: "channel", path: "/channels/channel/videos", status: http.StatusOK, ids: []string{"queued", "expired", "archived", "missing"}},
+		{name: "status", path: "/channels/channel/videos?status=" + constants.VideoStatusExpired, status: http.StatusOK, ids: []string{"expired"}},
+		{name: "published after", path: "/channels/channel/videos?published_after=" + published.Add(-90*time.Minute).Format(time.RFC3339), status: http.StatusOK, ids: []string{"queued", "expired"}},
+		{name: "limit", path: "/channels/channel/videos?limit=1", status: http.StatusOK, ids: []string{"queued"}},
+		{name: "every channel", path: "/videos?status=" + constants.VideoStatusArchived, status: http.StatusOK, ids: []string{"archived"}},
+		{name: "invalid limit", path: "/channels/channel/videos?limit=-1", status: http.StatusBadRequest},
+		{name: "invalid date", path: "/videos?published_after=yesterday", status: http.StatusBadRequest},
+		{name: "unknown channel", path: "/channels/unknown/videos", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var videos []videoResponse
+			var result any = &videos
+			if test.status != http.StatusOK {
+				result = &errorResponse{}
+			}
+			if res := request(t, httpServer, http.MethodGet, test.path, "", "", result); res.StatusCode != test.status {
+				t.Fatalf("GET %s status = %d, want %d", test.path, res.StatusCode, test.status)
+			}
+			if test.status == http.StatusOK && !reflect.DeepEqual(videoIds(videos), test.ids) {
+				t.Errorf("GET %s = %v, want %v", test.path, videoIds(videos), test.ids)
+			}
+		})
+	}
+}
+
+func TestGetVideo(t *testing.T) {
+	_, httpServer, _ := newTestServer(t, "")
+
+	var video videoResponse
+	if res := request(t, httpServer, http.MethodGet, "/channels/channel/videos/expired", "", "", &video); res.StatusCode != http.StatusOK {
+		t.Fatalf("GET video status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if video.Id != "expired" || video.ChannelId != "channel" || video.Status != constants.VideoStatusExpired {
+		t.Errorf("GET video = %+v, want the expired video of channel", video)
+	}
+	if res := request(t, httpServer, http.MethodGet, "/channels/channel/videos/404", "", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET unknown video status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestVideoActions(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   constants.VideoStatus
+	}{
+		{name: "enqueue missing", path: "/channels/channel/videos/missing/enqueue", status: http.StatusAccepted, want: constants.VideoStatusQueued},
+		{name: "enqueue queued", path: "/channels/channel/videos/queued/enqueue", status: http.StatusAccepted, want: constants.VideoStatusQueued},
+		{name: "enqueue archived", path: "/channels/channel/videos/archived/enqueue", status: http.StatusConflict},
+		{name: "enqueue foreign", path: "/channels/channel/videos/foreign1/enqueue", status: http.StatusConflict},
+		{name: "enqueue unknown", path: "/channels/channel/videos/404/enqueue", status: http.StatusNotFound},
+		{name: "retry expired", path: "/channels/channel/videos/expired/retry", status: http.StatusAccepted, want: constants.VideoStatusQueued},
+		{name: "retry archived", path: "/channels/channel/videos/archived/retry", status: http.StatusConflict},
+		{name: "cancel queued", path: "/channels/channel/videos/queued/cancel", status: http.StatusAccepted, want: constants.VideoStatusCancelled},
+		{name: "cancel archived", path: "/channels/channel/videos/archived/cancel", status: http.StatusConflict},
+		{name: "bump queued", path: "/channels/channel/videos/queued/bump?levels=2", status: http.StatusAccepted, want: constants.VideoStatusQueued},
+		{name: "bump invalid levels", path: "/channels/channel/videos/queued/bump?levels=many", status: http.StatusBadRequest},
+		{name: "unknown channel", path: "/channels/unknown/videos/queued/cancel", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, httpServer, _ := newTestServer(t, "")
+
+			var video videoResponse
+			res := request(t, httpServer, http.MethodPost, test.path, "", "", &video)
+			if res.StatusCode != test.status {
+				t.Fatalf("POST %s status = %d, want %d", test.path, res.StatusCode, test.status)
+			}
+			if test.want != "" && video.Status != test.want {
+				t.Errorf("POST %s status of the video = %s, want %s", test.path, video.Status, test.want)
+			}
+		})
+	}
+}
+
+func TestQueue(t *testing.T) {
+	_, httpServer, _ := newTestServer(t, "")
+	request(t, httpServer, http.MethodPost, "/channels/channel/videos/expired/retry", "", "", nil)
+
+	var queued []videoResponse
+	if res := request(t, httpServer, http.MethodGet, "/channels/channel/queue", "", "", &queued); res.StatusCode != http.StatusOK {
+		t.Fatalf("GET queue status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if ids := videoIds(queued); !reflect.DeepEqual(ids, []string{"queued", "expired"}) {
+		t.Errorf("GET queue = %v, want [queued expired]", ids)
+	}
+	if res := request(t, httpServer, http.MethodGet, "/channels/unknown/queue", "", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET queue of an unknown channel status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	server, httpServer, watchdogs := newTestServer(t, "")
+
+	if res := request(t, httpServer, http.MethodPost, "/channels", `{"channelId": "other"}`, "", nil); res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST channel status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	var channels []string
+	request(t, httpServer, http.MethodGet, "/channels", "", "", &channels)
+	if !reflect.DeepEqual(channels, []string{"channel", "other"}) {
+		t.Errorf("GET channels = %v, want [channel other]", channels)
+	}
+	if !watchdogs["other"].isRunning() {
+		t.Error("watchdog of the added channel is not running")
+	}
+	for body, status := range map[string]int{`{"channelId": "other"}`: http.StatusConflict, `{}`: http.StatusBadRequest, `channel`: http.StatusBadRequest} {
+		if res := request(t, httpServer, http.MethodPost, "/channels", body, "", nil); res.StatusCode != status {
+			t.Errorf("POST channel %s status = %d, want %d", body, res.StatusCode, status)
+		}
+	}
+
+	if res := request(t, httpServer, http.MethodDelete, "/channels/channel", "", "", nil); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE channel status = %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	if watchdogs["channel"].isRunning() {
+		t.Error("watchdog of the removed channel is still running")
+	}
+	if res := request(t, httpServer, http.MethodDelete, "/channels/channel", "", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE removed channel status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+	// The removed default channel is not watched again on restart
+	if recorded, _ := server.ChannelStore.WatchedChannels(); !reflect.DeepEqual(recorded, []string{"other"}) {
+		t.Errorf("recorded channels = %v, want [other]", recorded)
+	}
+	restarted := NewServerWithContext(server.Context, "127.0.0.1:0", server.NewWatchdog)
+	restarted.ChannelStore = server.ChannelStore
+	if restoreError := restarted.RestoreChannels("channel"); restoreError != nil {
+		t.Fatal(restoreError)
+	}
+	defer restarted.Stop()
+	if channels := restarted.Channels(); !reflect.DeepEqual(channels, []string{"other"}) {
+		t.Errorf("channels after restart = %v, want [other]", channels)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	_, httpServer, _ := newTestServer(t, "secret")
+
+	for _, token := range []string{"", "wrong"} {
+		res := request(t, httpServer, http.MethodPost, "/channels/channel/videos/queued/cancel", "", token, nil)
+		if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("POST with token %q status = %d, want %d with a bearer challenge", token, res.StatusCode, http.StatusUnauthorized)
+		}
+	}
+	if res := request(t, httpServer, http.MethodDelete, "/channels/channel", "", "wrong", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("DELETE with a wrong token status = %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+	// Reads stay open to the probes and the scrapers
+	if res := request(t, httpServer, http.MethodGet, "/channels/channel/videos", "", "", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("GET without token status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if res := request(t, httpServer, http.MethodPost, "/channels/channel/videos/queued/cancel", "", "secret", nil); res.StatusCode != http.StatusAccepted {
+		t.Errorf("POST with the token status = %d, want %d", res.StatusCode, http.StatusAccepted)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	server, httpServer, _ := newTestServer(t, "")
+	if res := request(t, httpServer, http.MethodGet, "/events", "", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET events without a bus status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	bus := events.NewBus[watchdog.UpdateMessage]()
+	defer bus.Close()
+	server.Events = bus
+	res, getError := httpServer.Client().Get(httpServer.URL + "/events")
+	if getError != nil {
+		t.Fatal(getError)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET events = %d %s, want %d text/event-stream", res.StatusCode, res.Header.Get("Content-Type"), http.StatusOK)
+	}
+
+	// The subscription exists once the headers have been sent
+	bus.Publish(watchdog.UpdateMessage{
+		VideoWatched: constants.VideoWatched{Video: twitch.Video{Id: "1"}, ChannelId: "channel", Status: constants.VideoStatusArchived},
+		Kind:         watchdog.UpdateKindStatus,
+	})
+	reader := bufio.NewReader(res.Body)
+	lines := make([]string, 0, 2)
+	for len(lines) < 2 {
+		line, readError := reader.ReadString('\n')
+		if readError != nil && readError != io.EOF {
+			t.Fatal(readError)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "event: "+watchdog.UpdateKindStatus {
+		t.Errorf("event line = %q, want the kind of the update", lines[0])
+	}
+	var video videoResponse
+	if decodeError := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &video); decodeError != nil || video.Id != "1" || video.Status != constants.VideoStatusArchived {
+		t.Errorf("data line = %q (%v), want the archived video 1", lines[1], decodeError)
+	}
+}
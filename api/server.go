@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/events"
+	"enssat.tv/autovodsaver/health"
+	"enssat.tv/autovodsaver/watchdog"
+	"github.com/rs/zerolog"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+var (
+	ErrChannelNotFound = errors.New("channel is not watched")
+	ErrChannelExists   = errors.New("channel is already watched")
+)
+
+// Watchdog operations exposed by the management API
+type ManagedWatchdog interface {
+	watchdog.Watchdoger
+	ListVideos(filter watchdog.VideoFilter) ([]constants.VideoWatched, error)
+	GetVideo(videoId string) (constants.VideoWatched, error)
+	EnqueueVideo(videoId string) (constants.VideoWatched, error)
+	RetryVideo(videoId string) (constants.VideoWatched, error)
+	CancelVideo(videoId string) (constants.VideoWatched, error)
+	BumpPriority(videoId string, levels int) (constants.VideoWatched, error)
+	QueuedVideos() []*constants.VideoWatched
+	HealthChecks() []health.Check
+}
+
+// Build the watchdog of a newly watched channel
+type WatchdogFactory func(ctx context.Context, channelId string) ManagedWatchdog
+
+type Server struct {
+	Context     context.Context
+	Address     string
+	NewWatchdog WatchdogFactory
+	Health      *health.Checker
+	Events      *events.Bus[watchdog.UpdateMessage] // Streamed to the clients of the events endpoint when set
+	// Channels added and removed through the api are recorded there when set, to be watched again on restart
+	ChannelStore watchdog.ChannelRepository
+	Token        string // Requests changing the channels or the videos must carry it as a bearer token when set
+	mu           *sync.Mutex
+	watchdogs    map[string]ManagedWatchdog
+	httpServer   *http.Server
+	stopping     chan struct{} // Closed when the server stops, to end the long-lived responses
+}
+
+func NewServer(address string, newWatchdog WatchdogFactory) *Server {
+	return NewServerWithContext(context.Background(), address, newWatchdog)
+}
+
+func NewServerWithContext(ctx context.Context, address string, newWatchdog WatchdogFactory) *Server {
+	s := &Server{
+		Context:     ctx,
+		Address:     address,
+		NewWatchdog: newWatchdog,
+		Health:      health.NewChecker(),
+		mu:          &sync.Mutex{},
+		watchdogs:   make(map[string]ManagedWatchdog),
+		stopping:    make(chan struct{}),
+	}
+	s.Health.AddSource(s.healthChecks)
+	s.httpServer = &http.Server{
+		Addr:    address,
+		Handler: s.authorize(s.Handler()),
+		BaseContext: func(_ net.Listener) context.Context {
+			return ctx
+		},
+	}
+	return s
+}
+
+// Serve the API in the background
+func (s *Server) Start() error {
+	logger := s.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	listener, listenError := net.Listen("tcp", s.Address)
+	if listenError != nil {
+		return listenError
+	}
+	logger.Info().Msgf("management api listening on %s", listener.Addr())
+	go func() {
+		if serveError := s.httpServer.Serve(listener); serveError != nil && !errors.Is(serveError, http.ErrServerClosed) {
+			logger.Error().Msg(serveError.Error())
+		}
+	}()
+	return nil
+}
+
+// Stop serving the API then stop every watchdog
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	close(s.stopping)
+	shutdownError := s.httpServer.Shutdown(ctx)
+
+	// Each watchdog may wait for its download to drain, they stop in parallel without holding the lock
+	s.mu.Lock()
+	watchdogs := s.watchdogs
+	s.watchdogs = make(map[string]ManagedWatchdog)
+	s.mu.Unlock()
+
+	errorsMu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for channelId, wd := range watchdogs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if stopError := wd.Stop(); stopError != nil {
+				errorsMu.Lock()
+				shutdownError = errors.Join(shutdownError, fmt.Errorf("stop watchdog of channel %s: %w", channelId, stopError))
+				errorsMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return shutdownError
+}
+
+// Start watching a channel
+func (s *Server) AddChannel(channelId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.watchdogs[channelId]; found {
+		return ErrChannelExists
+	}
+	wd := s.NewWatchdog(s.Context, channelId)
+	if runError := wd.Run(); runError != nil {
+		return runError
+	}
+	if s.ChannelStore != nil {
+		if watchError := s.ChannelStore.WatchChannel(channelId); watchError != nil {
+			return errors.Join(fmt.Errorf("record channel %s: %w", channelId, watchError), wd.Stop())
+		}
+	}
+	s.watchdogs[channelId] = wd
+	return nil
+}
+
+// Watch again the channels recorded in the channel store, the default channels are only recorded the first time
+// the store is used so that removed channels stay removed
+func (s *Server) RestoreChannels(defaultChannels ...string) error {
+	channels := defaultChannels
+	if s.ChannelStore != nil {
+		if seedError := s.ChannelStore.SeedChannels(defaultChannels...); seedError != nil {
+			return fmt.Errorf("seed default channels: %w", seedError)
+		}
+		recorded, listError := s.ChannelStore.WatchedChannels()
+		if listError != nil {
+			return fmt.Errorf("list recorded channels: %w", listError)
+		}
+		channels = recorded
+	}
+	for _, channelId := range channels {
+		if addError := s.AddChannel(channelId); addError != nil && !errors.Is(addError, ErrChannelExists) {
+			return addError
+		}
+	}
+	return nil
+}
+
+// Stop watching a channel, its videos stay in the database
+func (s *Server) RemoveChannel(channelId string) error {
+	s.mu.Lock()
+	wd, found := s.watchdogs[channelId]
+	if !found {
+		s.mu.Unlock()
+		return ErrChannelNotFound
+	}
+	if s.ChannelStore != nil {
+		if unwatchError := s.ChannelStore.UnwatchChannel(channelId); unwatchError != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("forget channel %s: %w", channelId, unwatchError)
+		}
+	}
+	delete(s.watchdogs, channelId)
+	s.mu.Unlock()
+	return wd.Stop()
+}
+
+func (s *Server) Channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channels := make([]string, 0, len(s.watchdogs))
+	for channelId := range s.watchdogs {
+		channels = append(channels, channelId)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Reject the requests changing the state of the daemon without the token, reads stay open to the probes and scrapers
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "missing or invalid bearer token"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) healthChecks() []health.Check {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checks := make([]health.Check, 0)
+	for _, wd := range s.watchdogs {
+		checks = append(checks, wd.HealthChecks()...)
+	}
+	return checks
+}
+
+func (s *Server) watchdog(channelId string) (ManagedWatchdog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wd, found := s.watchdogs[channelId]
+	if !found {
+		return nil, ErrChannelNotFound
+	}
+	return wd, nil
+}
@@ -0,0 +1,217 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bytes read before waiting for the limiters, keeps the transfer smooth at low rates
+const maxReadSize = 32 * 1024
+
+// Rates in bytes per second depending on the time of day, zero means unlimited
+type Schedule struct {
+	Rate    int64    // Rate outside of the windows
+	Windows []Window // The first window containing the time wins
+}
+
+type Window struct {
+	From time.Duration // Offset from midnight in local time
+	To   time.Duration // Before From when the window spans midnight
+	Rate int64
+}
+
+func (w Window) contains(offset time.Duration) bool {
+	if w.From <= w.To {
+		return offset >= w.From && offset < w.To
+	}
+	return offset >= w.From || offset < w.To
+}
+
+func (s Schedule) RateAt(t time.Time) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	for _, window := range s.Windows {
+		if window.contains(offset) {
+			return window.Rate
+		}
+	}
+	return s.Rate
+}
+
+func (s Schedule) Unlimited() bool {
+	if s.Rate > 0 {
+		return false
+	}
+	for _, window := range s.Windows {
+		if window.Rate > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse a schedule like "10M,08:00-19:00=1M,22:00-06:00=0", the entry without window is the rate outside of the windows
+func ParseSchedule(text string) (Schedule, error) {
+	schedule := Schedule{}
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		hours, rateText, found := strings.Cut(entry, "=")
+		if !found {
+			rate, parseError := ParseRate(entry)
+			if parseError != nil {
+				return Schedule{}, parseError
+			}
+			schedule.Rate = rate
+			continue
+		}
+
+		fromText, toText, found := strings.Cut(hours, "-")
+		if !found {
+			return Schedule{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM=rate", entry)
+		}
+		from, fromError := parseTimeOfDay(fromText)
+		if fromError != nil {
+			return Schedule{}, fromError
+		}
+		to, toError := parseTimeOfDay(toText)
+		if toError != nil {
+			return Schedule{}, toError
+		}
+		rate, parseError := ParseRate(rateText)
+		if parseError != nil {
+			return Schedule{}, parseError
+		}
+		schedule.Windows = append(schedule.Windows, Window{From: from, To: to, Rate: rate})
+	}
+	return schedule, nil
+}
+
+func parseTimeOfDay(text string) (time.Duration, error) {
+	parsed, parseError := time.Parse("15:04", strings.TrimSpace(text))
+	if parseError != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", text)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Parse a rate in bytes per second like "512K", "10M" or "1G", with binary multiples
+func ParseRate(text string) (int64, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "/S"), "B")
+	multiplier := int64(1)
+	for suffix, value := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if strings.HasSuffix(text, suffix) {
+			text = strings.TrimSuffix(text, suffix)
+			multiplier = value
+			break
+		}
+	}
+	rate, parseError := strconv.ParseFloat(text, 64)
+	if parseError != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected bytes per second like 512K or 10M", text)
+	}
+	return int64(rate * float64(multiplier)), nil
+}
+
+// Token bucket counting bytes, starting empty and holding at most one second of traffic
+type Limiter struct {
+	schedule Schedule
+	mu       *sync.Mutex
+	tokens   float64
+	last     time.Time
+}
+
+func NewLimiter(schedule Schedule) *Limiter {
+	return &Limiter{
+		schedule: schedule,
+		mu:       &sync.Mutex{},
+		last:     time.Now(),
+	}
+}
+
+// Take n bytes from the bucket, waiting while the bucket is in debt
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	rate := float64(l.schedule.RateAt(now))
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return nil
+	}
+	l.tokens = min(rate, l.tokens+now.Sub(l.last).Seconds()*rate) - float64(n)
+	l.last = now
+	debt := -l.tokens
+	l.mu.Unlock()
+
+	if debt <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(debt / rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Caps of the transfers going in one direction
+type Limits struct {
+	Global      *Limiter // Shared by every transfer, nil when unlimited
+	PerTransfer Schedule // Cap of each transfer on its own
+}
+
+func NewLimits(global Schedule, perTransfer Schedule) *Limits {
+	limits := &Limits{PerTransfer: perTransfer}
+	if !global.Unlimited() {
+		limits.Global = NewLimiter(global)
+	}
+	return limits
+}
+
+// Wrap the reader of a transfer so that it is read within the caps, a nil Limits returns the reader unchanged
+func (l *Limits) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || (l.Global == nil && l.PerTransfer.Unlimited()) {
+		return r
+	}
+	limiters := make([]*Limiter, 0, 2)
+	if l.Global != nil {
+		limiters = append(limiters, l.Global)
+	}
+	if !l.PerTransfer.Unlimited() {
+		limiters = append(limiters, NewLimiter(l.PerTransfer))
+	}
+	return &reader{ctx: ctx, reader: r, limiters: limiters}
+}
+
+type reader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxReadSize {
+		p = p[:maxReadSize]
+	}
+	n, readError := r.reader.Read(p)
+	if n > 0 {
+		for _, limiter := range r.limiters {
+			if waitError := limiter.WaitN(r.ctx, n); waitError != nil {
+				return n, waitError
+			}
+		}
+	}
+	return n, readError
+}
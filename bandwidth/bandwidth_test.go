@@ -0,0 +1,104 @@
+package bandwidth
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	schedule, parseError := ParseSchedule("10M, 08:00-19:00=512K, 22:00-06:00=0")
+	if parseError != nil {
+		t.Fatal(parseError)
+	}
+	day := func(hour int, minute int) time.Time {
+		return time.Date(2024, 3, 1, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		at   time.Time
+		want int64
+	}{
+		{at: day(7, 59), want: 10 << 20},
+		{at: day(8, 0), want: 512 << 10},
+		{at: day(18, 59), want: 512 << 10},
+		{at: day(19, 0), want: 10 << 20},
+		{at: day(23, 30), want: 0},
+		{at: day(3, 0), want: 0},
+	}
+	for _, test := range tests {
+		if rate := schedule.RateAt(test.at); rate != test.want {
+			t.Errorf("RateAt(%s) = %d, want %d", test.at.Format("15:04"), rate, test.want)
+		}
+	}
+
+	for _, invalid := range []string{"fast", "08:00=1M", "8h-9h=1M", "08:00-09:00=-1"} {
+		if _, parseError := ParseSchedule(invalid); parseError == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for text, want := range map[string]int64{"0": 0, "1500": 1500, "512K": 512 << 10, "1.5M": 3 << 19, "2GB": 2 << 30, "10MB/s": 10 << 20} {
+		if rate, parseError := ParseRate(text); parseError != nil || rate != want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", text, rate, parseError, want)
+		}
+	}
+}
+
+func TestReaderPerTransfer(t *testing.T) {
+	limits := NewLimits(Schedule{}, Schedule{Rate: 100 << 10})
+	content := bytes.Repeat([]byte("x"), 50<<10)
+
+	start := time.Now()
+	read, readError := io.ReadAll(limits.Reader(context.Background(), bytes.NewReader(content)))
+	if readError != nil || len(read) != len(content) {
+		t.Fatalf("ReadAll() = %d bytes, %v", len(read), readError)
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Errorf("50K read in %s, want at least 500ms at 100K/s", elapsed)
+	}
+}
+
+func TestReaderGlobal(t *testing.T) {
+	limits := NewLimits(Schedule{Rate: 100 << 10}, Schedule{})
+	content := bytes.Repeat([]byte("x"), 25<<10)
+
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.Discard, limits.Reader(context.Background(), bytes.NewReader(content)))
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Errorf("2 x 25K read in %s, want at least 500ms at 100K/s shared", elapsed)
+	}
+}
+
+func TestReaderCancelled(t *testing.T) {
+	limits := NewLimits(Schedule{Rate: 1}, Schedule{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, readError := io.ReadAll(limits.Reader(ctx, bytes.NewReader(make([]byte, 1024)))); readError != context.Canceled {
+		t.Errorf("ReadAll() error = %v, want %v", readError, context.Canceled)
+	}
+}
+
+func TestReaderUnlimited(t *testing.T) {
+	reader := bytes.NewReader(nil)
+	var limits *Limits
+	if limits.Reader(context.Background(), reader) != reader {
+		t.Error("a nil Limits must return the reader unchanged")
+	}
+	if NewLimits(Schedule{}, Schedule{}).Reader(context.Background(), reader) != reader {
+		t.Error("unlimited schedules must return the reader unchanged")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/storage"
+	"enssat.tv/autovodsaver/twitch"
+	"enssat.tv/autovodsaver/watchdog"
+)
+
+const usage = `usage: autovodsaver [command] [arguments]
+
+Without command the daemon is started.
+
+Commands:
+  download <videoId> -o <file>       download a video to a local file
+  list <channel>                     list the videos of a channel available on twitch
+  status [-channel c] [-status s]    list the videos known by the database
+  enqueue <videoId> [-channel c]     queue a video for download
+  retry [videoId...] [-channel c]    queue again failed, restricted or cancelled videos, all of them when no id is given
+  reconcile [-channel c]             synchronize the database with twitch once and report lost videos
+  upload <file> -video <videoId>     store a local file as the given video
+  verify [videoId...] [-channel c]   read the stored videos again and compare them with their checksum, all archived videos when no id is given
+  db migrate [-channel c]            create or update the database schema, videos of older schemas are assigned to the channel
+`
+
+var errUsage = errors.New("invalid arguments, run autovodsaver help")
+
+func runCommand(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "download":
+		return downloadCommand(ctx, args)
+	case "list":
+		return listCommand(ctx, args)
+	case "status":
+		return statusCommand(ctx, args)
+	case "enqueue":
+		return enqueueCommand(ctx, args)
+	case "retry":
+		return retryCommand(ctx, args)
+	case "reconcile":
+		return reconcileCommand(ctx, args)
+	case "upload":
+		return uploadCommand(ctx, args)
+	case "verify":
+		return verifyCommand(ctx, args)
+	case "db":
+		return dbCommand(ctx, args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return fmt.Errorf("unknown command %s", command)
+}
+
+// Parse flags placed before or after the positional arguments, like "download <videoId> -o file"
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		if parseError := fs.Parse(args); parseError != nil {
+			return nil, parseError
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// Open the database of a channel without starting its watchdog
+func openWatchdog(ctx context.Context, channelId string) (*watchdog.Watchdog, error) {
+	client, newClientError := newTwitchClient()
+	if newClientError != nil {
+		return nil, newClientError
+	}
+	wd := newWatchdog(ctx, client, channelId)
+	if openError := wd.Open(); openError != nil {
+		return nil, openError
+	}
+	return wd, nil
+}
+
+func printVideos(w io.Writer, videos []constants.VideoWatched) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPUBLISHED\tLENGTH\tSTATUS\tTITLE")
+	for _, video := range videos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", video.Id, video.PublishedAt.Format(time.DateTime), time.Duration(video.LengthSeconds)*time.Second, video.Status, video.Title)
+	}
+	return tw.Flush()
+}
+
+func downloadCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	output := fs.String("o", "", "output file, <videoId>.mp4 by default")
+	positional, parseError := parseArgs(fs, args)
+	if parseError != nil {
+		return parseError
+	}
+	if len(positional) != 1 {
+		return errUsage
+	}
+	if *output == "" {
+		*output = positional[0] + ".mp4"
+	}
+
+	client, newClientError := newTwitchClient()
+	if newClientError != nil {
+		return newClientError
+	}
+	signalCtx, stopSignals := signal.NotifyContext(ctx, os.Interrupt)
+	defer stopSignals()
+	video, getVideoError := client.GetVideo(signalCtx, positional[0])
+	if getVideoError != nil {
+		return getVideoError
+	}
+	if downloadError := video.Download(*output); downloadError != nil {
+		return downloadError
+	}
+	fmt.Printf("video %s downloaded to %s\n", video.Id, *output)
+	return nil
+}
+
+func listCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	positional, parseError := parseArgs(fs, args)
+	if parseError != nil {
+		return parseError
+	}
+	if len(positional) != 1 {
+		return errUsage
+	}
+
+	client, newClientError := newTwitchClient()
+	if newClientError != nil {
+		return newClientError
+	}
+	listed, listError := client.GetVideos(ctx, positional[0])
+	if listError != nil {
+		return listError
+	}
+	videos := make([]constants.VideoWatched, 0)
+	for _, video := range listed {
+		videos = append(videos, constants.VideoWatched{Video: video, ChannelId: positional[0]})
+	}
+	return printVideos(os.Stdout, videos)
+}
+
+func statusCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	channelId := fs.String("channel", defaultChannel, "channel of the videos")
+	status := fs.String("status", "", "only list videos with this status")
+	if _, parseError := parseArgs(fs, args); parseError != nil {
+		return parseError
+	}
+
+	wd, openError := openWatchdog(ctx, *channelId)
+	if openError != nil {
+		return openError
+	}
+	defer wd.Close()
+	videos, listError := wd.ListVideos(watchdog.VideoFilter{Status: constants.VideoStatus(*status)})
+	if listError != nil {
+		return listError
+	}
+	return printVideos(os.Stdout, videos)
+}
+
+func enqueueCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	channelId := fs.String("channel", defaultChannel, "channel of the video")
+	positional, parseError := parseArgs(fs, args)
+	if parseError != nil {
+		return parseError
+	}
+	if len(positional) != 1 {
+		return errUsage
+	}
+
+	wd, openError := openWatchdog(ctx, *channelId)
+	if openError != nil {
+		return openError
+	}
+	defer wd.Close()
+	video, enqueueError := wd.EnqueueVideo(positional[0])
+	if enqueueError != nil {
+		return enqueueError
+	}
+	fmt.Printf("video %s is %s\n", video.Id, video.Status)
+	return nil
+}
+
+func retryCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("retry", flag.ContinueOnError)
+	channelId := fs.String("channel", defaultChannel, "channel of the videos")
+	positional, parseError := parseArgs(fs, args)
+	if parseError != nil {
+		return parseError
+	}
+
+	wd, openError := openWatchdog(ctx, *channelId)
+	if openError != nil {
+		return openError
+	}
+	defer wd.Close()
+
+	// Without id, every failed, restricted or cancelled video is retried
+	if len(positional) == 0 {
+		for _, status := range []constants.VideoStatus{constants.VideoStatusExpired, constants.VideoStatusRestricted, constants.VideoStatusCancelled} {
+			videos, listError := wd.ListVideos(watchdog.VideoFilter{Status: status})
+			if listError != nil {
+				return listError
+			}
+			for _, video := range videos {
+				positional = append(positional, video.Id)
+			}
+		}
+	}
+
+	var retryErrors error
+	for _, videoId := range positional {
+		video, retryError := wd.RetryVideo(videoId)
+		if retryError != nil {
+			retryErrors = errors.Join(retryErrors, retryError)
+			continue
+		}
+		fmt.Printf("video %s is %s\n", video.Id, video.Status)
+	}
+	return retryErrors
+}
+
+func reconcileCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	channelId := fs.String("channel", defaultChannel, "channel to synchronize")
+	if _, parseError := parseArgs(fs, args); parseError != nil {
+		return parseError
+	}
+
+	wd, openError := openWatchdog(ctx, *channelId)
+	if openError != nil {
+		return openError
+	}
+	defer wd.Close()
+	if reconcileError := wd.Reconcile(); reconcileError != nil {
+		return reconcileError
+	}
+	lost, lostError := wd.GetLostVideos()
+	if lostError != nil {
+		return lostError
+	}
+	return watchdog.WriteLostReport(os.Stdout, lost)
+}
+
+func uploadCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	videoId := fs.String("video", "", "id of the video stored in the file")
+	channelId := fs.String("channel", defaultChannel, "channel of the video, to mark it as archived")
+	positional, parseError := parseArgs(fs, args)
+	if parseError != nil {
+		return parseError
+	}
+	if len(positional) != 1 || *videoId == "" {
+		return errUsage
+	}
+
+	store, newS3Error := newStorage(ctx)
+	if newS3Error != nil {
+		return newS3Error
+	}
+	client, newClientError := newTwitchClient()
+	if newClientError != nil {
+		return newClientError
+	}
+	video, getVideoError := client.GetVideo(ctx, *videoId)
+	if getVideoError != nil {
+		return getVideoError
+	}
+
+	wd, openError := openWatchdog(ctx, *channelId)
+	if openError != nil {
+		return openError
+	}
+	defer wd.Close()
+	// The storage rejects a file that is not the one downloaded by the watchdog
+	known, getVideoError := wd.GetVideo(video.Id)
+	if getVideoError != nil && !errors.Is(getVideoError, watchdog.ErrVideoNotFound) {
+		return getVideoError
+	}
+	video.Checksum = known.Checksum
+	if video.Checksum == "" {
+		checksum, checksumError := storage.FileChecksum(positional[0])
+		if checksumError != nil {
+			return checksumError
+		}
+		video.Checksum = checksum
+	}
+	if saveError := store.Save(&video, positional[0]); saveError != nil {
+		return saveError
+	}
+
+	if getVideoError == nil && known.Checksum == "" {
+		if checksumError := wd.SetChecksum(video.Id, video.Checksum); checksumError != nil {
+			return checksumError
+		}
+	}
+	if archiveError := wd.MarkArchived(video.Id); archiveError != nil && !errors.Is(archiveError, watchdog.ErrVideoNotFound) {
+		return archiveError
+	}
+	fmt.Printf("video %s uploaded\n", video.Id)
+	return nil
+}
+
+func verifyCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	channelId := fs.String("channel", defaultChannel, "channel of the videos")
+	positional, parseError := parseArgs(fs, args)
+	if parseError != nil {
+		return parseError
+	}
+
+	store, newS3Error := newStorage(ctx)
+	if newS3Error != nil {
+		return newS3Error
+	}
+	wd, openError := openWatchdog(ctx, *channelId)
+	if openError != nil {
+		return openError
+	}
+	defer wd.Close()
+
+	videos := make([]constants.VideoWatched, 0)
+	if len(positional) == 0 {
+		archived, listError := wd.ListVideos(watchdog.VideoFilter{Status: constants.VideoStatusArchived})
+		if listError != nil {
+			return listError
+		}
+		videos = archived
+	}
+	for _, videoId := range positional {
+		video, getVideoError := wd.GetVideo(videoId)
+		if errors.Is(getVideoError, watchdog.ErrVideoNotFound) {
+			// Stored without being known by the database, only the checksum of the object is checked
+			video = constants.VideoWatched{Video: twitch.Video{Id: videoId}}
+		} else if getVideoError != nil {
+			return getVideoError
+		}
+		videos = append(videos, video)
+	}
+
+	failed := 0
+	for _, video := range videos {
+		if verifyError := store.Verify(&video.Video); verifyError != nil {
+			failed++
+			fmt.Printf("video %s FAILED: %s\n", video.Id, verifyError.Error())
+			continue
+		}
+		fmt.Printf("video %s OK\n", video.Id)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d videos failed verification", failed, len(videos))
+	}
+	return nil
+}
+
+func dbCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "migrate" {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("db migrate", flag.ContinueOnError)
+	channelId := fs.String("channel", defaultChannel, "channel of the videos recorded before channels were stored")
+	if _, parseError := parseArgs(fs, args[1:]); parseError != nil {
+		return parseError
+	}
+
+	// Opening the database creates and updates its schema
+	wd, openError := openWatchdog(ctx, *channelId)
+	if openError != nil {
+		return openError
+	}
+	defer wd.Close()
+	if claimError := wd.ClaimOrphanVideos(); claimError != nil {
+		return claimError
+	}
+	fmt.Println("database schema is up to date")
+	return nil
+}
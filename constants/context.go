@@ -18,9 +18,14 @@ const (
 	VideoStatusArchived     = "VIDEO_STATUS_ARCHIVED"
 	VideoStatusDownloaded   = "VIDEO_STATUS_DOWNLOADED"
 	VideoStatusConcatenated = "VIDEO_STATUS_CONCATENATED"
+	VideoStatusLost         = "VIDEO_STATUS_LOST"
+	VideoStatusRecording    = "VIDEO_STATUS_RECORDING"
+	VideoStatusCancelled    = "VIDEO_STATUS_CANCELLED"
+	VideoStatusRestricted   = "VIDEO_STATUS_RESTRICTED"
 )
 
 type VideoWatched struct {
 	twitch.Video
-	Status VideoStatus
+	ChannelId string
+	Status    VideoStatus
 }
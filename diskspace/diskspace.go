@@ -0,0 +1,74 @@
+// Free space of the filesystems videos are written to
+package diskspace
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInsufficientSpace = errors.New("not enough free disk space")
+
+// Returned when a filesystem does not have the space a download needs
+type InsufficientSpaceError struct {
+	Path      string
+	Required  uint64
+	Available uint64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("%s: %s needed in %s, %s available", ErrInsufficientSpace.Error(), FormatSize(e.Required), e.Path, FormatSize(e.Available))
+}
+
+func (e *InsufficientSpaceError) Is(target error) bool {
+	return target == ErrInsufficientSpace
+}
+
+// Fail with an InsufficientSpaceError when the filesystem of path has less than required bytes available.
+// Nothing is checked when the free space cannot be read on this platform.
+func Check(path string, required uint64) error {
+	available, availableError := Available(path)
+	if errors.Is(availableError, errors.ErrUnsupported) {
+		return nil
+	}
+	if availableError != nil {
+		return availableError
+	}
+	if available < required {
+		return &InsufficientSpaceError{Path: path, Required: required, Available: available}
+	}
+	return nil
+}
+
+// Parse a size in bytes like "512M", "10G" or "1T", with binary multiples
+func ParseSize(text string) (uint64, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "B"), "I")
+	multiplier := uint64(1)
+	for suffix, value := range map[string]uint64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40} {
+		if strings.HasSuffix(text, suffix) {
+			text = strings.TrimSuffix(text, suffix)
+			multiplier = value
+			break
+		}
+	}
+	size, parseError := strconv.ParseFloat(text, 64)
+	if parseError != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected bytes like 512M or 10G", text)
+	}
+	return uint64(size * float64(multiplier)), nil
+}
+
+// Size in bytes with the largest binary multiple, like "1.5G"
+func FormatSize(size uint64) string {
+	for _, unit := range []struct {
+		suffix string
+		value  uint64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if size >= unit.value {
+			return strconv.FormatFloat(float64(size)/float64(unit.value), 'f', 1, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatUint(size, 10)
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package diskspace
+
+import "syscall"
+
+// Bytes available to unprivileged users on the filesystem of path
+func Available(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if statError := syscall.Statfs(path, &stat); statError != nil {
+		return 0, statError
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
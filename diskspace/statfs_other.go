@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package diskspace
+
+import (
+	"errors"
+	"fmt"
+)
+
+func Available(path string) (uint64, error) {
+	return 0, fmt.Errorf("free space of %s: %w", path, errors.ErrUnsupported)
+}
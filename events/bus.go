@@ -0,0 +1,139 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DropNewest DropPolicy = iota // Discard the event being published when the subscriber buffer is full
+	DropOldest                   // Discard the oldest buffered event to make room for the new one
+)
+
+type DropPolicy int
+
+// Publish/subscribe bus, every event is delivered to every subscriber
+type Bus[T any] struct {
+	mu          *sync.RWMutex
+	subscribers map[*Subscription[T]]struct{}
+	closed      bool
+}
+
+type Subscription[T any] struct {
+	Name    string
+	C       <-chan T // Events delivered to the subscriber, closed on Unsubscribe or when the bus is closed
+	ch      chan T
+	policy  DropPolicy
+	dropped *atomic.Uint64
+	mu      *sync.Mutex // Serializes deliveries so DropOldest never races with another publisher
+	bus     *Bus[T]
+}
+
+func NewBus[T any]() *Bus[T] {
+	return &Bus[T]{
+		mu:          &sync.RWMutex{},
+		subscribers: make(map[*Subscription[T]]struct{}),
+	}
+}
+
+func (b *Bus[T]) Subscribe(name string, bufferSize int, policy DropPolicy) *Subscription[T] {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	ch := make(chan T, bufferSize)
+	sub := &Subscription[T]{
+		Name:    name,
+		C:       ch,
+		ch:      ch,
+		policy:  policy,
+		dropped: &atomic.Uint64{},
+		mu:      &sync.Mutex{},
+		bus:     b,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return sub
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Deliver the event to every subscriber without waiting, a full subscriber loses an event according to its policy
+func (b *Bus[T]) Publish(event T) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	for sub := range b.subscribers {
+		sub.deliver(event)
+	}
+}
+
+// Close every subscription, events published afterwards are discarded
+func (b *Bus[T]) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subscribers {
+		close(sub.ch)
+		delete(b.subscribers, sub)
+	}
+}
+
+func (b *Bus[T]) Subscriptions() []*Subscription[T] {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	subs := make([]*Subscription[T], 0, len(b.subscribers))
+	for sub := range b.subscribers {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+func (s *Subscription[T]) deliver(event T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.policy {
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- event:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- event:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Number of events the subscriber missed because its buffer was full
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription[T]) Unsubscribe() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, found := s.bus.subscribers[s]; !found {
+		return
+	}
+	delete(s.bus.subscribers, s)
+	close(s.ch)
+}
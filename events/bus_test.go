@@ -0,0 +1,121 @@
+package events_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"enssat.tv/autovodsaver/events"
+)
+
+// Read the events already buffered by the subscription without waiting
+func drain(sub *events.Subscription[int]) []int {
+	received := make([]int, 0)
+	for {
+		select {
+		case event, open := <-sub.C:
+			if !open {
+				return received
+			}
+			received = append(received, event)
+		default:
+			return received
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	bus := events.NewBus[int]()
+	defer bus.Close()
+	first := bus.Subscribe("first", 10, events.DropNewest)
+	second := bus.Subscribe("second", 10, events.DropOldest)
+
+	for event := 1; event <= 3; event++ {
+		bus.Publish(event)
+	}
+	for _, sub := range []*events.Subscription[int]{first, second} {
+		if received := drain(sub); !reflect.DeepEqual(received, []int{1, 2, 3}) {
+			t.Errorf("subscriber %s received %v, want [1 2 3]", sub.Name, received)
+		}
+	}
+	if subs := bus.Subscriptions(); len(subs) != 2 {
+		t.Errorf("bus has %d subscriptions, want 2", len(subs))
+	}
+}
+
+func TestDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy   events.DropPolicy
+		received []int
+	}{
+		{policy: events.DropNewest, received: []int{1, 2}},
+		{policy: events.DropOldest, received: []int{4, 5}},
+	}
+	for _, test := range tests {
+		bus := events.NewBus[int]()
+		sub := bus.Subscribe("slow", 2, test.policy)
+		for event := 1; event <= 5; event++ {
+			bus.Publish(event)
+		}
+		if received := drain(sub); !reflect.DeepEqual(received, test.received) {
+			t.Errorf("policy %d received %v, want %v", test.policy, received, test.received)
+		}
+		if dropped := sub.Dropped(); dropped != 3 {
+			t.Errorf("policy %d dropped %d events, want 3", test.policy, dropped)
+		}
+		bus.Close()
+	}
+}
+
+func TestPublishAfterClose(t *testing.T) {
+	bus := events.NewBus[int]()
+	sub := bus.Subscribe("subscriber", 10, events.DropNewest)
+	bus.Publish(1)
+	bus.Close()
+	bus.Publish(2)
+	bus.Close()
+
+	if received := drain(sub); !reflect.DeepEqual(received, []int{1}) {
+		t.Errorf("subscriber received %v, want [1]", received)
+	}
+	if _, open := <-sub.C; open {
+		t.Error("subscription is still open after Close")
+	}
+	// Subscribing to a closed bus gives a closed subscription
+	if _, open := <-bus.Subscribe("late", 10, events.DropNewest).C; open {
+		t.Error("subscription to a closed bus is open")
+	}
+	sub.Unsubscribe()
+}
+
+func TestUnsubscribeWhilePublishing(t *testing.T) {
+	bus := events.NewBus[int]()
+	defer bus.Close()
+	stay := bus.Subscribe("stay", 1, events.DropOldest)
+
+	wg := &sync.WaitGroup{}
+	for publisher := 0; publisher < 4; publisher++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := 0; event < 1000; event++ {
+				bus.Publish(event)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		sub := bus.Subscribe("leaving", 1, events.DropNewest)
+		sub.Unsubscribe()
+		sub.Unsubscribe()
+		for range sub.C {
+		}
+	}
+	wg.Wait()
+
+	if subs := bus.Subscriptions(); len(subs) != 1 || subs[0] != stay {
+		t.Errorf("bus has %d subscriptions, want only the remaining one", len(subs))
+	}
+	if received := drain(stay); len(received) != 1 {
+		t.Errorf("remaining subscriber buffered %d events, want 1", len(received))
+	}
+}
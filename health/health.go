@@ -0,0 +1,111 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const probeTimeout = 5 * time.Second
+
+const (
+	Liveness  Kind = iota // The process must be restarted when a liveness check fails
+	Readiness             // The process must not receive work when a readiness check fails
+)
+
+type Kind int
+
+type Check struct {
+	Name  string
+	Kind  Kind
+	Probe func(ctx context.Context) error
+}
+
+type Checker struct {
+	mu      *sync.Mutex
+	checks  []Check
+	sources []func() []Check
+}
+
+type report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		mu:      &sync.Mutex{},
+		checks:  make([]Check, 0),
+		sources: make([]func() []Check, 0),
+	}
+}
+
+func (c *Checker) Add(check Check) {
+	c.mu.Lock()
+	c.checks = append(c.checks, check)
+	c.mu.Unlock()
+}
+
+// Add checks that are listed again every time the health is probed, for components that come and go
+func (c *Checker) AddSource(source func() []Check) {
+	c.mu.Lock()
+	c.sources = append(c.sources, source)
+	c.mu.Unlock()
+}
+
+// Run the checks of the given kind, readiness also includes the liveness checks
+func (c *Checker) Run(ctx context.Context, kind Kind) (bool, map[string]string) {
+	c.mu.Lock()
+	checks := append([]Check(nil), c.checks...)
+	sources := append([]func() []Check(nil), c.sources...)
+	c.mu.Unlock()
+	for _, source := range sources {
+		checks = append(checks, source()...)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	healthy := true
+	results := make(map[string]string)
+	resultsMu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, check := range checks {
+		if check.Kind > kind {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "ok"
+			if probeError := check.Probe(ctx); probeError != nil {
+				result = probeError.Error()
+			}
+			resultsMu.Lock()
+			if result != "ok" {
+				healthy = false
+			}
+			results[check.Name] = result
+			resultsMu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return healthy, results
+}
+
+func (c *Checker) Handler(kind Kind) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthy, results := c.Run(r.Context(), kind)
+		body := report{Status: "ok", Checks: results}
+		status := http.StatusOK
+		if !healthy {
+			body.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	})
+}
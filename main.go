@@ -2,41 +2,339 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"enssat.tv/autovodsaver/api"
+	"enssat.tv/autovodsaver/bandwidth"
 	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/diskspace"
+	"enssat.tv/autovodsaver/events"
+	"enssat.tv/autovodsaver/health"
+	"enssat.tv/autovodsaver/metrics"
 	"enssat.tv/autovodsaver/storage"
+	"enssat.tv/autovodsaver/twitch"
 	"enssat.tv/autovodsaver/watchdog"
 	"github.com/rs/zerolog"
 )
 
 const (
-	accessKey = ""
-	secretKey = ""
+	accessKey      = ""
+	secretKey      = ""
+	defaultChannel = "mistermv"
+	// Only reachable from the host unless AUTOVODSAVER_API_ADDRESS says otherwise
+	defaultAPIAddress = "127.0.0.1:8080"
 )
 
 func main() {
 	ctx := context.Background()
 
 	// Setup logger
-	logger := zerolog.New(nil).Output(zerolog.ConsoleWriter{Out: os.Stdout}).Level(zerolog.InfoLevel)
+	logger := zerolog.New(nil).Output(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.InfoLevel)
 	ctx = context.WithValue(ctx, constants.LoggerKey, &logger)
 
-	// Setup storage
+	// Without subcommand the daemon is started
+	if len(os.Args) > 1 {
+		if commandError := runCommand(ctx, os.Args[1], os.Args[2:]); commandError != nil {
+			logger.Error().Msg(commandError.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if daemonError := runDaemon(ctx); daemonError != nil {
+		logger.Error().Msg(daemonError.Error())
+		os.Exit(1)
+	}
+}
+
+func newStorage(ctx context.Context) (*storage.S3Storage, error) {
+	limits, limitsError := newBandwidthLimits("UPLOAD")
+	if limitsError != nil {
+		return nil, limitsError
+	}
 	store, newS3Error := storage.NewS3StorageWithContext(ctx, "http://:9000", "eu-west", "enssatv", storage.Credentials{
 		AccessKey: accessKey,
 		SecretKey: secretKey,
 		Session:   "",
 	})
 	if newS3Error != nil {
-		logger.Error().Msg(newS3Error.Error())
-		os.Exit(1)
+		return nil, newS3Error
+	}
+	store.Bandwidth = limits
+	return store, nil
+}
+
+// Read the caps of a direction from AUTOVODSAVER_<DIRECTION>_BANDWIDTH, shared by every transfer,
+// and AUTOVODSAVER_<DIRECTION>_BANDWIDTH_PER_TRANSFER, as schedules like "10M,08:00-19:00=1M"
+func newBandwidthLimits(direction string) (*bandwidth.Limits, error) {
+	schedules := make([]bandwidth.Schedule, 2)
+	for i, variable := range []string{"AUTOVODSAVER_" + direction + "_BANDWIDTH", "AUTOVODSAVER_" + direction + "_BANDWIDTH_PER_TRANSFER"} {
+		schedule, parseError := bandwidth.ParseSchedule(os.Getenv(variable))
+		if parseError != nil {
+			return nil, fmt.Errorf("invalid %s: %w", variable, parseError)
+		}
+		schedules[i] = schedule
+	}
+	return bandwidth.NewLimits(schedules[0], schedules[1]), nil
+}
+
+// Build the Twitch client from the environment, proxies also come from HTTP_PROXY and HTTPS_PROXY
+func newTwitchClient() (*twitch.Client, error) {
+	options := twitch.ClientOptions{
+		GraphQLBaseURL: os.Getenv("AUTOVODSAVER_TWITCH_GQL_URL"),
+		UsherBaseURL:   os.Getenv("AUTOVODSAVER_TWITCH_USHER_URL"),
+		UserAgent:      os.Getenv("AUTOVODSAVER_TWITCH_USER_AGENT"),
+		ClientId:       os.Getenv("AUTOVODSAVER_TWITCH_CLIENT_ID"),
+		WorkDir:        os.Getenv("AUTOVODSAVER_WORK_DIR"),
+	}
+	if proxy := os.Getenv("AUTOVODSAVER_TWITCH_PROXY"); proxy != "" {
+		proxyUrl, parseError := url.Parse(proxy)
+		if parseError != nil {
+			return nil, fmt.Errorf("invalid twitch proxy: %w", parseError)
+		}
+		options.Proxy = proxyUrl
+	}
+	if timeout := os.Getenv("AUTOVODSAVER_TWITCH_TIMEOUT"); timeout != "" {
+		duration, parseError := time.ParseDuration(timeout)
+		if parseError != nil {
+			return nil, fmt.Errorf("invalid twitch timeout: %w", parseError)
+		}
+		options.Timeout = duration
+	}
+	limits, limitsError := newBandwidthLimits("DOWNLOAD")
+	if limitsError != nil {
+		return nil, limitsError
+	}
+	options.Bandwidth = limits
+	// Rates are requests per second, a negative rate disables the limit
+	for variable, rate := range map[string]*float64{"AUTOVODSAVER_TWITCH_GQL_RATE": &options.GraphQLRate, "AUTOVODSAVER_TWITCH_MEDIA_RATE": &options.MediaRate} {
+		if value := os.Getenv(variable); value != "" {
+			parsed, parseError := strconv.ParseFloat(value, 64)
+			if parseError != nil {
+				return nil, fmt.Errorf("invalid %s: %w", variable, parseError)
+			}
+			*rate = parsed
+		}
+	}
+	return twitch.NewClient(options), nil
+}
+
+// Keep the videos and the watched channels in Postgres when AUTOVODSAVER_POSTGRES_URL is set,
+// in the local SQLite database otherwise
+func newRepository(ctx context.Context) *watchdog.SQLRepository {
+	if dataSource := os.Getenv("AUTOVODSAVER_POSTGRES_URL"); dataSource != "" {
+		return watchdog.NewPostgresRepositoryWithContext(ctx, dataSource)
+	}
+	return watchdog.NewSQLiteRepositoryWithContext(ctx, "./db.sqlite")
+}
+
+func newWatchdog(ctx context.Context, client *twitch.Client, channelId string) *watchdog.Watchdog {
+	wd := watchdog.NewWatchdogWithContext(ctx, channelId, newRepository(ctx))
+	wd.Twitch = client
+	if token, found := oauthTokens()[channelId]; found {
+		wd.Twitch = client.WithOAuthToken(token)
+	}
+	return wd
+}
+
+// Tokens of users subscribed to the channels, read from AUTOVODSAVER_TWITCH_OAUTH_TOKENS as "channel=token,other=token"
+func oauthTokens() map[string]string {
+	tokens := make(map[string]string)
+	for _, item := range splitList(os.Getenv("AUTOVODSAVER_TWITCH_OAUTH_TOKENS")) {
+		if channel, token, found := strings.Cut(item, "="); found && channel != "" && token != "" {
+			tokens[channel] = token
+		}
+	}
+	return tokens
+}
+
+// Read AUTOVODSAVER_STREAM_UPLOAD, to upload videos while they are downloaded, and AUTOVODSAVER_STREAM_WINDOW,
+// the number of chunks downloaded ahead
+func streamingOptions() (bool, int, error) {
+	streaming := false
+	if value := os.Getenv("AUTOVODSAVER_STREAM_UPLOAD"); value != "" {
+		parsed, parseError := strconv.ParseBool(value)
+		if parseError != nil {
+			return false, 0, fmt.Errorf("invalid AUTOVODSAVER_STREAM_UPLOAD: %w", parseError)
+		}
+		streaming = parsed
+	}
+	window := twitch.DefaultStreamWindow
+	if value := os.Getenv("AUTOVODSAVER_STREAM_WINDOW"); value != "" {
+		parsed, parseError := strconv.Atoi(value)
+		if parseError != nil || parsed < 1 {
+			return false, 0, fmt.Errorf("invalid AUTOVODSAVER_STREAM_WINDOW %q, expected a positive number of chunks", value)
+		}
+		window = parsed
+	}
+	return streaming, window, nil
+}
+
+func runDaemon(ctx context.Context) error {
+	logger := ctx.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	// Setup storage
+	store, newS3Error := newStorage(ctx)
+	if newS3Error != nil {
+		return newS3Error
 	}
 	ctx = context.WithValue(ctx, constants.StorageKey, &store)
 
+	// Setup twitch
+	client, newClientError := newTwitchClient()
+	if newClientError != nil {
+		return newClientError
+	}
+
+	// Downloads left behind by a previous run that did not stop cleanly, a directory written in the last minute
+	// may belong to a download command running meanwhile
+	removed, cleanError := twitch.CleanWorkDir(client.WorkDir(), time.Now().Add(-time.Minute))
+	if cleanError != nil {
+		return fmt.Errorf("clean work directory: %w", cleanError)
+	}
+	for _, stalePath := range removed {
+		logger.Info().Msgf("stale download directory %s removed", stalePath)
+	}
+
+	// Downloads wait while the disk is almost full
+	var minFreeSpace uint64
+	if value := os.Getenv("AUTOVODSAVER_MIN_FREE_SPACE"); value != "" {
+		parsed, parseError := diskspace.ParseSize(value)
+		if parseError != nil {
+			return fmt.Errorf("invalid AUTOVODSAVER_MIN_FREE_SPACE: %w", parseError)
+		}
+		minFreeSpace = parsed
+	}
+
+	// Upload the videos while they are downloaded instead of keeping a local copy
+	streaming, streamWindow, streamingError := streamingOptions()
+	if streamingError != nil {
+		return streamingError
+	}
+
+	// Videos of every channel are ranked together
+	scheduling, slots, schedulingError := schedulingOptions()
+	if schedulingError != nil {
+		return schedulingError
+	}
+
+	// Every watchdog publishes its updates on the same bus
+	bus := events.NewBus[watchdog.UpdateMessage]()
+	defer bus.Close()
+	metrics.ObserveBus(bus, func(msg watchdog.UpdateMessage) string {
+		return string(msg.Kind)
+	})
+
+	// Setup notifications
+	notifier, newNotifierError := newNotifier(ctx)
+	if newNotifierError != nil {
+		return newNotifierError
+	}
+	notifier.Start(bus)
+	defer notifier.Stop()
+
+	// Channels added through the api are watched again on restart
+	channelStore := newRepository(ctx)
+	if openError := channelStore.Open(); openError != nil {
+		return fmt.Errorf("open channel store: %w", openError)
+	}
+	defer channelStore.Close()
+
+	apiAddress := os.Getenv("AUTOVODSAVER_API_ADDRESS")
+	if apiAddress == "" {
+		apiAddress = defaultAPIAddress
+	}
+
 	logger.Info().Msg("AutoVODSaver (by EnssaTV)")
-	wd := watchdog.NewWithContext(ctx, "sqlite", "mistermv")
-	wd.Run()
-	defer wd.Stop()
-	select {}
+	server := api.NewServerWithContext(ctx, apiAddress, func(ctx context.Context, channelId string) api.ManagedWatchdog {
+		wd := newWatchdog(ctx, client, channelId)
+		wd.Events = bus
+		wd.MinFreeSpace = minFreeSpace
+		wd.Scheduling = scheduling
+		wd.Slots = slots
+		if streaming {
+			wd.Storage = store
+			wd.StreamWindow = streamWindow
+		}
+		return wd
+	})
+	server.Events = bus
+	server.Health.Add(health.Check{Name: "storage", Kind: health.Readiness, Probe: store.Ping})
+	server.ChannelStore = channelStore
+	// Required to add or remove channels and act on videos when set
+	server.Token = os.Getenv("AUTOVODSAVER_API_TOKEN")
+	if restoreError := server.RestoreChannels(defaultChannel); restoreError != nil {
+		return restoreError
+	}
+	if startError := server.Start(); startError != nil {
+		return startError
+	}
+
+	// Wait for a termination signal then let the watchdogs drain their in-flight work
+	signalCtx, stopSignals := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	<-signalCtx.Done()
+	logger.Info().Msg("shutting down, waiting for in-flight work to finish")
+	if stopError := server.Stop(); stopError != nil {
+		return fmt.Errorf("shutdown: %w", stopError)
+	}
+	logger.Info().Msg("AutoVODSaver stopped")
+	return nil
+}
+
+// Read AUTOVODSAVER_RETENTION, how long Twitch keeps the vods of a channel, AUTOVODSAVER_CHANNEL_RETENTIONS and
+// AUTOVODSAVER_CHANNEL_WEIGHTS, set per channel as "channel=336h,other=48h" and "channel=2,other=0.5", and
+// AUTOVODSAVER_MAX_DOWNLOADS, the downloads running at once across every channel, one per channel when unset
+func schedulingOptions() (*watchdog.SchedulingPolicy, *watchdog.DownloadSlots, error) {
+	var retention time.Duration
+	if value := os.Getenv("AUTOVODSAVER_RETENTION"); value != "" {
+		parsed, parseError := time.ParseDuration(value)
+		if parseError != nil || parsed <= 0 {
+			return nil, nil, fmt.Errorf("invalid AUTOVODSAVER_RETENTION %q, expected a positive duration", value)
+		}
+		retention = parsed
+	}
+	policy := watchdog.NewSchedulingPolicy(retention)
+	for _, item := range splitList(os.Getenv("AUTOVODSAVER_CHANNEL_RETENTIONS")) {
+		channel, value, _ := strings.Cut(item, "=")
+		parsed, parseError := time.ParseDuration(value)
+		if channel == "" || parseError != nil || parsed <= 0 {
+			return nil, nil, fmt.Errorf("invalid AUTOVODSAVER_CHANNEL_RETENTIONS entry %q, expected channel=duration", item)
+		}
+		policy.SetChannelRetention(channel, parsed)
+	}
+	for _, item := range splitList(os.Getenv("AUTOVODSAVER_CHANNEL_WEIGHTS")) {
+		channel, value, _ := strings.Cut(item, "=")
+		parsed, parseError := strconv.ParseFloat(value, 64)
+		if channel == "" || parseError != nil || parsed <= 0 {
+			return nil, nil, fmt.Errorf("invalid AUTOVODSAVER_CHANNEL_WEIGHTS entry %q, expected channel=positive number", item)
+		}
+		policy.SetChannelWeight(channel, parsed)
+	}
+	var slots *watchdog.DownloadSlots
+	if value := os.Getenv("AUTOVODSAVER_MAX_DOWNLOADS"); value != "" {
+		parsed, parseError := strconv.Atoi(value)
+		if parseError != nil || parsed < 1 {
+			return nil, nil, fmt.Errorf("invalid AUTOVODSAVER_MAX_DOWNLOADS %q, expected a positive number", value)
+		}
+		slots = watchdog.NewDownloadSlots(parsed)
+	}
+	return policy, slots, nil
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
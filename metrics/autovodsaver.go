@@ -0,0 +1,34 @@
+package metrics
+
+var (
+	Default = NewRegistry()
+
+	VideosDiscovered = NewCounterVec("autovodsaver_videos_discovered_total", "Videos discovered while polling Twitch.", "channel")
+	Syncs            = NewCounterVec("autovodsaver_syncs_total", "Synchronizations with Twitch by result.", "channel", "result")
+	SyncDuration     = NewHistogramVec("autovodsaver_sync_duration_seconds", "Duration of a synchronization with Twitch.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "channel")
+
+	Downloads        = NewCounterVec("autovodsaver_downloads_total", "Video downloads by result.", "result")
+	DownloadRetries  = NewCounterVec("autovodsaver_download_retries_total", "Videos queued again after a failed download.", "channel")
+	ChunksDownloaded = NewCounterVec("autovodsaver_chunks_downloaded_total", "Video chunks downloaded.")
+	BytesDownloaded  = NewCounterVec("autovodsaver_downloaded_bytes_total", "Bytes of video chunks downloaded.")
+	CorruptChunks    = NewCounterVec("autovodsaver_corrupt_chunks_total", "Chunk downloads rejected by the segment validation.")
+	ChunkErrors      = NewCounterVec("autovodsaver_chunk_errors_total", "Chunk downloads that failed before the segment validation by error type.", "type")
+	ChunkLatency     = NewHistogramVec("autovodsaver_chunk_download_duration_seconds", "Duration of a chunk download.", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+	QueueDepth       = NewGaugeFuncVec("autovodsaver_download_queue_depth", "Videos waiting in the download queue.", "channel")
+	UploadDuration   = NewHistogramVec("autovodsaver_upload_duration_seconds", "Duration of a video upload to the storage.", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}, "result")
+	BytesUploaded    = NewCounterVec("autovodsaver_uploaded_bytes_total", "Bytes of videos uploaded to the storage.")
+	GraphQLRequests  = NewCounterVec("autovodsaver_graphql_requests_total", "Requests sent to the Twitch GraphQL api.")
+	GraphQLErrors    = NewCounterVec("autovodsaver_graphql_errors_total", "Failed requests to the Twitch GraphQL api by error type.", "type")
+	TwitchThrottled  = NewCounterVec("autovodsaver_twitch_throttled_total", "Requests to Twitch rejected with status 429 by traffic.", "traffic")
+)
+
+func init() {
+	for _, collector := range []Collector{
+		VideosDiscovered, Syncs, SyncDuration,
+		Downloads, DownloadRetries, ChunksDownloaded, BytesDownloaded, CorruptChunks, ChunkErrors, ChunkLatency, QueueDepth,
+		UploadDuration, BytesUploaded,
+		GraphQLRequests, GraphQLErrors, TwitchThrottled,
+	} {
+		Default.Register(collector)
+	}
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+
+	"enssat.tv/autovodsaver/events"
+)
+
+var Events = NewCounterVec("autovodsaver_events_total", "Events published on the event bus by kind.", "kind")
+
+func init() {
+	Default.Register(Events)
+}
+
+// Exposes how many events each subscriber of a bus missed because it could not keep up
+type busDropsCollector[T any] struct {
+	bus *events.Bus[T]
+}
+
+func (c busDropsCollector[T]) Write(w io.Writer) error {
+	if _, writeError := fmt.Fprint(w, "# HELP autovodsaver_events_dropped_total Events a subscriber of the event bus missed because it could not keep up.\n# TYPE autovodsaver_events_dropped_total counter\n"); writeError != nil {
+		return writeError
+	}
+	for _, sub := range c.bus.Subscriptions() {
+		if _, writeError := fmt.Fprintf(w, "autovodsaver_events_dropped_total%s %d\n", formatLabels([]string{"subscriber"}, []string{sub.Name}), sub.Dropped()); writeError != nil {
+			return writeError
+		}
+	}
+	return nil
+}
+
+// Count the events published on the bus by kind and expose the drops of its subscribers, until the bus is closed
+func ObserveBus[T any](bus *events.Bus[T], kind func(event T) string) {
+	Default.Register(busDropsCollector[T]{bus: bus})
+	subscription := bus.Subscribe("metrics", 1000, events.DropOldest)
+	go func() {
+		for event := range subscription.C {
+			Events.Inc(kind(event))
+		}
+	}()
+}
@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Any metric that can be written in the Prometheus text exposition format
+type Collector interface {
+	Write(w io.Writer) error
+}
+
+type Registry struct {
+	mu         *sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mu:         &sync.Mutex{},
+		collectors: make([]Collector, 0),
+	}
+}
+
+func (r *Registry) Register(collector Collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, collector)
+	r.mu.Unlock()
+}
+
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := make([]Collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+
+	for _, collector := range collectors {
+		if writeError := collector.Write(w); writeError != nil {
+			return writeError
+		}
+	}
+	return nil
+}
+
+// Serve the metrics of the registry in the Prometheus text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// Values of a metric indexed by their label values
+type series[T any] struct {
+	mu         *sync.Mutex
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	values     map[string]T
+	labels     map[string][]string
+}
+
+func newSeries[T any](name string, help string, kind string, labelNames []string) series[T] {
+	return series[T]{
+		mu:         &sync.Mutex{},
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     make(map[string]T),
+		labels:     make(map[string][]string),
+	}
+}
+
+// Must be called with the lock held
+func (s *series[T]) get(labelValues []string, create func() T) T {
+	if len(labelValues) != len(s.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", s.name, len(s.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	value, found := s.values[key]
+	if !found {
+		value = create()
+		s.values[key] = value
+		s.labels[key] = append([]string(nil), labelValues...)
+	}
+	return value
+}
+
+// Must be called with the lock held
+func (s *series[T]) delete(labelValues []string) {
+	key := strings.Join(labelValues, "\xff")
+	delete(s.values, key)
+	delete(s.labels, key)
+}
+
+// Must be called with the lock held, yields the series sorted by labels so the output is stable
+func (s *series[T]) each(yield func(labelValues []string, value T)) {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		yield(s.labels[key], s.values[key])
+	}
+}
+
+func (s *series[T]) writeHeader(w io.Writer) error {
+	_, writeError := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+	return writeError
+}
+
+// Only the backslash, the double quote and the line feed are escaped in label values, unlike the Go quoting
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], labelValueEscaper.Replace(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type CounterVec struct {
+	series[*float64]
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newSeries[*float64](name, help, "counter", labelNames)}
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.mu.Lock()
+	*c.get(labelValues, func() *float64 { return new(float64) }) += value
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if writeError := c.writeHeader(w); writeError != nil {
+		return writeError
+	}
+	var writeError error
+	c.each(func(labelValues []string, value *float64) {
+		if writeError == nil {
+			_, writeError = fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labelNames, labelValues), formatFloat(*value))
+		}
+	})
+	return writeError
+}
+
+// A gauge whose values are read from functions when the metrics are collected
+type GaugeFuncVec struct {
+	series[func() float64]
+}
+
+func NewGaugeFuncVec(name string, help string, labelNames ...string) *GaugeFuncVec {
+	return &GaugeFuncVec{newSeries[func() float64](name, help, "gauge", labelNames)}
+}
+
+func (g *GaugeFuncVec) Set(read func() float64, labelValues ...string) {
+	g.mu.Lock()
+	// Replace the function of a series that already exists
+	g.delete(labelValues)
+	g.get(labelValues, func() func() float64 { return read })
+	g.mu.Unlock()
+}
+
+func (g *GaugeFuncVec) Delete(labelValues ...string) {
+	g.mu.Lock()
+	g.delete(labelValues)
+	g.mu.Unlock()
+}
+
+func (g *GaugeFuncVec) Write(w io.Writer) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if writeError := g.writeHeader(w); writeError != nil {
+		return writeError
+	}
+	var writeError error
+	g.each(func(labelValues []string, read func() float64) {
+		if writeError == nil {
+			_, writeError = fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labelNames, labelValues), formatFloat(read()))
+		}
+	})
+	return writeError
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type HistogramVec struct {
+	series[*histogram]
+	buckets []float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{
+		series:  newSeries[*histogram](name, help, "histogram", labelNames),
+		buckets: sorted,
+	}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist := h.get(labelValues, func() *histogram {
+		return &histogram{counts: make([]uint64, len(h.buckets))}
+	})
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += value
+	hist.count++
+}
+
+func (h *HistogramVec) Write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if writeError := h.writeHeader(w); writeError != nil {
+		return writeError
+	}
+	var writeError error
+	write := func(format string, args ...any) {
+		if writeError == nil {
+			_, writeError = fmt.Fprintf(w, format, args...)
+		}
+	}
+	h.each(func(labelValues []string, hist *histogram) {
+		for i, bound := range h.buckets {
+			write("%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, labelValues, "le", formatFloat(bound)), hist.counts[i])
+		}
+		write("%s_bucket%s %d\n", h.name, formatLabels(h.labelNames, labelValues, "le", "+Inf"), hist.count)
+		write("%s_sum%s %s\n", h.name, formatLabels(h.labelNames, labelValues), formatFloat(hist.sum))
+		write("%s_count%s %d\n", h.name, formatLabels(h.labelNames, labelValues), hist.count)
+	})
+	return writeError
+}
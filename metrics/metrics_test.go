@@ -0,0 +1,67 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"enssat.tv/autovodsaver/metrics"
+)
+
+const exposition = `# HELP test_chunks_total Chunks downloaded
+# TYPE test_chunks_total counter
+test_chunks_total{channel="a\\b",result="ok"} 3
+test_chunks_total{channel="quote\"d",result="line\nfeed"} 0.5
+# HELP test_queue_size Videos waiting
+# TYPE test_queue_size gauge
+test_queue_size{channel="café` + "\t" + `"} 7
+test_queue_size{channel="other"} 0
+# HELP test_duration_seconds Download duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{channel="a",le="0.5"} 1
+test_duration_seconds_bucket{channel="a",le="10"} 2
+test_duration_seconds_bucket{channel="a",le="+Inf"} 3
+test_duration_seconds_sum{channel="a"} 32.75
+test_duration_seconds_count{channel="a"} 3
+# HELP test_uptime_seconds Uptime
+# TYPE test_uptime_seconds gauge
+test_uptime_seconds 42
+`
+
+func TestExposition(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	chunks := metrics.NewCounterVec("test_chunks_total", "Chunks downloaded", "channel", "result")
+	chunks.Add(2, `a\b`, "ok")
+	chunks.Inc(`a\b`, "ok")
+	chunks.Add(0.5, `quote"d`, "line\nfeed")
+	registry.Register(chunks)
+
+	queue := metrics.NewGaugeFuncVec("test_queue_size", "Videos waiting", "channel")
+	queue.Set(func() float64 { return 1 }, "other")
+	queue.Set(func() float64 { return 0 }, "other")
+	queue.Set(func() float64 { return 7 }, "café\t")
+	queue.Set(func() float64 { return 9 }, "removed")
+	queue.Delete("removed")
+	registry.Register(queue)
+
+	duration := metrics.NewHistogramVec("test_duration_seconds", "Download duration", []float64{10, 0.5}, "channel")
+	for _, value := range []float64{0.25, 10, 22.5} {
+		duration.Observe(value, "a")
+	}
+	registry.Register(duration)
+
+	uptime := metrics.NewGaugeFuncVec("test_uptime_seconds", "Uptime")
+	uptime.Set(func() float64 { return 42 })
+	registry.Register(uptime)
+
+	res := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if contentType := res.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the text exposition format", contentType)
+	}
+	if body := res.Body.String(); body != exposition {
+		t.Errorf("exposition =\n%s\nwant\n%s", body, exposition)
+	}
+}
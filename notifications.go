@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"os"
+
+	"enssat.tv/autovodsaver/notify"
+)
+
+// Build the notifier from the environment, every sink is optional
+func newNotifier(ctx context.Context) (*notify.Notifier, error) {
+	events := splitList(os.Getenv("AUTOVODSAVER_NOTIFY_EVENTS"))
+	subscriptions := make([]notify.Subscription, 0)
+
+	if url := os.Getenv("AUTOVODSAVER_WEBHOOK_URL"); url != "" {
+		webhook, webhookError := notify.NewWebhook(url, os.Getenv("AUTOVODSAVER_WEBHOOK_TEMPLATE"))
+		if webhookError != nil {
+			return nil, webhookError
+		}
+		subscriptions = append(subscriptions, notify.Subscription{Name: "webhook", Sink: webhook, Events: events})
+	}
+
+	if url := os.Getenv("AUTOVODSAVER_DISCORD_WEBHOOK_URL"); url != "" {
+		discord, discordError := notify.NewDiscordWebhook(url, os.Getenv("AUTOVODSAVER_DISCORD_TEMPLATE"))
+		if discordError != nil {
+			return nil, discordError
+		}
+		subscriptions = append(subscriptions, notify.Subscription{Name: "discord", Sink: discord, Events: events})
+	}
+
+	if address := os.Getenv("AUTOVODSAVER_SMTP_ADDRESS"); address != "" {
+		var auth smtp.Auth
+		if username := os.Getenv("AUTOVODSAVER_SMTP_USERNAME"); username != "" {
+			host, _, splitError := net.SplitHostPort(address)
+			if splitError != nil {
+				return nil, splitError
+			}
+			auth = smtp.PlainAuth("", username, os.Getenv("AUTOVODSAVER_SMTP_PASSWORD"), host)
+		}
+		mail, mailError := notify.NewMail(address, auth, os.Getenv("AUTOVODSAVER_SMTP_FROM"), splitList(os.Getenv("AUTOVODSAVER_SMTP_TO")), "", "")
+		if mailError != nil {
+			return nil, mailError
+		}
+		subscriptions = append(subscriptions, notify.Subscription{Name: "mail", Sink: mail, Events: events})
+	}
+
+	return notify.NewWithContext(ctx, subscriptions...), nil
+}
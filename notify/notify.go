@@ -0,0 +1,227 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/events"
+	"enssat.tv/autovodsaver/watchdog"
+	"github.com/rs/zerolog"
+)
+
+const (
+	EventDiscovered = "video.discovered"
+	EventDownloaded = "video.downloaded"
+	EventArchived   = "video.archived"
+	EventFailed     = "video.failed"
+	EventLost       = "video.lost"
+
+	defaultMaxAttempts  = 5
+	defaultRetryBackoff = 2 * time.Second
+	defaultStopTimeout  = 30 * time.Second
+	eventsBufferSize    = 100
+)
+
+type Event struct {
+	Name  string
+	Video constants.VideoWatched
+	Time  time.Time
+}
+
+// Somewhere notifications are delivered
+type Sink interface {
+	Send(ctx context.Context, event Event) error
+}
+
+// A sink and the events it is interested in
+type Subscription struct {
+	Name   string
+	Sink   Sink
+	Events []string // Every event is sent when empty
+}
+
+func (s Subscription) wants(eventName string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, name := range s.Events {
+		if name == eventName {
+			return true
+		}
+	}
+	return false
+}
+
+type Notifier struct {
+	Context       context.Context
+	Subscriptions []Subscription
+	MaxAttempts   int
+	RetryBackoff  time.Duration // Delay before the first retry, doubled after each attempt
+	StopTimeout   time.Duration // How long Stop waits for the pending notifications before giving up on them
+	subscription  *events.Subscription[watchdog.UpdateMessage]
+	sendContext   context.Context // Cancelled when Stop gives up, to abort the retries and the deliveries in progress
+	cancelSend    context.CancelFunc
+	wg            *sync.WaitGroup
+}
+
+func New(subscriptions ...Subscription) *Notifier {
+	return NewWithContext(context.Background(), subscriptions...)
+}
+
+func NewWithContext(ctx context.Context, subscriptions ...Subscription) *Notifier {
+	return &Notifier{
+		Context:       ctx,
+		Subscriptions: subscriptions,
+		MaxAttempts:   defaultMaxAttempts,
+		RetryBackoff:  defaultRetryBackoff,
+		StopTimeout:   defaultStopTimeout,
+		wg:            &sync.WaitGroup{},
+	}
+}
+
+// Deliver notifications for the updates published on the bus until Stop is called,
+// the oldest updates are dropped when notifications cannot keep up
+func (n *Notifier) Start(bus *events.Bus[watchdog.UpdateMessage]) {
+	n.subscription = bus.Subscribe("notifier", eventsBufferSize, events.DropOldest)
+	n.sendContext, n.cancelSend = context.WithCancel(n.Context)
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for msg := range n.subscription.C {
+			name := eventName(msg)
+			if name == "" || n.sendContext.Err() != nil {
+				continue
+			}
+			n.dispatch(Event{Name: name, Video: msg.VideoWatched, Time: time.Now()})
+		}
+	}()
+}
+
+// Deliver the pending notifications then return, those still pending after StopTimeout are dropped
+func (n *Notifier) Stop() {
+	logger := n.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	if n.subscription == nil {
+		// Never started
+		return
+	}
+	n.subscription.Unsubscribe()
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(n.StopTimeout):
+		logger.Warn().Msgf("pending notifications dropped, they could not be delivered within %s", n.StopTimeout)
+		n.cancelSend()
+		<-done
+	}
+	n.cancelSend()
+	if dropped := n.subscription.Dropped(); dropped > 0 {
+		logger.Warn().Msgf("%d updates were dropped because notifications could not keep up", dropped)
+	}
+}
+
+func eventName(msg watchdog.UpdateMessage) string {
+	if msg.Kind == watchdog.UpdateKindAdded {
+		return EventDiscovered
+	}
+	if msg.Kind != watchdog.UpdateKindStatus {
+		return ""
+	}
+	switch msg.Status {
+	case constants.VideoStatusDownloaded:
+		return EventDownloaded
+	case constants.VideoStatusArchived:
+		return EventArchived
+	case constants.VideoStatusExpired, constants.VideoStatusRestricted:
+		return EventFailed
+	case constants.VideoStatusLost:
+		return EventLost
+	}
+	return ""
+}
+
+func (n *Notifier) dispatch(event Event) {
+	logger := n.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	for _, subscription := range n.Subscriptions {
+		if !subscription.wants(event.Name) {
+			continue
+		}
+		if sendError := n.sendWithRetry(subscription.Sink, event); sendError != nil {
+			logger.Error().Msgf("notification %s for video %s could not be sent to %s: %s", event.Name, event.Video.Id, subscription.Name, sendError.Error())
+		}
+	}
+}
+
+func (n *Notifier) sendWithRetry(sink Sink, event Event) error {
+	backoff := n.RetryBackoff
+	var sendError error
+	for attempt := 1; attempt <= n.MaxAttempts; attempt++ {
+		if sendError = sink.Send(n.sendContext, event); sendError == nil {
+			return nil
+		}
+		if attempt == n.MaxAttempts {
+			break
+		}
+		select {
+		case <-n.sendContext.Done():
+			return n.sendContext.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("%d attempts failed, last error: %w", n.MaxAttempts, sendError)
+}
+
+// Data available to the templates
+type templateData struct {
+	Event     string
+	Time      time.Time
+	Id        string
+	Title     string
+	ChannelId string
+	Status    constants.VideoStatus
+	Url       string
+}
+
+func newTemplateData(event Event) templateData {
+	return templateData{
+		Event:     event.Name,
+		Time:      event.Time,
+		Id:        event.Video.Id,
+		Title:     event.Video.Title,
+		ChannelId: event.Video.ChannelId,
+		Status:    event.Video.Status,
+		Url:       "https://www.twitch.tv/videos/" + event.Video.Id,
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	// Quote a value as a JSON string, for JSON payload templates
+	"json": func(value any) (string, error) {
+		encoded, marshalError := json.Marshal(value)
+		return string(encoded), marshalError
+	},
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+func render(tmpl *template.Template, event Event) (string, error) {
+	buffer := &bytes.Buffer{}
+	if executeError := tmpl.Execute(buffer, newTemplateData(event)); executeError != nil {
+		return "", executeError
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,129 @@
+package notify_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/events"
+	"enssat.tv/autovodsaver/notify"
+	"enssat.tv/autovodsaver/twitch"
+	"enssat.tv/autovodsaver/watchdog"
+	"github.com/rs/zerolog"
+)
+
+func newTestContext() context.Context {
+	logger := zerolog.Nop()
+	return context.WithValue(context.Background(), constants.LoggerKey, &logger)
+}
+
+// Records the events it receives, the first failures attempts fail
+type recordingSink struct {
+	mu       *sync.Mutex
+	failures int
+	attempts int
+	events   []string
+}
+
+func newRecordingSink(failures int) *recordingSink {
+	return &recordingSink{mu: &sync.Mutex{}, failures: failures}
+}
+
+func (s *recordingSink) Send(_ context.Context, event notify.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.failures < 0 || s.attempts <= s.failures {
+		return errors.New("sink unavailable")
+	}
+	s.events = append(s.events, event.Name+" "+event.Video.Id)
+	return nil
+}
+
+func (s *recordingSink) received() (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts, append([]string(nil), s.events...)
+}
+
+func statusUpdate(videoId string, status constants.VideoStatus) watchdog.UpdateMessage {
+	return watchdog.UpdateMessage{
+		VideoWatched: constants.VideoWatched{Video: twitch.Video{Id: videoId}, Status: status},
+		Kind:         watchdog.UpdateKindStatus,
+	}
+}
+
+func TestNotifierFiltersEvents(t *testing.T) {
+	bus := events.NewBus[watchdog.UpdateMessage]()
+	defer bus.Close()
+	every, archived := newRecordingSink(0), newRecordingSink(0)
+	notifier := notify.NewWithContext(newTestContext(),
+		notify.Subscription{Name: "every", Sink: every},
+		notify.Subscription{Name: "archived", Sink: archived, Events: []string{notify.EventArchived}},
+	)
+	notifier.Start(bus)
+
+	bus.Publish(watchdog.UpdateMessage{VideoWatched: constants.VideoWatched{Video: twitch.Video{Id: "1"}}, Kind: watchdog.UpdateKindAdded})
+	bus.Publish(statusUpdate("1", constants.VideoStatusQueued))
+	bus.Publish(statusUpdate("1", constants.VideoStatusArchived))
+	bus.Publish(statusUpdate("2", constants.VideoStatusLost))
+	notifier.Stop()
+
+	// The queued status has no event, the pending updates are delivered before Stop returns
+	if _, got := every.received(); !reflect.DeepEqual(got, []string{"video.discovered 1", "video.archived 1", "video.lost 2"}) {
+		t.Errorf("every event sink received %v", got)
+	}
+	if _, got := archived.received(); !reflect.DeepEqual(got, []string{"video.archived 1"}) {
+		t.Errorf("archived event sink received %v", got)
+	}
+}
+
+func TestNotifierRetries(t *testing.T) {
+	bus := events.NewBus[watchdog.UpdateMessage]()
+	defer bus.Close()
+	sink := newRecordingSink(2)
+	notifier := notify.NewWithContext(newTestContext(), notify.Subscription{Name: "flaky", Sink: sink})
+	notifier.RetryBackoff = time.Millisecond
+	notifier.Start(bus)
+
+	bus.Publish(statusUpdate("1", constants.VideoStatusArchived))
+	notifier.Stop()
+
+	if attempts, got := sink.received(); attempts != 3 || len(got) != 1 {
+		t.Errorf("%d attempts delivered %v, want 3 attempts delivering the event", attempts, got)
+	}
+}
+
+func TestNotifierStopGivesUpOnRetries(t *testing.T) {
+	bus := events.NewBus[watchdog.UpdateMessage]()
+	defer bus.Close()
+	sink := newRecordingSink(-1)
+	notifier := notify.NewWithContext(newTestContext(), notify.Subscription{Name: "down", Sink: sink})
+	notifier.RetryBackoff = time.Hour
+	notifier.StopTimeout = 50 * time.Millisecond
+	notifier.Start(bus)
+
+	bus.Publish(statusUpdate("1", constants.VideoStatusArchived))
+	bus.Publish(statusUpdate("2", constants.VideoStatusArchived))
+	for attempts, _ := sink.received(); attempts == 0; attempts, _ = sink.received() {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	notifier.Stop()
+
+	// Waiting for the retry would take an hour, the second event is dropped without being attempted
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stop() took %s, want about the stop timeout", elapsed)
+	}
+	if attempts, _ := sink.received(); attempts != 1 {
+		t.Errorf("%d attempts, want only the one before Stop", attempts)
+	}
+}
+
+func TestNotifierStopWithoutStart(t *testing.T) {
+	notify.NewWithContext(newTestContext()).Stop()
+}
@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultMailSubjectTemplate = `[AutoVODSaver] {{.Event}}: {{.Title}}`
+	defaultMailBodyTemplate    = `Video {{.Id}} "{{.Title}}" of channel {{.ChannelId}} is now {{.Status}}.
+{{.Url}}
+`
+	mailTimeout = 30 * time.Second
+)
+
+// Sends the rendered templates by mail
+type Mail struct {
+	Address string // Address of the SMTP server, host:port
+	Auth    smtp.Auth
+	From    string
+	To      []string
+	subject *template.Template
+	body    *template.Template
+}
+
+// Empty templates send a short description of the event
+func NewMail(address string, auth smtp.Auth, from string, to []string, subjectTemplate string, bodyTemplate string) (*Mail, error) {
+	if subjectTemplate == "" {
+		subjectTemplate = defaultMailSubjectTemplate
+	}
+	if bodyTemplate == "" {
+		bodyTemplate = defaultMailBodyTemplate
+	}
+	subject, parseSubjectError := parseTemplate("subject", subjectTemplate)
+	if parseSubjectError != nil {
+		return nil, parseSubjectError
+	}
+	body, parseBodyError := parseTemplate("body", bodyTemplate)
+	if parseBodyError != nil {
+		return nil, parseBodyError
+	}
+	return &Mail{
+		Address: address,
+		Auth:    auth,
+		From:    from,
+		To:      to,
+		subject: subject,
+		body:    body,
+	}, nil
+}
+
+// Line breaks would let the subject inject headers
+var headerLineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func (m *Mail) Send(ctx context.Context, event Event) error {
+	subject, renderSubjectError := render(m.subject, event)
+	if renderSubjectError != nil {
+		return renderSubjectError
+	}
+	body, renderBodyError := render(m.body, event)
+	if renderBodyError != nil {
+		return renderBodyError
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		m.From, strings.Join(m.To, ", "), headerLineBreaks.Replace(subject), body)
+	return m.sendMail(ctx, []byte(message))
+}
+
+// Same exchange as smtp.SendMail, aborted when the context is done
+func (m *Mail) sendMail(ctx context.Context, message []byte) error {
+	host, _, splitError := net.SplitHostPort(m.Address)
+	if splitError != nil {
+		return splitError
+	}
+	conn, dialError := (&net.Dialer{Timeout: mailTimeout}).DialContext(ctx, "tcp", m.Address)
+	if dialError != nil {
+		return dialError
+	}
+	defer conn.Close()
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline || time.Until(deadline) > mailTimeout {
+		deadline = time.Now().Add(mailTimeout)
+	}
+	conn.SetDeadline(deadline)
+	// Unblock the exchange as soon as the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	client, clientError := smtp.NewClient(conn, host)
+	if clientError != nil {
+		return clientError
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if tlsError := client.StartTLS(&tls.Config{ServerName: host}); tlsError != nil {
+			return tlsError
+		}
+	}
+	if m.Auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp server does not support authentication")
+		}
+		if authError := client.Auth(m.Auth); authError != nil {
+			return authError
+		}
+	}
+	if mailError := client.Mail(m.From); mailError != nil {
+		return mailError
+	}
+	for _, recipient := range m.To {
+		if rcptError := client.Rcpt(recipient); rcptError != nil {
+			return rcptError
+		}
+	}
+	writer, dataError := client.Data()
+	if dataError != nil {
+		return dataError
+	}
+	if _, writeError := writer.Write(message); writeError != nil {
+		return writeError
+	}
+	if closeError := writer.Close(); closeError != nil {
+		return closeError
+	}
+	return client.Quit()
+}
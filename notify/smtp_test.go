@@ -0,0 +1,125 @@
+package notify_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/notify"
+)
+
+// Minimal SMTP server accepting one message, its content is sent on the returned channel
+func newSMTPServer(t *testing.T) (string, chan string) {
+	listener, listenError := net.Listen("tcp", "127.0.0.1:0")
+	if listenError != nil {
+		t.Fatal(listenError)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan string, 1)
+	go func() {
+		conn, acceptError := listener.Accept()
+		if acceptError != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, readError := reader.ReadString('\n')
+			if readError != nil {
+				return
+			}
+			command := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch command {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "DATA":
+				reply("354 end with <CRLF>.<CRLF>")
+				message := &strings.Builder{}
+				for {
+					dataLine, dataError := reader.ReadString('\n')
+					if dataError != nil {
+						return
+					}
+					if dataLine == ".\r\n" {
+						break
+					}
+					message.WriteString(dataLine)
+				}
+				messages <- message.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestMail(t *testing.T) {
+	address, messages := newSMTPServer(t)
+	mail, newError := notify.NewMail(address, nil, "autovodsaver@example.com", []string{"admin@example.com"}, "", "")
+	if newError != nil {
+		t.Fatal(newError)
+	}
+	event := testEvent()
+	// A title with line breaks must not add headers to the message
+	event.Video.Title = "Speedrun\r\nBcc: victim@example.com\rX-Injected: yes"
+
+	if sendError := mail.Send(context.Background(), event); sendError != nil {
+		t.Fatalf("Send() error = %v", sendError)
+	}
+	message := <-messages
+	headers, body, found := strings.Cut(message, "\r\n\r\n")
+	if !found {
+		t.Fatalf("message %q has no body", message)
+	}
+	for _, header := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(header, "Bcc:") || strings.Contains(header, "\r") || strings.HasPrefix(header, "X-Injected") {
+			t.Errorf("header %q injected by the title", header)
+		}
+	}
+	if !strings.Contains(headers, "Subject: [AutoVODSaver] video.archived: Speedrun Bcc: victim@example.com X-Injected: yes") {
+		t.Errorf("headers %q do not contain the subject on one line", headers)
+	}
+	if !strings.Contains(body, "https://www.twitch.tv/videos/1000") {
+		t.Errorf("body %q does not link the video", body)
+	}
+}
+
+func TestMailCancelled(t *testing.T) {
+	// The server accepts the connection but never greets the client
+	listener, listenError := net.Listen("tcp", "127.0.0.1:0")
+	if listenError != nil {
+		t.Fatal(listenError)
+	}
+	defer listener.Close()
+	go func() {
+		conn, acceptError := listener.Accept()
+		if acceptError == nil {
+			defer conn.Close()
+			time.Sleep(10 * time.Second)
+		}
+	}()
+	mail, newError := notify.NewMail(listener.Addr().String(), nil, "autovodsaver@example.com", []string{"admin@example.com"}, "", "")
+	if newError != nil {
+		t.Fatal(newError)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if sendError := mail.Send(ctx, testEvent()); sendError == nil {
+		t.Error("Send() to a silent server succeeded, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send() returned after %s, want it to stop with the context", elapsed)
+	}
+}
@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultWebhookTemplate = `{"event":{{json .Event}},"time":{{json .Time}},"video":{"id":{{json .Id}},"title":{{json .Title}},"channel":{{json .ChannelId}},"status":{{json .Status}},"url":{{json .Url}}}}`
+	defaultDiscordTemplate = `**{{.ChannelId}}** {{.Event}}: [{{.Title}}]({{.Url}})`
+	webhookTimeout         = 10 * time.Second
+)
+
+// Posts the rendered template to an URL
+type Webhook struct {
+	Url         string
+	ContentType string
+	Headers     map[string]string
+	Client      *http.Client
+	template    *template.Template
+}
+
+// An empty template sends a JSON description of the event
+func NewWebhook(url string, payloadTemplate string) (*Webhook, error) {
+	if payloadTemplate == "" {
+		payloadTemplate = defaultWebhookTemplate
+	}
+	tmpl, parseError := parseTemplate("webhook", payloadTemplate)
+	if parseError != nil {
+		return nil, parseError
+	}
+	return &Webhook{
+		Url:         url,
+		ContentType: "application/json",
+		Headers:     make(map[string]string),
+		Client:      &http.Client{Timeout: webhookTimeout},
+		template:    tmpl,
+	}, nil
+}
+
+func (w *Webhook) Send(ctx context.Context, event Event) error {
+	payload, renderError := render(w.template, event)
+	if renderError != nil {
+		return renderError
+	}
+	return post(ctx, w.Client, w.Url, w.ContentType, w.Headers, []byte(payload))
+}
+
+// Posts the rendered template as the message of a Discord webhook
+type DiscordWebhook struct {
+	Url      string
+	Username string
+	Client   *http.Client
+	template *template.Template
+}
+
+func NewDiscordWebhook(url string, messageTemplate string) (*DiscordWebhook, error) {
+	if messageTemplate == "" {
+		messageTemplate = defaultDiscordTemplate
+	}
+	tmpl, parseError := parseTemplate("discord", messageTemplate)
+	if parseError != nil {
+		return nil, parseError
+	}
+	return &DiscordWebhook{
+		Url:      url,
+		Username: "AutoVODSaver",
+		Client:   &http.Client{Timeout: webhookTimeout},
+		template: tmpl,
+	}, nil
+}
+
+func (d *DiscordWebhook) Send(ctx context.Context, event Event) error {
+	content, renderError := render(d.template, event)
+	if renderError != nil {
+		return renderError
+	}
+	payload, marshalError := json.Marshal(map[string]string{
+		"content":  content,
+		"username": d.Username,
+	})
+	if marshalError != nil {
+		return marshalError
+	}
+	return post(ctx, d.Client, d.Url, "application/json", nil, payload)
+}
+
+func post(ctx context.Context, client *http.Client, url string, contentType string, headers map[string]string, payload []byte) error {
+	req, requestError := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if requestError != nil {
+		return requestError
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, responseError := client.Do(req)
+	if responseError != nil {
+		return responseError
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/notify"
+	"enssat.tv/autovodsaver/twitch"
+)
+
+type capturedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// Server answering every request with the status, the requests are sent on the returned channel
+func newWebhookServer(t *testing.T, status int) (*httptest.Server, chan capturedRequest) {
+	requests := make(chan capturedRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- capturedRequest{header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func testEvent() notify.Event {
+	return notify.Event{
+		Name: notify.EventArchived,
+		Time: time.Date(2024, time.March, 1, 20, 0, 0, 0, time.UTC),
+		Video: constants.VideoWatched{
+			Video:     twitch.Video{Id: "1000", Title: `Speedrun "any%"`},
+			ChannelId: "channel",
+			Status:    constants.VideoStatusArchived,
+		},
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusNoContent)
+	webhook, newError := notify.NewWebhook(server.URL, "")
+	if newError != nil {
+		t.Fatal(newError)
+	}
+	webhook.Headers["Authorization"] = "Bearer secret"
+
+	if sendError := webhook.Send(context.Background(), testEvent()); sendError != nil {
+		t.Fatalf("Send() error = %v", sendError)
+	}
+	request := <-requests
+	if got := request.header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the configured header", got)
+	}
+	var payload struct {
+		Event string `json:"event"`
+		Video struct {
+			Id      string `json:"id"`
+			Title   string `json:"title"`
+			Channel string `json:"channel"`
+			Url     string `json:"url"`
+		} `json:"video"`
+	}
+	// The default template quotes the values, the title must survive its quotes
+	if decodeError := json.Unmarshal(request.body, &payload); decodeError != nil {
+		t.Fatalf("payload %s is not valid json: %v", request.body, decodeError)
+	}
+	if payload.Event != notify.EventArchived || payload.Video.Id != "1000" || payload.Video.Title != `Speedrun "any%"` ||
+		payload.Video.Channel != "channel" || payload.Video.Url != "https://www.twitch.tv/videos/1000" {
+		t.Errorf("payload = %+v", payload)
+	}
+}
+
+func TestWebhookErrorStatus(t *testing.T) {
+	server, _ := newWebhookServer(t, http.StatusBadGateway)
+	webhook, newError := notify.NewWebhook(server.URL, "{{.Id}}")
+	if newError != nil {
+		t.Fatal(newError)
+	}
+	if sendError := webhook.Send(context.Background(), testEvent()); sendError == nil {
+		t.Error("Send() to a failing webhook succeeded, want an error")
+	}
+}
+
+func TestDiscordWebhook(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusNoContent)
+	discord, newError := notify.NewDiscordWebhook(server.URL, "")
+	if newError != nil {
+		t.Fatal(newError)
+	}
+	if sendError := discord.Send(context.Background(), testEvent()); sendError != nil {
+		t.Fatalf("Send() error = %v", sendError)
+	}
+	var payload map[string]string
+	if decodeError := json.Unmarshal((<-requests).body, &payload); decodeError != nil {
+		t.Fatal(decodeError)
+	}
+	want := `**channel** video.archived: [Speedrun "any%"](https://www.twitch.tv/videos/1000)`
+	if payload["content"] != want || payload["username"] != "AutoVODSaver" {
+		t.Errorf("payload = %v, want content %q", payload, want)
+	}
+}
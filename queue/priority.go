@@ -0,0 +1,152 @@
+package queue
+
+import (
+	"container/heap"
+	"sync"
+
+	"enssat.tv/autovodsaver/constants"
+)
+
+// Lower scores are dequeued first
+type ScoreFunc func(element *constants.VideoWatched) float64
+
+type PriorityQueue struct {
+	mu     *sync.Mutex
+	cond   *sync.Cond
+	score  ScoreFunc
+	closed bool
+	items  *priorityItems
+}
+
+type priorityItem struct {
+	element *constants.VideoWatched
+	score   float64
+	seq     uint64
+}
+
+type priorityItems struct {
+	list []priorityItem
+	seq  uint64
+}
+
+func (p *priorityItems) Len() int { return len(p.list) }
+
+func (p *priorityItems) Less(i, j int) bool {
+	if p.list[i].score == p.list[j].score {
+		// Keep discovery order between elements of equal priority
+		return p.list[i].seq < p.list[j].seq
+	}
+	return p.list[i].score < p.list[j].score
+}
+
+func (p *priorityItems) Swap(i, j int) { p.list[i], p.list[j] = p.list[j], p.list[i] }
+
+func (p *priorityItems) Push(x any) { p.list = append(p.list, x.(priorityItem)) }
+
+func (p *priorityItems) Pop() any {
+	last := p.list[len(p.list)-1]
+	p.list = p.list[:len(p.list)-1]
+	return last
+}
+
+func NewPriority(score ScoreFunc) *PriorityQueue {
+	mu := &sync.Mutex{}
+	return &PriorityQueue{
+		mu:    mu,
+		cond:  sync.NewCond(mu),
+		score: score,
+		items: &priorityItems{list: make([]priorityItem, 0)},
+	}
+}
+
+func (q *PriorityQueue) Enqueue(element *constants.VideoWatched) {
+	q.mu.Lock()
+	q.items.seq++
+	heap.Push(q.items, priorityItem{
+		element: element,
+		score:   q.score(element),
+		seq:     q.items.seq,
+	})
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *PriorityQueue) Dequeue() *constants.VideoWatched {
+	q.mu.Lock()
+	for q.items.Len() == 0 {
+		if q.closed {
+			q.mu.Unlock()
+			return nil
+		}
+		// Wait for an element to be pushed
+		q.cond.Wait()
+	}
+	item := heap.Pop(q.items).(priorityItem)
+	q.mu.Unlock()
+	return item.element
+}
+
+func (q *PriorityQueue) Size() int {
+	q.mu.Lock()
+	size := q.items.Len()
+	q.mu.Unlock()
+	return size
+}
+
+// Recompute the score of every queued element, to be called when the inputs of the score function changed
+func (q *PriorityQueue) Reprioritize() {
+	q.mu.Lock()
+	for i := range q.items.list {
+		q.items.list[i].score = q.score(q.items.list[i].element)
+	}
+	heap.Init(q.items)
+	q.mu.Unlock()
+}
+
+// Wake up every pending Dequeue, which returns nil once the queue is closed and empty
+func (q *PriorityQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// List the queued elements, in the order they will be dequeued
+func (q *PriorityQueue) Snapshot() []*constants.VideoWatched {
+	q.mu.Lock()
+	items := make([]priorityItem, len(q.items.list))
+	copy(items, q.items.list)
+	q.mu.Unlock()
+
+	sorted := &priorityItems{list: items}
+	heap.Init(sorted)
+	elements := make([]*constants.VideoWatched, 0, len(items))
+	for sorted.Len() > 0 {
+		elements = append(elements, heap.Pop(sorted).(priorityItem).element)
+	}
+	return elements
+}
+
+func (q *PriorityQueue) Contains(videoId string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range q.items.list {
+		if item.element.Id == videoId {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the first element matching the given video id, reports whether an element was removed
+func (q *PriorityQueue) Remove(videoId string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.items.list {
+		if item.element.Id == videoId {
+			heap.Remove(q.items, i)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package queue_test
+
+import (
+	"reflect"
+	"testing"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/queue"
+	"enssat.tv/autovodsaver/twitch"
+)
+
+func newVideo(id string) *constants.VideoWatched {
+	return &constants.VideoWatched{Video: twitch.Video{Id: id}}
+}
+
+func dequeueAll(q *queue.PriorityQueue) []string {
+	ids := make([]string, 0)
+	for q.Size() > 0 {
+		ids = append(ids, q.Dequeue().Id)
+	}
+	return ids
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	scores := map[string]float64{"late": 72, "soon": 2, "overdue": -5, "first-tie": 10, "second-tie": 10}
+	q := queue.NewPriority(func(video *constants.VideoWatched) float64 {
+		return scores[video.Id]
+	})
+	for _, id := range []string{"late", "first-tie", "soon", "second-tie", "overdue"} {
+		q.Enqueue(newVideo(id))
+	}
+
+	// Lowest score first, equal scores in the order they were enqueued
+	want := []string{"overdue", "soon", "first-tie", "second-tie", "late"}
+	snapshot := make([]string, 0)
+	for _, video := range q.Snapshot() {
+		snapshot = append(snapshot, video.Id)
+	}
+	if !reflect.DeepEqual(snapshot, want) {
+		t.Errorf("Snapshot() = %v, want %v", snapshot, want)
+	}
+	if got := dequeueAll(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("dequeued %v, want %v", got, want)
+	}
+}
+
+func TestPriorityQueueReprioritize(t *testing.T) {
+	scores := map[string]float64{"a": 1, "b": 2, "c": 3}
+	q := queue.NewPriority(func(video *constants.VideoWatched) float64 {
+		return scores[video.Id]
+	})
+	for _, id := range []string{"a", "b", "c"} {
+		q.Enqueue(newVideo(id))
+	}
+
+	// Scores are only computed again on request
+	scores["c"] = 0
+	if head := q.Snapshot()[0].Id; head != "a" {
+		t.Errorf("head = %s before Reprioritize, want a", head)
+	}
+	q.Reprioritize()
+	if got := dequeueAll(q); !reflect.DeepEqual(got, []string{"c", "a", "b"}) {
+		t.Errorf("dequeued %v after Reprioritize, want [c a b]", got)
+	}
+}
+
+func TestPriorityQueueRemove(t *testing.T) {
+	scores := map[string]float64{"a": 1, "b": 2, "c": 3}
+	q := queue.NewPriority(func(video *constants.VideoWatched) float64 {
+		return scores[video.Id]
+	})
+	for _, id := range []string{"c", "b", "a"} {
+		q.Enqueue(newVideo(id))
+	}
+
+	if !q.Remove("b") || q.Remove("b") {
+		t.Error("Remove(b) should remove the video exactly once")
+	}
+	if q.Contains("b") || !q.Contains("a") {
+		t.Error("Contains() does not reflect the removal")
+	}
+	if got := dequeueAll(q); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("dequeued %v, want [a c]", got)
+	}
+}
+
+func TestPriorityQueueClose(t *testing.T) {
+	q := queue.NewPriority(func(video *constants.VideoWatched) float64 { return 0 })
+	done := make(chan *constants.VideoWatched)
+	go func() {
+		done <- q.Dequeue()
+	}()
+	q.Close()
+	if video := <-done; video != nil {
+		t.Errorf("Dequeue() on a closed queue = %v, want nil", video)
+	}
+}
@@ -0,0 +1,10 @@
+package storage
+
+// Lower the size above which the checksum is recorded with a multipart copy, until the returned function is called
+func SetCopyLimits(maxObjectSize int64, partSize int64) func() {
+	previousMaxObjectSize, previousPartSize := maxCopyObjectSize, copyPartSize
+	maxCopyObjectSize, copyPartSize = maxObjectSize, partSize
+	return func() {
+		maxCopyObjectSize, copyPartSize = previousMaxObjectSize, previousPartSize
+	}
+}
@@ -2,23 +2,52 @@ package storage
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"enssat.tv/autovodsaver/bandwidth"
 	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/metrics"
 	"enssat.tv/autovodsaver/twitch"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/rs/zerolog"
 )
 
 type S3Storage struct {
-	Context context.Context
-	Client  *s3.Client
-	Bucket  string
+	Context      context.Context
+	Client       *s3.Client
+	Bucket       string
+	ListPageSize int32             // Keys requested per listing page, the S3 default when zero
+	Bandwidth    *bandwidth.Limits // Caps of the uploads, unlimited when nil
+	PartSize     int64             // Size of the parts of streamed uploads, 16 MiB when zero, S3 requires at least 5 MiB
+}
+
+// Send the request bodies, the uploaded videos, within the bandwidth caps of the storage
+type throttledClient struct {
+	store  *S3Storage
+	client s3.HTTPClient
+}
+
+func (c throttledClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || c.store.Bandwidth == nil {
+		return c.client.Do(req)
+	}
+	throttled := req.Clone(req.Context())
+	throttled.Body = struct {
+		io.Reader
+		io.Closer
+	}{c.store.Bandwidth.Reader(req.Context(), req.Body), req.Body}
+	return c.client.Do(throttled)
 }
 
 type Credentials struct {
@@ -34,36 +63,40 @@ func NewS3Storage(endpoint string, region string, bucket string, creds Credentia
 func NewS3StorageWithContext(ctx context.Context, endpoint string, region string, bucket string, creds Credentials) (*S3Storage, error) {
 	logger := ctx.Value(constants.LoggerKey).(*zerolog.Logger)
 
-	client := s3.New(s3.Options{
+	store := &S3Storage{
+		Context: ctx,
+		Bucket:  bucket,
+	}
+	store.Client = s3.New(s3.Options{
 		BaseEndpoint: aws.String(endpoint),
 		Region:       region,
 		Credentials:  credentials.NewStaticCredentialsProvider(creds.AccessKey, creds.SecretKey, creds.Session),
+		UsePathStyle: true, // Self-hosted endpoints like MinIO do not serve buckets as subdomains
+		HTTPClient:   throttledClient{store: store, client: awshttp.NewBuildableClient()},
 	})
 
 	// Check if bucket exists
-	buckets, listBucketError := client.ListBuckets(ctx, nil)
-	if listBucketError != nil {
-		return nil, listBucketError
+	if pingError := store.Ping(ctx); pingError != nil {
+		return nil, pingError
 	}
+	logger.Debug().Msgf("bucket %s found", bucket)
 
-	found := false
+	logger.Debug().Msgf("New S3 storage instance with bucket %s (endpoint: %s)", bucket, endpoint)
+	return store, nil
+}
+
+// Check that the storage is reachable and that the bucket exists
+func (s *S3Storage) Ping(ctx context.Context) error {
+	buckets, listBucketError := s.Client.ListBuckets(ctx, nil)
+	if listBucketError != nil {
+		return listBucketError
+	}
 	for _, v := range buckets.Buckets {
-		if *v.Name == bucket {
-			found = true
-			logger.Debug().Msgf("bucket %s found", bucket)
-			break
+		if *v.Name == s.Bucket {
+			return nil
 		}
 	}
-	if !found {
-		return nil, fmt.Errorf("bucket %s has not been found", bucket)
-	}
-
-	logger.Debug().Msgf("New S3 storage instance with bucket %s (endpoint: %s)", bucket, endpoint)
-	return &S3Storage{
-		Context: ctx,
-		Client:  client,
-		Bucket:  bucket,
-	}, nil
+	return fmt.Errorf("bucket %s has not been found", s.Bucket)
 }
 
 func (s *S3Storage) GetVideos() ([]twitch.Video, error) {
@@ -73,30 +106,141 @@ func (s *S3Storage) GetVideos() ([]twitch.Video, error) {
 		return []twitch.Video{}, fmt.Errorf("s3 client is nil, is the client initialize correctly ?")
 	}
 
-	objects, listObjectsError := s.Client.ListObjectsV2(s.Context, &s3.ListObjectsV2Input{
+	input := &s3.ListObjectsV2Input{
 		Bucket: &s.Bucket,
-	})
-	if listObjectsError != nil {
-		return []twitch.Video{}, listObjectsError
-	}
-	logger.Debug().Msgf("number of document found in bucket %s: %d", s.Bucket, *objects.KeyCount)
-
-	for _, object := range objects.Contents {
-		obj, getObjectError := s.Client.GetObjectAttributes(s.Context, &s3.GetObjectAttributesInput{
-			Bucket: &s.Bucket,
-			Key:    object.Key,
-			ObjectAttributes: []types.ObjectAttributes{
-				types.ObjectAttributesObjectParts,
-			},
-		})
-		if getObjectError != nil {
-			logger.Error().Msg(getObjectError.Error())
-			continue
+	}
+	if s.ListPageSize > 0 {
+		input.MaxKeys = aws.Int32(s.ListPageSize)
+	}
+	videos := make([]twitch.Video, 0)
+	paginator := s3.NewListObjectsV2Paginator(s.Client, input)
+	for paginator.HasMorePages() {
+		page, listObjectsError := paginator.NextPage(s.Context)
+		if listObjectsError != nil {
+			return []twitch.Video{}, listObjectsError
+		}
+		logger.Debug().Msgf("number of document found in bucket %s: %d", s.Bucket, len(page.Contents))
+
+		for _, object := range page.Contents {
+			head, headObjectError := s.Client.HeadObject(s.Context, &s3.HeadObjectInput{
+				Bucket: &s.Bucket,
+				Key:    object.Key,
+			})
+			if headObjectError != nil {
+				return []twitch.Video{}, headObjectError
+			}
+			video, metadataError := videoFromMetadata(head.Metadata)
+			if metadataError != nil {
+				// Objects not written by Save are not videos
+				logger.Warn().Msgf("object %s skipped: %s", *object.Key, metadataError.Error())
+				continue
+			}
+			video.Context = s.Context
+			videos = append(videos, video)
 		}
-		logger.Debug().Msgf("%s", obj.ResultMetadata)
 	}
 
-	return make([]twitch.Video, 0), nil
+	return videos, nil
+}
+
+// Dates written by older versions use the format of time.Time.String
+const legacyPublishDateLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+func videoFromMetadata(metadata map[string]string) (twitch.Video, error) {
+	if metadata["id"] == "" {
+		return twitch.Video{}, fmt.Errorf("no video id in metadata")
+	}
+	duration, parseDurationError := strconv.Atoi(metadata["duration"])
+	if parseDurationError != nil {
+		return twitch.Video{}, fmt.Errorf("invalid duration %q", metadata["duration"])
+	}
+	publishedAt, parseDateError := time.Parse(time.RFC3339, metadata["publish_date"])
+	if parseDateError != nil {
+		// Drop the monotonic clock reading time.Time.String may have appended
+		legacy, _, _ := strings.Cut(metadata["publish_date"], " m=")
+		publishedAt, parseDateError = time.Parse(legacyPublishDateLayout, legacy)
+		if parseDateError != nil {
+			return twitch.Video{}, fmt.Errorf("invalid publish date %q", metadata["publish_date"])
+		}
+	}
+	return twitch.Video{
+		Id:            metadata["id"],
+		Title:         metadata["title"],
+		Description:   metadata["description"],
+		LengthSeconds: uint(duration),
+		PublishedAt:   publishedAt,
+		Checksum:      metadata["sha256"],
+	}, nil
+}
+
+// Metadata stored with the object of a video, read back by videoFromMetadata, without sha256 when the checksum is empty
+func videoMetadata(video *twitch.Video, checksum string) map[string]string {
+	metadata := map[string]string{
+		"id":           video.Id,
+		"title":        video.Title,
+		"description":  video.Description,
+		"duration":     strconv.Itoa(int(video.LengthSeconds)),
+		"publish_date": video.PublishedAt.Format(time.RFC3339),
+	}
+	if checksum != "" {
+		metadata["sha256"] = checksum
+	}
+	return metadata
+}
+
+func objectKey(video *twitch.Video) string {
+	return fmt.Sprintf("%s_%s.mp4", video.Title, video.Id)
+}
+
+// Key of the stored video, the title may have changed on Twitch since it was saved
+func (s *S3Storage) findObjectKey(video *twitch.Video) (string, error) {
+	key := objectKey(video)
+	if _, headObjectError := s.Client.HeadObject(s.Context, &s3.HeadObjectInput{Bucket: &s.Bucket, Key: &key}); headObjectError == nil {
+		return key, nil
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{Bucket: &s.Bucket})
+	for paginator.HasMorePages() {
+		page, listObjectsError := paginator.NextPage(s.Context)
+		if listObjectsError != nil {
+			return "", listObjectsError
+		}
+		for _, object := range page.Contents {
+			if strings.HasSuffix(*object.Key, "_"+video.Id+".mp4") {
+				return *object.Key, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrVideoNotStored, video.Id)
+}
+
+func (s *S3Storage) Verify(video *twitch.Video) error {
+	if s.Client == nil {
+		return fmt.Errorf("s3 client is nil, is the client initialize correctly ?")
+	}
+	key, findError := s.findObjectKey(video)
+	if findError != nil {
+		return findError
+	}
+	object, getObjectError := s.Client.GetObject(s.Context, &s3.GetObjectInput{Bucket: &s.Bucket, Key: &key})
+	if getObjectError != nil {
+		return getObjectError
+	}
+	defer object.Body.Close()
+
+	checksum, checksumError := readChecksum(object.Body)
+	if checksumError != nil {
+		return checksumError
+	}
+	if recorded := object.Metadata["sha256"]; recorded != "" && recorded != checksum {
+		return fmt.Errorf("%w: object %s has checksum %s, %s was recorded when it was saved", ErrChecksumMismatch, key, checksum, recorded)
+	}
+	if video.Checksum != "" && video.Checksum != checksum {
+		return fmt.Errorf("%w: object %s has checksum %s, %s was expected", ErrChecksumMismatch, key, checksum, video.Checksum)
+	}
+	if object.Metadata["sha256"] == "" && video.Checksum == "" {
+		return fmt.Errorf("no checksum recorded for object %s", key)
+	}
+	return nil
 }
 
 func (s *S3Storage) Save(video *twitch.Video, filePath string) error {
@@ -110,24 +254,43 @@ func (s *S3Storage) Save(video *twitch.Video, filePath string) error {
 	if fileOpenError != nil {
 		return fileOpenError
 	}
+	defer file.Close()
+
+	// S3 rejects the upload when the file does not match the checksum
+	checksum := video.Checksum
+	if checksum == "" {
+		var checksumError error
+		if checksum, checksumError = readChecksum(file); checksumError != nil {
+			return checksumError
+		}
+		if _, seekError := file.Seek(0, io.SeekStart); seekError != nil {
+			return seekError
+		}
+	}
+	digest, decodeError := hex.DecodeString(checksum)
+	if decodeError != nil {
+		return fmt.Errorf("invalid checksum %q of video %s: %w", checksum, video.Id, decodeError)
+	}
 
 	logger.Info().Msgf("video %s being stored in s3 bucket %s", video.Title, s.Bucket)
+	start := time.Now()
 
 	_, putObjectError := s.Client.PutObject(s.Context, &s3.PutObjectInput{
-		Bucket: &s.Bucket,
-		Key:    aws.String(fmt.Sprintf("%s_%s.mp4", video.Title, video.Id)),
-		Body:   file,
-		Metadata: map[string]string{
-			"id":           video.Id,
-			"title":        video.Title,
-			"description":  video.Description,
-			"duration":     strconv.Itoa(int(video.LengthSeconds)),
-			"publish_date": video.PublishedAt.String(),
-		},
+		Bucket:         &s.Bucket,
+		Key:            aws.String(objectKey(video)),
+		Body:           file,
+		ContentType:    aws.String("video/mp4"),
+		ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(digest)),
+		Metadata:       videoMetadata(video, checksum),
 	})
 	if putObjectError != nil {
+		metrics.UploadDuration.Observe(time.Since(start).Seconds(), "error")
 		return putObjectError
 	}
+	metrics.UploadDuration.Observe(time.Since(start).Seconds(), "success")
+	if info, statError := file.Stat(); statError == nil {
+		metrics.BytesUploaded.Add(float64(info.Size()))
+	}
 
 	logger.Info().Msgf("video %s stored in s3 bucket %s", video.Title, s.Bucket)
 
@@ -0,0 +1,237 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/bandwidth"
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/storage"
+	"enssat.tv/autovodsaver/storage/s3test"
+	"enssat.tv/autovodsaver/storage/storagetest"
+	"enssat.tv/autovodsaver/twitch"
+	"github.com/rs/zerolog"
+)
+
+func newTestContext() context.Context {
+	logger := zerolog.Nop()
+	return context.WithValue(context.Background(), constants.LoggerKey, &logger)
+}
+
+func newTestS3Storage(t *testing.T, server *s3test.Server, bucket string) (*storage.S3Storage, error) {
+	t.Helper()
+	return storage.NewS3StorageWithContext(newTestContext(), server.URL, "eu-west", bucket, storage.Credentials{
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+}
+
+func TestS3StorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		server := s3test.NewServer("videos")
+		t.Cleanup(server.Close)
+		store, newStorageError := newTestS3Storage(t, server, "videos")
+		if newStorageError != nil {
+			t.Fatal(newStorageError)
+		}
+		// Small pages so listing goes through pagination
+		store.ListPageSize = 4
+		return store
+	})
+}
+
+func TestS3StorageMissingBucket(t *testing.T) {
+	server := s3test.NewServer("videos")
+	defer server.Close()
+
+	if _, newStorageError := newTestS3Storage(t, server, "missing"); newStorageError == nil {
+		t.Error("NewS3StorageWithContext() with a missing bucket succeeded, want an error")
+	}
+}
+
+func TestS3StorageObject(t *testing.T) {
+	server := s3test.NewServer("videos")
+	defer server.Close()
+	store, newStorageError := newTestS3Storage(t, server, "videos")
+	if newStorageError != nil {
+		t.Fatal(newStorageError)
+	}
+	video := twitch.Video{Id: "1000", Title: "Title", PublishedAt: time.Now()}
+	filePath := filepath.Join(t.TempDir(), "video.mp4")
+	if writeError := os.WriteFile(filePath, []byte("content"), 0660); writeError != nil {
+		t.Fatal(writeError)
+	}
+
+	if saveError := store.Save(&video, filePath); saveError != nil {
+		t.Fatal(saveError)
+	}
+	object, found := server.Object("videos", "Title_1000.mp4")
+	if !found {
+		t.Fatalf("object not found, bucket holds %v", server.Keys("videos"))
+	}
+	if string(object.Body) != "content" || object.ContentType != "video/mp4" || object.Metadata["id"] != "1000" {
+		t.Errorf("stored object = %q (%s, %v)", object.Body, object.ContentType, object.Metadata)
+	}
+}
+
+func TestS3StorageBandwidth(t *testing.T) {
+	server := s3test.NewServer("videos")
+	defer server.Close()
+	store, newStorageError := newTestS3Storage(t, server, "videos")
+	if newStorageError != nil {
+		t.Fatal(newStorageError)
+	}
+	store.Bandwidth = bandwidth.NewLimits(bandwidth.Schedule{}, bandwidth.Schedule{Rate: 100 << 10})
+	video := twitch.Video{Id: "1000", Title: "Title", PublishedAt: time.Now()}
+	filePath := filepath.Join(t.TempDir(), "video.mp4")
+	if writeError := os.WriteFile(filePath, make([]byte, 50<<10), 0660); writeError != nil {
+		t.Fatal(writeError)
+	}
+
+	start := time.Now()
+	if saveError := store.Save(&video, filePath); saveError != nil {
+		t.Fatal(saveError)
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Errorf("50K uploaded in %s, want at least 500ms at 100K/s", elapsed)
+	}
+	if object, found := server.Object("videos", "Title_1000.mp4"); !found || len(object.Body) != 50<<10 {
+		t.Errorf("stored object found = %t, want the 50K of the file", found)
+	}
+}
+
+func TestS3StorageVerifyCorruptObject(t *testing.T) {
+	server := s3test.NewServer("videos")
+	defer server.Close()
+	store, newStorageError := newTestS3Storage(t, server, "videos")
+	if newStorageError != nil {
+		t.Fatal(newStorageError)
+	}
+	video := twitch.Video{Id: "1000", Title: "Title", PublishedAt: time.Now()}
+	filePath := filepath.Join(t.TempDir(), "video.mp4")
+	if writeError := os.WriteFile(filePath, []byte("content"), 0660); writeError != nil {
+		t.Fatal(writeError)
+	}
+	if saveError := store.Save(&video, filePath); saveError != nil {
+		t.Fatal(saveError)
+	}
+	if object, _ := server.Object("videos", "Title_1000.mp4"); object.Checksum == "" {
+		t.Error("the SHA-256 checksum was not sent with the object")
+	}
+
+	server.ReplaceBody("videos", "Title_1000.mp4", []byte("corrupted"))
+	if verifyError := store.Verify(&video); !errors.Is(verifyError, storage.ErrChecksumMismatch) {
+		t.Errorf("Verify() of a corrupted object error = %v, want %v", verifyError, storage.ErrChecksumMismatch)
+	}
+}
+
+func TestS3StorageSaveStream(t *testing.T) {
+	tests := map[string]struct {
+		maxCopyObjectSize int64
+		copyPartSize      int64
+		operation         string
+		requests          int
+	}{
+		"copy":           {maxCopyObjectSize: 5 << 30, copyPartSize: 1 << 30, operation: "CopyObject", requests: 1},
+		"multipart copy": {maxCopyObjectSize: 1 << 10, copyPartSize: 3 << 10, operation: "UploadPartCopy", requests: 4},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Small objects are copied by parts when the limit of a single copy is lowered
+			defer storage.SetCopyLimits(test.maxCopyObjectSize, test.copyPartSize)()
+			server := s3test.NewServer("videos")
+			defer server.Close()
+			store, newStorageError := newTestS3Storage(t, server, "videos")
+			if newStorageError != nil {
+				t.Fatal(newStorageError)
+			}
+			store.PartSize = 4 << 10
+			content := bytes.Repeat([]byte("0123456789"), 1024)
+			video := twitch.Video{Id: "1000", Title: "Title", PublishedAt: time.Now()}
+
+			saveError := store.SaveStream(&video, func(w io.Writer) error {
+				// Small writes like the chunks of a video
+				for start := 0; start < len(content); start += 1000 {
+					if _, writeError := w.Write(content[start:min(start+1000, len(content))]); writeError != nil {
+						return writeError
+					}
+				}
+				return nil
+			})
+			if saveError != nil {
+				t.Fatal(saveError)
+			}
+			object, found := server.Object("videos", "Title_1000.mp4")
+			if !found || !bytes.Equal(object.Body, content) || object.Metadata["id"] != "1000" {
+				t.Fatalf("stored object found = %t with %d bytes, want the %d bytes written", found, len(object.Body), len(content))
+			}
+			if parts := server.Requests("UploadPart"); parts != 3 {
+				t.Errorf("%d parts uploaded, want 3 parts of 4K", parts)
+			}
+			if requests := server.Requests(test.operation); requests != test.requests {
+				t.Errorf("%d %s requests to record the checksum, want %d", requests, test.operation, test.requests)
+			}
+			checksum := sha256.Sum256(content)
+			if object.Metadata["sha256"] != hex.EncodeToString(checksum[:]) || video.Checksum != object.Metadata["sha256"] {
+				t.Errorf("sha256 metadata = %q and Checksum = %q, want %x", object.Metadata["sha256"], video.Checksum, checksum)
+			}
+			if object.ContentType != "video/mp4" || object.Metadata["title"] != "Title" {
+				t.Errorf("content type %q and metadata %v lost when the checksum was recorded", object.ContentType, object.Metadata)
+			}
+
+			// The checksum recorded in the object is enough, like for the videos listed from the bucket
+			if verifyError := store.Verify(&twitch.Video{Id: "1000", Title: "Title"}); verifyError != nil {
+				t.Errorf("Verify() error = %v", verifyError)
+			}
+			server.ReplaceBody("videos", "Title_1000.mp4", bytes.Repeat([]byte("x"), len(content)))
+			if verifyError := store.Verify(&twitch.Video{Id: "1000", Title: "Title"}); !errors.Is(verifyError, storage.ErrChecksumMismatch) {
+				t.Errorf("Verify() of a corrupt object error = %v, want %v", verifyError, storage.ErrChecksumMismatch)
+			}
+		})
+	}
+}
+
+func TestS3StorageSaveStreamFailure(t *testing.T) {
+	server := s3test.NewServer("videos")
+	defer server.Close()
+	store, newStorageError := newTestS3Storage(t, server, "videos")
+	if newStorageError != nil {
+		t.Fatal(newStorageError)
+	}
+	store.PartSize = 4 << 10
+	video := twitch.Video{Id: "1000", Title: "Title", PublishedAt: time.Now()}
+	downloadError := errors.New("download failed")
+
+	// Failing before writing anything does not start an upload
+	if saveError := store.SaveStream(&video, func(w io.Writer) error { return downloadError }); !errors.Is(saveError, downloadError) {
+		t.Errorf("SaveStream() error = %v, want %v", saveError, downloadError)
+	}
+	if uploads := server.Requests("CreateMultipartUpload"); uploads != 0 {
+		t.Errorf("%d uploads created for a video without content, want 0", uploads)
+	}
+
+	// Failing after some parts aborts the upload
+	saveError := store.SaveStream(&video, func(w io.Writer) error {
+		if _, writeError := w.Write(make([]byte, 10<<10)); writeError != nil {
+			return writeError
+		}
+		return downloadError
+	})
+	if !errors.Is(saveError, downloadError) {
+		t.Errorf("SaveStream() error = %v, want %v", saveError, downloadError)
+	}
+	if _, found := server.Object("videos", "Title_1000.mp4"); found {
+		t.Error("an incomplete video has been stored")
+	}
+	if server.Requests("AbortMultipartUpload") != 1 || server.PendingUploads() != 0 {
+		t.Errorf("%d uploads left pending, want the upload to be aborted", server.PendingUploads())
+	}
+}
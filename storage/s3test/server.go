@@ -0,0 +1,589 @@
+// In-process S3-compatible server for tests, it keeps the objects in memory and does not check signatures
+package s3test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metadataPrefix = "X-Amz-Meta-"
+
+type Object struct {
+	Body         []byte
+	Metadata     map[string]string // User metadata, keys are lower case
+	ContentType  string
+	LastModified time.Time
+	ETag         string
+	Checksum     string // Base64 SHA-256 sent by the client, empty when none was sent
+}
+
+type multipartUpload struct {
+	bucket      string
+	key         string
+	metadata    map[string]string
+	contentType string
+	parts       map[int][]byte
+}
+
+type Server struct {
+	*httptest.Server
+	mu       *sync.Mutex
+	buckets  map[string]map[string]*Object
+	uploads  map[string]*multipartUpload
+	uploadId int
+	requests map[string]int
+}
+
+// Start a server holding the given empty buckets, it must be stopped with Close
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		mu:       &sync.Mutex{},
+		buckets:  make(map[string]map[string]*Object),
+		uploads:  make(map[string]*multipartUpload),
+		requests: make(map[string]int),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]*Object)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Copy of a stored object
+func (s *Server) Object(bucket string, key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, found := s.buckets[bucket][key]
+	if !found {
+		return Object{}, false
+	}
+	return *object, true
+}
+
+// Replace the body of a stored object and keep its metadata, like a storage corrupting its data
+func (s *Server) ReplaceBody(bucket string, key string, body []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, found := s.buckets[bucket][key]
+	if found {
+		object.Body = body
+		object.ETag = etag(body)
+	}
+	return found
+}
+
+// Keys of the objects of a bucket, sorted
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Number of requests received for an operation, like "PutObject" or "UploadPart"
+func (s *Server) Requests(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[operation]
+}
+
+// Multipart uploads neither completed nor aborted
+func (s *Server) PendingUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(errorResponse{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(value)
+}
+
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Path-style requests only: /bucket/key
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		s.listBuckets(w)
+		return
+	case bucket == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported operation")
+		return
+	}
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodPut:
+			s.requests["CreateBucket"]++
+			if _, found := s.buckets[bucket]; !found {
+				s.buckets[bucket] = make(map[string]*Object)
+			}
+		case http.MethodGet:
+			s.listObjects(w, bucket, query)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported operation")
+		}
+		return
+	}
+
+	objects, found := s.buckets[bucket]
+	if !found {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && query.Has("uploadId") && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.uploadPartCopy(w, r, query)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, r, objects, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.requests["AbortMultipartUpload"]++
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, objects, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, objects, key)
+	case r.Method == http.MethodHead, r.Method == http.MethodGet:
+		s.getObject(w, r, objects, key)
+	case r.Method == http.MethodDelete:
+		s.requests["DeleteObject"]++
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported operation")
+	}
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter) {
+	s.requests["ListBuckets"]++
+	type bucket struct {
+		Name         string    `xml:"Name"`
+		CreationDate time.Time `xml:"CreationDate"`
+	}
+	response := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{}
+	for name := range s.buckets {
+		response.Buckets = append(response.Buckets, bucket{Name: name, CreationDate: time.Now().UTC()})
+	}
+	writeXML(w, response)
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, bucket string, query map[string][]string) {
+	s.requests["ListObjectsV2"]++
+	objects, found := s.buckets[bucket]
+	if !found {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist")
+		return
+	}
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	maxKeys := 1000
+	if value := get("max-keys"); value != "" {
+		parsed, parseError := strconv.Atoi(value)
+		if parseError != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+			return
+		}
+		maxKeys = min(parsed, 1000)
+	}
+	// The continuation token is the last key of the previous page
+	after := get("continuation-token")
+	if startAfter := get("start-after"); startAfter > after {
+		after = startAfter
+	}
+
+	keys := make([]string, 0)
+	for key := range objects {
+		if strings.HasPrefix(key, get("prefix")) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	type content struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int       `xml:"Size"`
+		StorageClass string    `xml:"StorageClass"`
+	}
+	response := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Name                  string    `xml:"Name"`
+		Prefix                string    `xml:"Prefix"`
+		KeyCount              int       `xml:"KeyCount"`
+		MaxKeys               int       `xml:"MaxKeys"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		ContinuationToken     string    `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+		Contents              []content `xml:"Contents"`
+	}{
+		Name:              bucket,
+		Prefix:            get("prefix"),
+		MaxKeys:           maxKeys,
+		ContinuationToken: get("continuation-token"),
+	}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		response.IsTruncated = true
+		response.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		object := objects[key]
+		response.Contents = append(response.Contents, content{
+			Key:          key,
+			LastModified: object.LastModified,
+			ETag:         object.ETag,
+			Size:         len(object.Body),
+			StorageClass: "STANDARD",
+		})
+	}
+	response.KeyCount = len(response.Contents)
+	writeXML(w, response)
+}
+
+func readMetadata(r *http.Request) map[string]string {
+	metadata := make(map[string]string)
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, metadataPrefix) && len(values) > 0 {
+			metadata[strings.ToLower(strings.TrimPrefix(name, metadataPrefix))] = values[0]
+		}
+	}
+	return metadata
+}
+
+// Request body without the aws-chunked framing the SDK uses for streamed payloads, with the trailing
+// headers of the framing like checksums
+func readBody(r *http.Request) ([]byte, http.Header, error) {
+	trailer := http.Header{}
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") && !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		body, readError := io.ReadAll(r.Body)
+		return body, trailer, readError
+	}
+
+	reader := bufio.NewReader(r.Body)
+	body := bytes.Buffer{}
+	for {
+		header, readError := reader.ReadString('\n')
+		if readError != nil {
+			return nil, nil, readError
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, parseError := strconv.ParseInt(sizeField, 16, 64)
+		if parseError != nil {
+			return nil, nil, fmt.Errorf("invalid aws-chunked chunk size %q", sizeField)
+		}
+		if size == 0 {
+			break
+		}
+		if _, copyError := io.CopyN(&body, reader, size); copyError != nil {
+			return nil, nil, copyError
+		}
+		if _, discardError := reader.Discard(2); discardError != nil {
+			return nil, nil, discardError
+		}
+	}
+	// Trailing headers follow the last chunk until an empty line
+	for {
+		line, readError := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if name, value, found := strings.Cut(line, ":"); found {
+			trailer.Add(name, strings.TrimSpace(value))
+		}
+		if line == "" || readError != nil {
+			return body.Bytes(), trailer, nil
+		}
+	}
+}
+
+// Compare the body with the SHA-256 sent in the headers or in the aws-chunked trailer, returns the checksum
+func checkSHA256(r *http.Request, trailer http.Header, body []byte) (string, error) {
+	expected := r.Header.Get("X-Amz-Checksum-Sha256")
+	if expected == "" {
+		expected = trailer.Get("X-Amz-Checksum-Sha256")
+	}
+	if expected == "" {
+		return "", nil
+	}
+	digest := sha256.Sum256(body)
+	if actual := base64.StdEncoding.EncodeToString(digest[:]); actual != expected {
+		return "", fmt.Errorf("the SHA-256 %s you specified did not match the calculated checksum %s", expected, actual)
+	}
+	return expected, nil
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+	s.requests["PutObject"]++
+	body, trailer, readError := readBody(r)
+	if readError != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", readError.Error())
+		return
+	}
+	checksum, checksumError := checkSHA256(r, trailer, body)
+	if checksumError != nil {
+		writeError(w, http.StatusBadRequest, "BadDigest", checksumError.Error())
+		return
+	}
+	object := &Object{
+		Body:         body,
+		Metadata:     readMetadata(r),
+		ContentType:  r.Header.Get("Content-Type"),
+		LastModified: time.Now().UTC().Truncate(time.Second),
+		ETag:         etag(body),
+		Checksum:     checksum,
+	}
+	objects[key] = object
+	w.Header().Set("ETag", object.ETag)
+}
+
+// Object named by the X-Amz-Copy-Source header, "bucket/key" with the key URL-encoded
+func (s *Server) copySource(r *http.Request) (*Object, bool) {
+	source, _, _ := strings.Cut(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"), "?")
+	bucket, escapedKey, _ := strings.Cut(source, "/")
+	key, unescapeError := url.PathUnescape(escapedKey)
+	if unescapeError != nil {
+		return nil, false
+	}
+	object, found := s.buckets[bucket][key]
+	return object, found
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+	s.requests["CopyObject"]++
+	source, found := s.copySource(r)
+	if !found {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "the source key does not exist")
+		return
+	}
+	object := *source
+	object.LastModified = time.Now().UTC().Truncate(time.Second)
+	// The metadata of the source is kept unless the request replaces it
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		object.Metadata = readMetadata(r)
+		object.ContentType = r.Header.Get("Content-Type")
+	}
+	objects[key] = &object
+	writeXML(w, struct {
+		XMLName      xml.Name  `xml:"CopyObjectResult"`
+		ETag         string    `xml:"ETag"`
+		LastModified time.Time `xml:"LastModified"`
+	}{ETag: object.ETag, LastModified: object.LastModified})
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+	if r.Method == http.MethodHead {
+		s.requests["HeadObject"]++
+	} else {
+		s.requests["GetObject"]++
+	}
+	object, found := objects[key]
+	if !found {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+		return
+	}
+	for name, value := range object.Metadata {
+		w.Header().Set(metadataPrefix+name, value)
+	}
+	if object.ContentType != "" {
+		w.Header().Set("Content-Type", object.ContentType)
+	}
+	w.Header().Set("ETag", object.ETag)
+	if object.Checksum != "" && r.Header.Get("X-Amz-Checksum-Mode") == "ENABLED" {
+		w.Header().Set("X-Amz-Checksum-Sha256", object.Checksum)
+	}
+	w.Header().Set("Last-Modified", object.LastModified.Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(object.Body)))
+	if r.Method == http.MethodGet {
+		w.Write(object.Body)
+	}
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	s.requests["CreateMultipartUpload"]++
+	s.uploadId++
+	uploadId := strconv.Itoa(s.uploadId)
+	s.uploads[uploadId] = &multipartUpload{
+		bucket:      bucket,
+		key:         key,
+		metadata:    readMetadata(r),
+		contentType: r.Header.Get("Content-Type"),
+		parts:       make(map[int][]byte),
+	}
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadId string   `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadId: uploadId})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, query map[string][]string) {
+	s.requests["UploadPart"]++
+	upload, found := s.uploads[query["uploadId"][0]]
+	if !found {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+		return
+	}
+	partNumber, parseError := strconv.Atoi(strings.Join(query["partNumber"], ""))
+	if parseError != nil || partNumber < 1 || partNumber > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+	body, trailer, readError := readBody(r)
+	if readError != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", readError.Error())
+		return
+	}
+	if _, checksumError := checkSHA256(r, trailer, body); checksumError != nil {
+		writeError(w, http.StatusBadRequest, "BadDigest", checksumError.Error())
+		return
+	}
+	upload.parts[partNumber] = body
+	w.Header().Set("ETag", etag(body))
+}
+
+// Copy the range given by X-Amz-Copy-Source-Range, "bytes=first-last", or the whole source as a part
+func (s *Server) uploadPartCopy(w http.ResponseWriter, r *http.Request, query map[string][]string) {
+	s.requests["UploadPartCopy"]++
+	upload, found := s.uploads[query["uploadId"][0]]
+	if !found {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+		return
+	}
+	partNumber, parseError := strconv.Atoi(strings.Join(query["partNumber"], ""))
+	if parseError != nil || partNumber < 1 || partNumber > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+	source, found := s.copySource(r)
+	if !found {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "the source key does not exist")
+		return
+	}
+	body := source.Body
+	if byteRange := r.Header.Get("X-Amz-Copy-Source-Range"); byteRange != "" {
+		var first, last int
+		if _, scanError := fmt.Sscanf(byteRange, "bytes=%d-%d", &first, &last); scanError != nil || first > last || last >= len(body) {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid copy source range")
+			return
+		}
+		body = body[first : last+1]
+	}
+	upload.parts[partNumber] = slices.Clone(body)
+	writeXML(w, struct {
+		XMLName      xml.Name  `xml:"CopyPartResult"`
+		ETag         string    `xml:"ETag"`
+		LastModified time.Time `xml:"LastModified"`
+	}{ETag: etag(body), LastModified: time.Now().UTC().Truncate(time.Second)})
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, objects map[string]*Object, uploadId string) {
+	s.requests["CompleteMultipartUpload"]++
+	upload, found := s.uploads[uploadId]
+	if !found {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if decodeError := xml.NewDecoder(r.Body).Decode(&request); decodeError != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", decodeError.Error())
+		return
+	}
+	if len(request.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "no part given")
+		return
+	}
+
+	body := bytes.Buffer{}
+	for i, part := range request.Parts {
+		content, found := upload.parts[part.PartNumber]
+		if !found || etag(content) != part.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d has not been uploaded", part.PartNumber))
+			return
+		}
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			writeError(w, http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order")
+			return
+		}
+		body.Write(content)
+	}
+	object := &Object{
+		Body:         body.Bytes(),
+		Metadata:     upload.metadata,
+		ContentType:  upload.contentType,
+		LastModified: time.Now().UTC().Truncate(time.Second),
+		ETag:         fmt.Sprintf(`"%s-%d"`, strings.Trim(etag(body.Bytes()), `"`), len(request.Parts)),
+	}
+	objects[upload.key] = object
+	delete(s.uploads, uploadId)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: upload.bucket, Key: upload.key, ETag: object.ETag})
+}
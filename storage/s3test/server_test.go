@@ -0,0 +1,111 @@
+package s3test_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"enssat.tv/autovodsaver/storage/s3test"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func newClient(server *s3test.Server) *s3.Client {
+	return s3.New(s3.Options{
+		BaseEndpoint: aws.String(server.URL),
+		Region:       "eu-west",
+		Credentials:  credentials.NewStaticCredentialsProvider("access", "secret", ""),
+		UsePathStyle: true,
+	})
+}
+
+func TestMultipartUpload(t *testing.T) {
+	server := s3test.NewServer("videos")
+	defer server.Close()
+	client := newClient(server)
+	ctx := context.Background()
+
+	upload, createError := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String("videos"),
+		Key:      aws.String("video.mp4"),
+		Metadata: map[string]string{"id": "1000"},
+	})
+	if createError != nil {
+		t.Fatal(createError)
+	}
+	parts := [][]byte{bytes.Repeat([]byte("a"), 1024), bytes.Repeat([]byte("b"), 512)}
+	completed := make([]types.CompletedPart, 0)
+	for i, part := range parts {
+		uploaded, uploadError := client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String("videos"),
+			Key:        aws.String("video.mp4"),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			Body:       bytes.NewReader(part),
+		})
+		if uploadError != nil {
+			t.Fatal(uploadError)
+		}
+		completed = append(completed, types.CompletedPart{ETag: uploaded.ETag, PartNumber: aws.Int32(int32(i + 1))})
+	}
+	if server.PendingUploads() != 1 {
+		t.Errorf("%d pending uploads before completion, want 1", server.PendingUploads())
+	}
+	if _, completeError := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("videos"),
+		Key:             aws.String("video.mp4"),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	}); completeError != nil {
+		t.Fatal(completeError)
+	}
+
+	object, getError := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("videos"), Key: aws.String("video.mp4")})
+	if getError != nil {
+		t.Fatal(getError)
+	}
+	defer object.Body.Close()
+	body, readError := io.ReadAll(object.Body)
+	if readError != nil {
+		t.Fatal(readError)
+	}
+	if !bytes.Equal(body, bytes.Join(parts, nil)) {
+		t.Errorf("object holds %d bytes, want the %d bytes of the parts", len(body), len(bytes.Join(parts, nil)))
+	}
+	if object.Metadata["id"] != "1000" {
+		t.Errorf("metadata = %v, want the metadata given on creation", object.Metadata)
+	}
+	if server.PendingUploads() != 0 {
+		t.Errorf("%d pending uploads after completion, want 0", server.PendingUploads())
+	}
+}
+
+func TestAbortMultipartUpload(t *testing.T) {
+	server := s3test.NewServer("videos")
+	defer server.Close()
+	client := newClient(server)
+	ctx := context.Background()
+
+	upload, createError := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("videos"), Key: aws.String("video.mp4")})
+	if createError != nil {
+		t.Fatal(createError)
+	}
+	if _, abortError := client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String("videos"), Key: aws.String("video.mp4"), UploadId: upload.UploadId}); abortError != nil {
+		t.Fatal(abortError)
+	}
+	if server.PendingUploads() != 0 || len(server.Keys("videos")) != 0 {
+		t.Errorf("%d pending uploads and keys %v after abort, want none", server.PendingUploads(), server.Keys("videos"))
+	}
+}
+
+func TestHeadMissingObject(t *testing.T) {
+	server := s3test.NewServer("videos")
+	defer server.Close()
+
+	if _, headError := newClient(server).HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("videos"), Key: aws.String("missing")}); headError == nil {
+		t.Error("HeadObject() of a missing object succeeded, want an error")
+	}
+}
@@ -1,8 +1,48 @@
 package storage
 
-import "enssat.tv/autovodsaver/twitch"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"enssat.tv/autovodsaver/twitch"
+)
+
+var (
+	ErrVideoNotStored   = errors.New("video is not stored")
+	ErrChecksumMismatch = errors.New("stored video does not match its checksum")
+)
 
 type Storager interface {
-	Save(filePath string) error
+	// Store the file as the given video, an already stored video is replaced. The file is rejected when it does
+	// not match video.Checksum, its checksum is computed when video.Checksum is empty.
+	Save(video *twitch.Video, filePath string) error
+	// List the stored videos with their metadata
 	GetVideos() ([]twitch.Video, error)
+	// Read the stored video again and compare it with the checksum recorded when it was saved,
+	// and with video.Checksum when it is set
+	Verify(video *twitch.Video) error
+	// Check that the storage is reachable
+	Ping(ctx context.Context) error
+}
+
+// SHA-256 of the file in hexadecimal, the format of twitch.Video.Checksum
+func FileChecksum(filePath string) (string, error) {
+	file, openError := os.Open(filePath)
+	if openError != nil {
+		return "", openError
+	}
+	defer file.Close()
+	return readChecksum(file)
+}
+
+func readChecksum(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, copyError := io.Copy(hash, r); copyError != nil {
+		return "", copyError
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
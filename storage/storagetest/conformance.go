@@ -0,0 +1,217 @@
+// Behaviour every Storager implementation must have
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/storage"
+	"enssat.tv/autovodsaver/twitch"
+)
+
+// Run the conformance suite, newStorager must return an empty storage on each call
+func Run(t *testing.T, newStorager func(t *testing.T) storage.Storager) {
+	t.Run("Ping", func(t *testing.T) {
+		if pingError := newStorager(t).Ping(context.Background()); pingError != nil {
+			t.Errorf("Ping() error = %v", pingError)
+		}
+	})
+	t.Run("EmptyStorage", func(t *testing.T) {
+		testEmptyStorage(t, newStorager(t))
+	})
+	t.Run("SaveThenList", func(t *testing.T) {
+		testSaveThenList(t, newStorager(t))
+	})
+	t.Run("SaveReplaces", func(t *testing.T) {
+		testSaveReplaces(t, newStorager(t))
+	})
+	t.Run("SaveMissingFile", func(t *testing.T) {
+		testSaveMissingFile(t, newStorager(t))
+	})
+	t.Run("ManyVideos", func(t *testing.T) {
+		testManyVideos(t, newStorager(t))
+	})
+	t.Run("SaveChecksum", func(t *testing.T) {
+		testSaveChecksum(t, newStorager(t))
+	})
+	t.Run("Verify", func(t *testing.T) {
+		testVerify(t, newStorager(t))
+	})
+}
+
+func newVideo(id string) twitch.Video {
+	return twitch.Video{
+		Context:       context.Background(),
+		Id:            id,
+		Title:         "Video " + id,
+		Description:   "Description of video " + id,
+		PublishedAt:   time.Date(2024, time.March, 1, 20, 30, 0, 0, time.UTC),
+		LengthSeconds: 3600,
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), "video.mp4")
+	if writeError := os.WriteFile(filePath, []byte(content), 0660); writeError != nil {
+		t.Fatal(writeError)
+	}
+	return filePath
+}
+
+func listVideos(t *testing.T, store storage.Storager) []twitch.Video {
+	t.Helper()
+	videos, getVideosError := store.GetVideos()
+	if getVideosError != nil {
+		t.Fatalf("GetVideos() error = %v", getVideosError)
+	}
+	slices.SortFunc(videos, func(a, b twitch.Video) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+	return videos
+}
+
+func sameMetadata(a twitch.Video, b twitch.Video) bool {
+	return a.Id == b.Id && a.Title == b.Title && a.Description == b.Description && a.LengthSeconds == b.LengthSeconds && a.PublishedAt.Equal(b.PublishedAt)
+}
+
+func testEmptyStorage(t *testing.T, store storage.Storager) {
+	if videos := listVideos(t, store); len(videos) != 0 {
+		t.Errorf("GetVideos() of an empty storage returned %d videos, want 0", len(videos))
+	}
+}
+
+func testSaveThenList(t *testing.T, store storage.Storager) {
+	video := newVideo("1000")
+	if saveError := store.Save(&video, writeFile(t, "content")); saveError != nil {
+		t.Fatalf("Save() error = %v", saveError)
+	}
+
+	videos := listVideos(t, store)
+	if len(videos) != 1 {
+		t.Fatalf("GetVideos() returned %d videos, want 1", len(videos))
+	}
+	if !sameMetadata(videos[0], video) {
+		t.Errorf("GetVideos()[0] = %+v, want %+v", videos[0], video)
+	}
+}
+
+func testSaveReplaces(t *testing.T, store storage.Storager) {
+	video := newVideo("1000")
+	if saveError := store.Save(&video, writeFile(t, "first")); saveError != nil {
+		t.Fatalf("Save() error = %v", saveError)
+	}
+	video.Description = "Updated description"
+	if saveError := store.Save(&video, writeFile(t, "second")); saveError != nil {
+		t.Fatalf("Save() error = %v", saveError)
+	}
+
+	videos := listVideos(t, store)
+	if len(videos) != 1 {
+		t.Fatalf("GetVideos() returned %d videos after saving the same video twice, want 1", len(videos))
+	}
+	if videos[0].Description != video.Description {
+		t.Errorf("description = %q, want %q", videos[0].Description, video.Description)
+	}
+}
+
+func testSaveMissingFile(t *testing.T, store storage.Storager) {
+	video := newVideo("1000")
+	if saveError := store.Save(&video, filepath.Join(t.TempDir(), "missing.mp4")); saveError == nil {
+		t.Error("Save() of a missing file succeeded, want an error")
+	}
+	if videos := listVideos(t, store); len(videos) != 0 {
+		t.Errorf("GetVideos() returned %d videos after a failed save, want 0", len(videos))
+	}
+}
+
+func testManyVideos(t *testing.T, store storage.Storager) {
+	filePath := writeFile(t, "content")
+	saved := make([]twitch.Video, 0)
+	for i := 0; i < 25; i++ {
+		video := newVideo(fmt.Sprintf("%04d", i))
+		if saveError := store.Save(&video, filePath); saveError != nil {
+			t.Fatalf("Save(%s) error = %v", video.Id, saveError)
+		}
+		saved = append(saved, video)
+	}
+
+	videos := listVideos(t, store)
+	if len(videos) != len(saved) {
+		t.Fatalf("GetVideos() returned %d videos, want %d", len(videos), len(saved))
+	}
+	for i := range saved {
+		if !sameMetadata(videos[i], saved[i]) {
+			t.Errorf("GetVideos()[%d] = %+v, want %+v", i, videos[i], saved[i])
+		}
+	}
+}
+
+func testSaveChecksum(t *testing.T, store storage.Storager) {
+	filePath := writeFile(t, "content")
+	checksum, checksumError := storage.FileChecksum(filePath)
+	if checksumError != nil {
+		t.Fatal(checksumError)
+	}
+
+	// The checksum of another file must be rejected
+	mismatch := newVideo("1001")
+	mismatch.Checksum = strings.Repeat("0", len(checksum))
+	if saveError := store.Save(&mismatch, filePath); saveError == nil {
+		t.Error("Save() with the checksum of another file succeeded, want an error")
+	}
+
+	video := newVideo("1000")
+	video.Checksum = checksum
+	if saveError := store.Save(&video, filePath); saveError != nil {
+		t.Fatalf("Save() error = %v", saveError)
+	}
+	// Without checksum the one of the file is recorded
+	computed := newVideo("1002")
+	if saveError := store.Save(&computed, filePath); saveError != nil {
+		t.Fatalf("Save() error = %v", saveError)
+	}
+
+	videos := listVideos(t, store)
+	if len(videos) != 2 {
+		t.Fatalf("GetVideos() returned %d videos, want the 2 videos matching their checksum", len(videos))
+	}
+	for _, listed := range videos {
+		if listed.Checksum != checksum {
+			t.Errorf("checksum of video %s = %q, want %q", listed.Id, listed.Checksum, checksum)
+		}
+	}
+}
+
+func testVerify(t *testing.T, store storage.Storager) {
+	video := newVideo("1000")
+	if saveError := store.Save(&video, writeFile(t, "content")); saveError != nil {
+		t.Fatalf("Save() error = %v", saveError)
+	}
+
+	if verifyError := store.Verify(&video); verifyError != nil {
+		t.Errorf("Verify() error = %v", verifyError)
+	}
+	// The title may change on Twitch after the video has been stored
+	renamed := video
+	renamed.Title = "Renamed"
+	if verifyError := store.Verify(&renamed); verifyError != nil {
+		t.Errorf("Verify() of a renamed video error = %v", verifyError)
+	}
+	expected := video
+	expected.Checksum = strings.Repeat("0", 64)
+	if verifyError := store.Verify(&expected); !errors.Is(verifyError, storage.ErrChecksumMismatch) {
+		t.Errorf("Verify() with another checksum error = %v, want %v", verifyError, storage.ErrChecksumMismatch)
+	}
+	missing := newVideo("2000")
+	if verifyError := store.Verify(&missing); !errors.Is(verifyError, storage.ErrVideoNotStored) {
+		t.Errorf("Verify() of a missing video error = %v, want %v", verifyError, storage.ErrVideoNotStored)
+	}
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/metrics"
+	"enssat.tv/autovodsaver/twitch"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/rs/zerolog"
+)
+
+const defaultPartSize = 16 << 20
+
+// A single CopyObject is limited to 5 GiB by S3, larger objects are copied by parts of copyPartSize
+var (
+	maxCopyObjectSize int64 = 5 << 30
+	copyPartSize      int64 = 1 << 30
+)
+
+// Storage able to store a video while it is being downloaded, without a local copy of the file
+type StreamStorager interface {
+	Storager
+	// Store what write writes as the given video, the video is not stored when write fails and its error is returned
+	SaveStream(video *twitch.Video, write func(w io.Writer) error) error
+}
+
+// Upload the video as a multipart upload, one part is kept in memory at a time. The checksum of the whole video
+// is unknown when the upload starts, the sha256 metadata is set by copying the object onto itself once complete.
+func (s *S3Storage) SaveStream(video *twitch.Video, write func(w io.Writer) error) error {
+	logger := s.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	if s.Client == nil {
+		return fmt.Errorf("s3 client is nil, is the client initialize correctly ?")
+	}
+
+	reader, writer := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		writeError := write(writer)
+		writer.CloseWithError(writeError)
+		written <- writeError
+	}()
+
+	start := time.Now()
+	size, checksum, uploadError := s.uploadParts(video, reader)
+	// Stop the writer when the upload failed first, its error takes precedence as it tells why the video is incomplete
+	reader.CloseWithError(errors.Join(uploadError, io.ErrClosedPipe))
+	if writeError := <-written; writeError != nil {
+		metrics.UploadDuration.Observe(time.Since(start).Seconds(), "error")
+		return writeError
+	}
+	if uploadError != nil {
+		metrics.UploadDuration.Observe(time.Since(start).Seconds(), "error")
+		return uploadError
+	}
+	if video.Checksum != "" && video.Checksum != checksum {
+		metrics.UploadDuration.Observe(time.Since(start).Seconds(), "error")
+		return fmt.Errorf("%w: video %s uploaded with checksum %s, %s was written", ErrChecksumMismatch, video.Id, checksum, video.Checksum)
+	}
+	if recordError := s.recordChecksum(video, size, checksum); recordError != nil {
+		metrics.UploadDuration.Observe(time.Since(start).Seconds(), "error")
+		return fmt.Errorf("checksum of video %s could not be recorded in s3: %w", video.Id, recordError)
+	}
+	video.Checksum = checksum
+	metrics.UploadDuration.Observe(time.Since(start).Seconds(), "success")
+	metrics.BytesUploaded.Add(float64(size))
+
+	logger.Info().Msgf("video %s streamed to s3 bucket %s (%d bytes)", video.Title, s.Bucket, size)
+	return nil
+}
+
+// Replace the metadata of the uploaded object by the same metadata along with its checksum
+func (s *S3Storage) recordChecksum(video *twitch.Video, size int64, checksum string) error {
+	key := objectKey(video)
+	source := s.Bucket + "/" + url.PathEscape(key)
+	metadata := videoMetadata(video, checksum)
+	if size <= maxCopyObjectSize {
+		_, copyError := s.Client.CopyObject(s.Context, &s3.CopyObjectInput{
+			Bucket:            &s.Bucket,
+			Key:               &key,
+			CopySource:        aws.String(source),
+			ContentType:       aws.String("video/mp4"),
+			MetadataDirective: types.MetadataDirectiveReplace,
+			Metadata:          metadata,
+		})
+		return copyError
+	}
+
+	created, createError := s.Client.CreateMultipartUpload(s.Context, &s3.CreateMultipartUploadInput{
+		Bucket:      &s.Bucket,
+		Key:         &key,
+		ContentType: aws.String("video/mp4"),
+		Metadata:    metadata,
+	})
+	if createError != nil {
+		return createError
+	}
+	parts := make([]types.CompletedPart, 0, size/copyPartSize+1)
+	for first := int64(0); first < size; first += copyPartSize {
+		partNumber := int32(len(parts) + 1)
+		copied, copyError := s.Client.UploadPartCopy(s.Context, &s3.UploadPartCopyInput{
+			Bucket:          &s.Bucket,
+			Key:             &key,
+			UploadId:        created.UploadId,
+			PartNumber:      aws.Int32(partNumber),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", first, min(first+copyPartSize, size)-1)),
+		})
+		if copyError != nil {
+			s.Client.AbortMultipartUpload(s.Context, &s3.AbortMultipartUploadInput{Bucket: &s.Bucket, Key: &key, UploadId: created.UploadId})
+			return copyError
+		}
+		parts = append(parts, types.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: aws.Int32(partNumber)})
+	}
+	_, completeError := s.Client.CompleteMultipartUpload(s.Context, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.Bucket,
+		Key:             &key,
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if completeError != nil {
+		s.Client.AbortMultipartUpload(s.Context, &s3.AbortMultipartUploadInput{Bucket: &s.Bucket, Key: &key, UploadId: created.UploadId})
+	}
+	return completeError
+}
+
+// Upload what is read as the parts of a multipart upload and return its size and hex SHA-256, the upload is only
+// created once the first part has been read and it is aborted on failure
+func (s *S3Storage) uploadParts(video *twitch.Video, reader io.Reader) (int64, string, error) {
+	logger := s.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	buffer := make([]byte, partSize)
+	hash := sha256.New()
+	key := objectKey(video)
+	var (
+		uploadId *string
+		parts    []types.CompletedPart
+		size     int64
+	)
+	abort := func(cause error) (int64, string, error) {
+		if uploadId != nil {
+			if _, abortError := s.Client.AbortMultipartUpload(s.Context, &s3.AbortMultipartUploadInput{Bucket: &s.Bucket, Key: &key, UploadId: uploadId}); abortError != nil {
+				logger.Error().Msgf("multipart upload of video %s could not be aborted: %s", video.Id, abortError.Error())
+			}
+		}
+		return size, "", cause
+	}
+
+	for {
+		n, readError := io.ReadFull(reader, buffer)
+		if readError != nil && readError != io.EOF && readError != io.ErrUnexpectedEOF {
+			return abort(readError)
+		}
+		if n == 0 && uploadId != nil {
+			break
+		}
+
+		if uploadId == nil {
+			created, createError := s.Client.CreateMultipartUpload(s.Context, &s3.CreateMultipartUploadInput{
+				Bucket:            &s.Bucket,
+				Key:               &key,
+				ContentType:       aws.String("video/mp4"),
+				ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+				Metadata:          videoMetadata(video, ""),
+			})
+			if createError != nil {
+				return size, "", createError
+			}
+			uploadId = created.UploadId
+		}
+
+		digest := sha256.Sum256(buffer[:n])
+		checksum := base64.StdEncoding.EncodeToString(digest[:])
+		partNumber := int32(len(parts) + 1)
+		uploaded, uploadPartError := s.Client.UploadPart(s.Context, &s3.UploadPartInput{
+			Bucket:         &s.Bucket,
+			Key:            &key,
+			UploadId:       uploadId,
+			PartNumber:     aws.Int32(partNumber),
+			Body:           bytes.NewReader(buffer[:n]),
+			ChecksumSHA256: aws.String(checksum),
+		})
+		if uploadPartError != nil {
+			return abort(uploadPartError)
+		}
+		parts = append(parts, types.CompletedPart{ETag: uploaded.ETag, PartNumber: aws.Int32(partNumber), ChecksumSHA256: aws.String(checksum)})
+		hash.Write(buffer[:n])
+		size += int64(n)
+		logger.Debug().Msgf("part %d of video %s uploaded (%d bytes)", partNumber, video.Id, n)
+
+		if readError != nil {
+			break
+		}
+	}
+
+	if _, completeError := s.Client.CompleteMultipartUpload(s.Context, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.Bucket,
+		Key:             &key,
+		UploadId:        uploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); completeError != nil {
+		return abort(completeError)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,153 @@
+package twitch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"enssat.tv/autovodsaver/bandwidth"
+	"enssat.tv/autovodsaver/twitch/internals"
+)
+
+const (
+	DefaultGraphQLBaseURL = "https://gql.twitch.tv"
+	DefaultUsherBaseURL   = "https://usher.ttvnw.net"
+	DefaultClientId       = "kd1unb4b3q4t58fwlpcbzcbnm76a8fp"
+	DefaultTimeout        = 30 * time.Second
+	DefaultGraphQLRate    = 4  // Requêtes par seconde vers l'api GraphQL
+	DefaultGraphQLBurst   = 8  // Rafale de requêtes autorisée vers l'api GraphQL
+	DefaultMediaRate      = 30 // Requêtes par seconde de playlists et de morceaux
+	DefaultMediaBurst     = 60 // Rafale de requêtes autorisée de playlists et de morceaux
+)
+
+// Configuration d'un client Twitch, les champs vides prennent leur valeur par défaut
+type ClientOptions struct {
+	GraphQLBaseURL string            // Adresse de base de l'api GraphQL
+	UsherBaseURL   string            // Adresse de base du service distribuant les playlists des vidéos
+	HTTPClient     *http.Client      // Client HTTP à utiliser, Proxy est ignoré lorsqu'il est fourni
+	Timeout        time.Duration     // Durée maximale d'attente des en-têtes d'une réponse puis de chaque lecture de son corps
+	Proxy          *url.URL          // Proxy de toutes les requêtes, celui des variables d'environnement HTTP(S)_PROXY par défaut
+	UserAgent      string            // User-Agent de toutes les requêtes
+	ClientId       string            // Identifiant envoyé à l'api GraphQL
+	OAuthToken     string            // Token OAuth d'un utilisateur envoyé à l'api GraphQL, il donne accès aux vidéos réservées aux abonnés
+	GraphQLRate    float64           // Requêtes par seconde vers l'api GraphQL, sans limite lorsqu'il est négatif
+	GraphQLBurst   int               // Rafale de requêtes autorisée vers l'api GraphQL
+	MediaRate      float64           // Requêtes par seconde de playlists et de morceaux, sans limite lorsqu'il est négatif
+	MediaBurst     int               // Rafale de requêtes autorisée de playlists et de morceaux
+	Bandwidth      *bandwidth.Limits // Débits maximaux du téléchargement des morceaux, sans limite lorsqu'il est nil
+	WorkDir        string            // Dossier des morceaux en cours de téléchargement, le dossier temporaire du système par défaut
+}
+
+// Statistiques d'un limiteur de requêtes
+type LimiterStats = internals.LimiterStats
+
+// Client des services de Twitch (api GraphQL, playlists et CDN)
+type Client struct {
+	api       *internals.Client
+	bandwidth *bandwidth.Limits
+	workDir   string
+}
+
+// Client utilisé par les fonctions du paquet et par les vidéos sans client
+var DefaultClient = NewClient(ClientOptions{})
+
+// Crée un client Twitch à partir de sa configuration
+func NewClient(options ClientOptions) *Client {
+	httpClient := options.HTTPClient
+	if httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if options.Proxy != nil {
+			transport.Proxy = http.ProxyURL(options.Proxy)
+		}
+		// Le délai est appliqué par le client de Twitch, un délai global couperait le téléchargement
+		// des morceaux longs à lire sous un plafond de débit
+		httpClient = &http.Client{Transport: transport}
+	}
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	api := &internals.Client{
+		HTTPClient:     httpClient,
+		Timeout:        timeout,
+		GraphQLBaseURL: options.GraphQLBaseURL,
+		UsherBaseURL:   options.UsherBaseURL,
+		ClientId:       options.ClientId,
+		UserAgent:      options.UserAgent,
+		OAuthToken:     options.OAuthToken,
+		GraphQLLimiter: newLimiter("graphql", options.GraphQLRate, DefaultGraphQLRate, options.GraphQLBurst, DefaultGraphQLBurst),
+		MediaLimiter:   newLimiter("media", options.MediaRate, DefaultMediaRate, options.MediaBurst, DefaultMediaBurst),
+	}
+	if api.GraphQLBaseURL == "" {
+		api.GraphQLBaseURL = DefaultGraphQLBaseURL
+	}
+	if api.UsherBaseURL == "" {
+		api.UsherBaseURL = DefaultUsherBaseURL
+	}
+	if api.ClientId == "" {
+		api.ClientId = DefaultClientId
+	}
+	return &Client{api: api, bandwidth: options.Bandwidth, workDir: options.WorkDir}
+}
+
+func newLimiter(name string, rate float64, defaultRate float64, burst int, defaultBurst int) *internals.Limiter {
+	if rate == 0 {
+		rate = defaultRate
+	}
+	if burst <= 0 {
+		burst = defaultBurst
+	}
+	return internals.NewLimiter(name, rate, burst)
+}
+
+// Copie du client authentifiée avec le token OAuth d'un utilisateur, comme un abonné de la chaîne,
+// elle partage les limiteurs de requêtes et de débit ainsi que le dossier de travail du client
+func (c *Client) WithOAuthToken(token string) *Client {
+	api := *c.api
+	api.OAuthToken = token
+	return &Client{api: &api, bandwidth: c.bandwidth, workDir: c.workDir}
+}
+
+// Statistiques des limiteurs de requêtes, partagés par les copies du client
+func (c *Client) LimiterStats() []LimiterStats {
+	return c.api.LimiterStats()
+}
+
+// Récupère les informations de la vidéo à partir de son identifiant, ErrVideoNotFound lorsqu'elle n'existe pas
+func (c *Client) GetVideo(ctx context.Context, videoId string) (Video, error) {
+	video, err := internals.PostGraphQL[videoResponse](ctx, c.api, getVideoQuery(videoId))
+	if err != nil {
+		return Video{}, err
+	}
+	if video.Data.Video == nil {
+		return Video{}, fmt.Errorf("%w: %s", ErrVideoNotFound, videoId)
+	}
+	video.Data.Video.Context = ctx
+	video.Data.Video.Client = c
+	return *video.Data.Video, nil
+}
+
+// Récupère les informations des vidéos d'une chaîne, ErrChannelNotFound lorsqu'elle n'existe pas
+func (c *Client) GetVideos(ctx context.Context, channelName string) ([]Video, error) {
+	data, err := internals.PostGraphQL[userVideosResponse](ctx, c.api, getVideosByChannel(channelName))
+	if err != nil {
+		return nil, err
+	}
+	if data.Data.User == nil {
+		return nil, fmt.Errorf("%w: %s", ErrChannelNotFound, channelName)
+	}
+	videos := make([]Video, 0)
+	for _, edge := range data.Data.User.Videos.Edges {
+		edge.Node.Context = ctx
+		edge.Node.Client = c
+		videos = append(videos, edge.Node)
+	}
+	return videos, nil
+}
+
+// Envoie une requête vers Twitch ou son CDN
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	return c.api.Do(req)
+}
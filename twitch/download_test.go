@@ -0,0 +1,167 @@
+package twitch_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/twitch"
+	"enssat.tv/autovodsaver/twitch/twitchtest"
+)
+
+func TestDownloadReplacesExistingFile(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	segments := [][]byte{twitchtest.TSSegment(0, 2), twitchtest.TSSegment(1, 2)}
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000", Segments: segments})
+	output := filepath.Join(t.TempDir(), "1000.mp4")
+	// Un fichier plus long ne doit pas laisser de reste après la vidéo
+	if writeError := os.WriteFile(output, bytes.Repeat([]byte{0xFF}, 10*188), 0660); writeError != nil {
+		t.Fatal(writeError)
+	}
+
+	if downloadError := video.Download(output); downloadError != nil {
+		t.Fatalf("Download() error = %v", downloadError)
+	}
+	content, readError := os.ReadFile(output)
+	if readError != nil {
+		t.Fatal(readError)
+	}
+	if !bytes.Equal(content, bytes.Join(segments, nil)) {
+		t.Errorf("output holds %d bytes, want only the %d bytes of the video", len(content), len(bytes.Join(segments, nil)))
+	}
+	assertOnlyFile(t, filepath.Dir(output), "1000.mp4")
+}
+
+func TestDownloadKeepsExistingFileOnFailure(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+	server.Fail(twitchtest.SegmentPath("1000", 2), twitchtest.Failure{Status: http.StatusNotFound})
+	output := filepath.Join(t.TempDir(), "1000.mp4")
+	if writeError := os.WriteFile(output, []byte("previous"), 0660); writeError != nil {
+		t.Fatal(writeError)
+	}
+
+	downloadError := video.Download(output)
+	var statusError *twitch.ChunkStatusError
+	if !errors.As(downloadError, &statusError) || statusError.ChunkId != 2 || statusError.StatusCode != http.StatusNotFound {
+		t.Fatalf("Download() error = %v, want the status of chunk 2", downloadError)
+	}
+	// Un morceau refusé par le CDN n'est pas téléchargé à nouveau
+	if requests := server.Requests(twitchtest.SegmentPath("1000", 2)); requests != 1 {
+		t.Errorf("missing chunk requested %d times, want 1", requests)
+	}
+	if content, _ := os.ReadFile(output); string(content) != "previous" {
+		t.Errorf("output = %q after a failed download, want the previous file", content)
+	}
+	assertOnlyFile(t, filepath.Dir(output), "1000.mp4")
+}
+
+func TestDownloadRetriesServerErrors(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+	server.Fail(twitchtest.SegmentPath("1000", 1), twitchtest.Failure{Status: http.StatusServiceUnavailable, Times: 1})
+
+	if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError != nil {
+		t.Fatalf("Download() error = %v", downloadError)
+	}
+	if requests := server.Requests(twitchtest.SegmentPath("1000", 1)); requests != 2 {
+		t.Errorf("chunk requested %d times, want 2", requests)
+	}
+}
+
+// Vérifie que le dossier ne contient que le fichier donné, sans fichier temporaire restant
+func assertOnlyFile(t *testing.T, dir string, name string) {
+	t.Helper()
+	entries, readDirError := os.ReadDir(dir)
+	if readDirError != nil {
+		t.Fatal(readDirError)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory holds %v, want only %s", names, name)
+	}
+}
+
+// Nombre de descripteurs de fichiers ouverts par le processus
+func openFileDescriptors() (int, error) {
+	entries, readDirError := os.ReadDir("/proc/self/fd")
+	if readDirError != nil {
+		return 0, readDirError
+	}
+	return len(entries), nil
+}
+
+func TestDownloadFileDescriptorsStayBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("10000 chunks are downloaded")
+	}
+	server := twitchtest.NewServer()
+	defer server.Close()
+	segments := make([][]byte, 10000)
+	for i := range segments {
+		segments[i] = twitchtest.TSSegment(i, 1)
+	}
+	server.AddVideo("channel", twitchtest.Video{Id: "1000", Segments: segments})
+	client := twitch.NewClient(twitch.ClientOptions{
+		GraphQLBaseURL: server.URL,
+		UsherBaseURL:   server.URL,
+		HTTPClient:     server.Server.Client(),
+		MediaRate:      -1,
+		WorkDir:        t.TempDir(),
+	})
+	video := getVideo(t, client, "1000")
+	baseline, countError := openFileDescriptors()
+	if countError != nil {
+		t.Skipf("open file descriptors cannot be counted: %v", countError)
+	}
+
+	// Les descripteurs sont comptés pendant tout le téléchargement, concaténation comprise. Le maximum et l'éventuelle
+	// erreur sont renvoyés par la goroutine une fois le téléchargement terminé : seul le test peut appeler t.Skipf
+	type sample struct {
+		peak int
+		err  error
+	}
+	done := make(chan struct{})
+	sampled := make(chan sample, 1)
+	go func() {
+		peak := baseline
+		for {
+			count, countError := openFileDescriptors()
+			if countError != nil {
+				sampled <- sample{err: countError}
+				return
+			}
+			peak = max(peak, count)
+			select {
+			case <-done:
+				sampled <- sample{peak: peak}
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4"))
+	close(done)
+	result := <-sampled
+	if downloadError != nil {
+		t.Fatalf("Download() error = %v", downloadError)
+	}
+	if result.err != nil {
+		t.Skipf("open file descriptors cannot be counted: %v", result.err)
+	}
+	peak := result.peak
+	// Quelques connexions et fichiers ouverts en même temps, loin des 10000 morceaux
+	if peak-baseline > 64 {
+		t.Errorf("%d file descriptors opened at once while downloading 10000 chunks, want at most 64", peak-baseline)
+	}
+}
@@ -0,0 +1,153 @@
+package internals
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"enssat.tv/autovodsaver/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// Paramètres communs aux requêtes envoyées à Twitch
+type Client struct {
+	HTTPClient     *http.Client // Client utilisé pour toutes les requêtes
+	GraphQLBaseURL string       // Adresse de base de l'api GraphQL, comme https://gql.twitch.tv
+	UsherBaseURL   string       // Adresse de base du service distribuant les playlists des vidéos, comme https://usher.ttvnw.net
+	ClientId       string       // Identifiant envoyé à l'api GraphQL
+	UserAgent      string       // User-Agent de toutes les requêtes, celui de Go lorsqu'il est vide
+	OAuthToken     string       // Token OAuth d'un utilisateur envoyé à l'api GraphQL, anonyme lorsqu'il est vide
+	GraphQLLimiter *Limiter     // Limiteur des requêtes vers l'api GraphQL, sans limite lorsqu'il est nil
+	MediaLimiter   *Limiter     // Limiteur des requêtes de playlists et de morceaux, sans limite lorsqu'il est nil
+	// Durée maximale d'attente des en-têtes de la réponse puis de chaque lecture du corps, sans limite lorsqu'elle
+	// est nulle. Le temps passé entre deux lectures, comme sous un plafond de débit, n'est pas compté
+	Timeout time.Duration
+}
+
+// Envoie la requête en y ajoutant les en-têtes communs, en respectant le limiteur de son trafic.
+// Une réponse 429 met le limiteur en pause et la requête est renvoyée jusqu'à MaxThrottleRetries fois.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	limiter := c.limiterFor(req)
+
+	for attempt := 0; ; attempt++ {
+		if waitError := limiter.Wait(req.Context()); waitError != nil {
+			return nil, waitError
+		}
+		res, responseError := c.send(req)
+		if responseError != nil || res.StatusCode != http.StatusTooManyRequests || attempt == MaxThrottleRetries {
+			return res, responseError
+		}
+		// Un corps déjà lu ne peut pas être renvoyé
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return res, nil
+		}
+
+		delay := throttleDelay(res, attempt)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		limiter.Throttle(delay)
+		metrics.TwitchThrottled.Inc(limiter.name)
+		log.Warn().Msgf("twitch throttled %s %s, pausing %s requests for %s (%s)", req.Method, req.URL.Path, limiter.name, delay, limiter.Stats())
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, getBodyError := req.GetBody()
+			if getBodyError != nil {
+				return nil, getBodyError
+			}
+			retry.Body = body
+		}
+		req = retry
+	}
+}
+
+// Envoie la requête une fois, elle est annulée lorsque Twitch reste silencieux plus longtemps que Timeout
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.Timeout <= 0 {
+		return c.HTTPClient.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	body := &idleTimeoutBody{timeout: c.Timeout, cancel: cancel}
+	body.timer = time.AfterFunc(c.Timeout, func() {
+		body.expired.Store(true)
+		cancel()
+	})
+	res, responseError := c.HTTPClient.Do(req.WithContext(ctx))
+	if responseError != nil {
+		body.timer.Stop()
+		cancel()
+		if body.expired.Load() {
+			return nil, body.timeoutError()
+		}
+		return nil, responseError
+	}
+	// Les en-têtes sont arrivés, le corps est surveillé lecture par lecture
+	body.timer.Stop()
+	body.body = res.Body
+	res.Body = body
+	return res, nil
+}
+
+// Corps d'une réponse dont chaque lecture doit aboutir avant le délai
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired atomic.Bool
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.expired.Load() {
+		return 0, b.timeoutError()
+	}
+	b.timer.Reset(b.timeout)
+	n, readError := b.body.Read(p)
+	b.timer.Stop()
+	if readError != nil && readError != io.EOF && b.expired.Load() {
+		return n, b.timeoutError()
+	}
+	return n, readError
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	closeError := b.body.Close()
+	b.cancel()
+	return closeError
+}
+
+func (b *idleTimeoutBody) timeoutError() error {
+	return fmt.Errorf("twitch sent nothing for %s: %w", b.timeout, os.ErrDeadlineExceeded)
+}
+
+// Limiteur du trafic de la requête, un limiteur propre à la requête lorsque le client n'en a pas
+func (c *Client) limiterFor(req *http.Request) *Limiter {
+	limiter, name := c.MediaLimiter, "media"
+	if strings.HasPrefix(req.URL.String(), c.GraphQLBaseURL+"/gql") {
+		limiter, name = c.GraphQLLimiter, "graphql"
+	}
+	if limiter == nil {
+		return NewLimiter(name, 0, 1)
+	}
+	return limiter
+}
+
+// Statistiques des limiteurs du client
+func (c *Client) LimiterStats() []LimiterStats {
+	stats := make([]LimiterStats, 0, 2)
+	for _, limiter := range []*Limiter{c.GraphQLLimiter, c.MediaLimiter} {
+		if limiter != nil {
+			stats = append(stats, limiter.Stats())
+		}
+	}
+	return stats
+}
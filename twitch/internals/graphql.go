@@ -2,47 +2,143 @@ package internals
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+
+	"enssat.tv/autovodsaver/metrics"
 )
 
-const gqlEndpoint = "https://gql.twitch.tv/gql"
-const clientId = "kd1unb4b3q4t58fwlpcbzcbnm76a8fp"
+// Requête GraphQL, les valeurs venant de l'extérieur doivent passer par les variables
+type Request struct {
+	OperationName      string         // Nom de l'opération de la requête
+	Query              string         // Texte de la requête, envoyé seul ou si la requête persistée est inconnue
+	Variables          map[string]any // Valeurs des variables de la requête
+	PersistedQueryHash string         // Empreinte SHA-256 d'une requête persistée par le serveur, la requête est envoyée sans texte
+}
+
+// Erreur renvoyée par le serveur GraphQL dans le tableau "errors"
+type Error struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// Erreurs renvoyées par le serveur GraphQL pour une requête
+type Errors []Error
 
-func PostGraphQL[T any](query string) (T, error) {
-	client := &http.Client{}
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		if len(err.Path) > 0 {
+			messages = append(messages, fmt.Sprintf("%s (path %v)", err.Message, err.Path))
+			continue
+		}
+		messages = append(messages, err.Message)
+	}
+	return "graphql: " + strings.Join(messages, "; ")
+}
 
-	payload, jsonError := json.Marshal(map[string]string{
-		"query": query,
-	})
+// Indique si le serveur ne connaît pas la requête persistée
+func (e Errors) persistedQueryNotFound() bool {
+	for _, err := range e {
+		if err.Message == "PersistedQueryNotFound" {
+			return true
+		}
+	}
+	return false
+}
+
+type persistedQuery struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+type extensions struct {
+	PersistedQuery persistedQuery `json:"persistedQuery"`
+}
+
+type payload struct {
+	OperationName string         `json:"operationName,omitempty"`
+	Query         string         `json:"query,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+	Extensions    *extensions    `json:"extensions,omitempty"`
+}
+
+func PostGraphQL[T any](ctx context.Context, client *Client, request Request) (T, error) {
+	body := payload{
+		OperationName: request.OperationName,
+		Query:         request.Query,
+		Variables:     request.Variables,
+	}
+	if request.PersistedQueryHash != "" {
+		body.Query = ""
+		body.Extensions = &extensions{PersistedQuery: persistedQuery{Version: 1, Sha256Hash: request.PersistedQueryHash}}
+	}
+
+	data, err := postGraphQL[T](ctx, client, body)
+	var graphQLErrors Errors
+	if request.PersistedQueryHash != "" && request.Query != "" && errors.As(err, &graphQLErrors) && graphQLErrors.persistedQueryNotFound() {
+		// Le serveur ne connaît pas l'empreinte, la requête complète permet de la persister
+		body.Query = request.Query
+		return postGraphQL[T](ctx, client, body)
+	}
+	return data, err
+}
+
+func postGraphQL[T any](ctx context.Context, client *Client, body payload) (T, error) {
+	metrics.GraphQLRequests.Inc()
+
+	encoded, jsonError := json.Marshal(body)
 	if jsonError != nil {
 		return *new(T), jsonError
 	}
 
-	reader := bytes.NewReader(payload)
-	req, requestError := http.NewRequest(http.MethodPost, gqlEndpoint, reader)
+	req, requestError := http.NewRequestWithContext(ctx, http.MethodPost, client.GraphQLBaseURL+"/gql", bytes.NewReader(encoded))
 	if requestError != nil {
 		return *new(T), requestError
 	}
-	req.Header.Set("Client-Id", clientId)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Client-Id", client.ClientId)
+	if client.OAuthToken != "" {
+		req.Header.Set("Authorization", "OAuth "+client.OAuthToken)
+	}
 
 	res, responseError := client.Do(req)
 	if responseError != nil {
+		metrics.GraphQLErrors.Inc("network")
 		return *new(T), responseError
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
+		metrics.GraphQLErrors.Inc(fmt.Sprintf("status_%d", res.StatusCode))
 		return *new(T), fmt.Errorf("post graphql failed with status code %d reason: %s", res.StatusCode, res.Status)
 	}
 
 	result, readAllError := io.ReadAll(res.Body)
 	if readAllError != nil {
+		metrics.GraphQLErrors.Inc("network")
 		return *new(T), readAllError
 	}
 
+	var envelope struct {
+		Errors Errors `json:"errors"`
+	}
+	if unjsonError := json.Unmarshal(result, &envelope); unjsonError != nil {
+		metrics.GraphQLErrors.Inc("decode")
+		return *new(T), unjsonError
+	}
+	if len(envelope.Errors) > 0 {
+		metrics.GraphQLErrors.Inc("graphql")
+		return *new(T), envelope.Errors
+	}
+
 	var data T
 	if unjsonError := json.Unmarshal(result, &data); unjsonError != nil {
+		metrics.GraphQLErrors.Inc("decode")
 		return *new(T), unjsonError
 	}
 	return data, nil
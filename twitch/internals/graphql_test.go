@@ -0,0 +1,106 @@
+package internals
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testResponse struct {
+	Data struct {
+		Echo string `json:"echo"`
+	} `json:"data"`
+}
+
+// Serveur répondant à chaque requête avec le handler donné, les payloads reçus sont enregistrés
+func newGraphQLServer(t *testing.T, handler func(body payload) any) (*Client, *[]payload) {
+	t.Helper()
+	received := make([]payload, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gql" || r.Header.Get("Client-Id") != "client-id" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var body payload
+		if decodeError := json.NewDecoder(r.Body).Decode(&body); decodeError != nil {
+			http.Error(w, decodeError.Error(), http.StatusBadRequest)
+			return
+		}
+		received = append(received, body)
+		json.NewEncoder(w).Encode(handler(body))
+	}))
+	t.Cleanup(server.Close)
+	return &Client{HTTPClient: server.Client(), GraphQLBaseURL: server.URL, ClientId: "client-id"}, &received
+}
+
+func TestPostGraphQLSendsVariables(t *testing.T) {
+	client, received := newGraphQLServer(t, func(body payload) any {
+		return map[string]any{"data": map[string]any{"echo": body.Variables["login"]}}
+	})
+	login := `x") { evil } #`
+
+	response, postError := PostGraphQL[testResponse](context.Background(), client, Request{
+		OperationName: "Echo",
+		Query:         "query Echo($login: String!) { echo(login: $login) }",
+		Variables:     map[string]any{"login": login},
+	})
+	if postError != nil {
+		t.Fatal(postError)
+	}
+	if response.Data.Echo != login {
+		t.Errorf("echo = %q, want %q", response.Data.Echo, login)
+	}
+	if len(*received) != 1 || (*received)[0].OperationName != "Echo" || (*received)[0].Extensions != nil {
+		t.Errorf("received %+v, want a single Echo operation without extensions", *received)
+	}
+}
+
+func TestPostGraphQLErrors(t *testing.T) {
+	client, _ := newGraphQLServer(t, func(body payload) any {
+		return map[string]any{
+			"data":   nil,
+			"errors": []map[string]any{{"message": "service timeout", "path": []any{"video"}}, {"message": "second"}},
+		}
+	})
+
+	_, postError := PostGraphQL[testResponse](context.Background(), client, Request{OperationName: "Echo", Query: "query Echo { echo }"})
+	var graphQLErrors Errors
+	if !errors.As(postError, &graphQLErrors) {
+		t.Fatalf("PostGraphQL() error = %v, want GraphQL errors", postError)
+	}
+	if len(graphQLErrors) != 2 || graphQLErrors[0].Message != "service timeout" {
+		t.Errorf("errors = %+v, want the two errors of the response", graphQLErrors)
+	}
+	if message := postError.Error(); message != "graphql: service timeout (path [video]); second" {
+		t.Errorf("Error() = %q", message)
+	}
+}
+
+func TestPostGraphQLPersistedQuery(t *testing.T) {
+	known := map[string]bool{}
+	client, received := newGraphQLServer(t, func(body payload) any {
+		hash := body.Extensions.PersistedQuery.Sha256Hash
+		if body.Query == "" && !known[hash] {
+			return map[string]any{"errors": []map[string]any{{"message": "PersistedQueryNotFound"}}}
+		}
+		known[hash] = true
+		return map[string]any{"data": map[string]any{"echo": "ok"}}
+	})
+	request := Request{OperationName: "Echo", Query: "query Echo { echo }", PersistedQueryHash: "abc"}
+
+	for attempt, wantRequests := range []int{2, 3} {
+		response, postError := PostGraphQL[testResponse](context.Background(), client, request)
+		if postError != nil || response.Data.Echo != "ok" {
+			t.Fatalf("attempt %d: PostGraphQL() = %+v, %v", attempt, response, postError)
+		}
+		if len(*received) != wantRequests {
+			t.Errorf("attempt %d: %d requests sent, want %d", attempt, len(*received), wantRequests)
+		}
+	}
+	if (*received)[0].Query != "" || (*received)[1].Query == "" || (*received)[2].Query != "" {
+		t.Errorf("the query text must only be sent when the hash is unknown, received %+v", *received)
+	}
+}
@@ -0,0 +1,146 @@
+package internals
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	MaxThrottleRetries     = 3                // Nouvelles tentatives d'une requête refusée avec le code 429
+	defaultThrottleBackoff = 2 * time.Second  // Pause après un code 429 sans en-tête Retry-After, doublée à chaque tentative
+	maxThrottleBackoff     = 60 * time.Second // Pause maximale imposée par un code 429
+)
+
+// Limiteur à seau de jetons partagé par toutes les requêtes d'un même trafic (api GraphQL ou CDN),
+// un code 429 met en pause toutes ces requêtes
+type Limiter struct {
+	name        string
+	rate        float64 // Jetons ajoutés par seconde, sans limite lorsqu'il est nul
+	burst       float64 // Nombre maximal de jetons disponibles
+	mu          sync.Mutex
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	stats       LimiterStats
+}
+
+// Statistiques d'un limiteur depuis sa création
+type LimiterStats struct {
+	Name        string
+	Requests    uint64        // Requêtes autorisées
+	Delayed     uint64        // Requêtes ayant attendu un jeton ou la fin d'une pause
+	Waited      time.Duration // Temps total passé à attendre
+	Throttled   uint64        // Réponses 429 reçues
+	PausedUntil time.Time     // Fin de la dernière pause imposée par Twitch
+}
+
+func (s LimiterStats) String() string {
+	return fmt.Sprintf("%s: %d requests, %d delayed for %s, %d throttled", s.Name, s.Requests, s.Delayed, s.Waited.Round(time.Millisecond), s.Throttled)
+}
+
+// Crée un limiteur autorisant rate requêtes par seconde avec des rafales de burst requêtes,
+// un rate négatif ou nul ne limite que les pauses imposées par Twitch
+func NewLimiter(name string, rate float64, burst int) *Limiter {
+	if rate < 0 {
+		rate = 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		name:   name,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		stats:  LimiterStats{Name: name},
+	}
+}
+
+// Attend un jeton et la fin de la pause en cours, ou l'annulation du contexte
+func (l *Limiter) Wait(ctx context.Context) error {
+	start := time.Now()
+	delayed := false
+	for {
+		delay := l.reserve()
+		if delay == 0 {
+			break
+		}
+		delayed = true
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.Requests++
+	if delayed {
+		l.stats.Delayed++
+		l.stats.Waited += time.Since(start)
+	}
+	return nil
+}
+
+// Prend un jeton s'il est disponible, sinon renvoie le temps à attendre avant de réessayer
+func (l *Limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.rate == 0 {
+		return 0
+	}
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Met en pause toutes les requêtes du limiteur pendant delay, suite à un code 429
+func (l *Limiter) Throttle(delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(delay); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	// Les jetons accumulés ne doivent pas relancer une rafale à la fin de la pause
+	l.tokens = 0
+	l.stats.Throttled++
+	l.stats.PausedUntil = l.pausedUntil
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// Durée de la pause demandée par une réponse 429, en secondes ou en date HTTP dans l'en-tête Retry-After
+func throttleDelay(res *http.Response, attempt int) time.Duration {
+	delay := defaultThrottleBackoff << attempt
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, parseError := strconv.Atoi(retryAfter); parseError == nil && seconds >= 0 {
+			delay = time.Duration(seconds) * time.Second
+		} else if date, parseError := http.ParseTime(retryAfter); parseError == nil {
+			delay = time.Until(date)
+		}
+	}
+	return max(0, min(delay, maxThrottleBackoff))
+}
@@ -0,0 +1,74 @@
+package internals
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	limiter := NewLimiter("test", 50, 2)
+
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		if waitError := limiter.Wait(context.Background()); waitError != nil {
+			t.Fatal(waitError)
+		}
+	}
+	// Deux requêtes passent immédiatement, les cinq suivantes attendent chacune 20ms
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("7 requests took %s, want at least 100ms at 50 requests per second", elapsed)
+	}
+	if stats := limiter.Stats(); stats.Requests != 7 || stats.Delayed == 0 {
+		t.Errorf("stats = %+v, want 7 requests with some delayed", stats)
+	}
+}
+
+func TestLimiterThrottle(t *testing.T) {
+	limiter := NewLimiter("test", 0, 1)
+	limiter.Throttle(100 * time.Millisecond)
+
+	start := time.Now()
+	if waitError := limiter.Wait(context.Background()); waitError != nil {
+		t.Fatal(waitError)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Wait() returned after %s, want the pause of 100ms", elapsed)
+	}
+
+	limiter.Throttle(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if waitError := limiter.Wait(ctx); !errors.Is(waitError, context.DeadlineExceeded) {
+		t.Errorf("Wait() error = %v, want the context error", waitError)
+	}
+	if stats := limiter.Stats(); stats.Throttled != 2 {
+		t.Errorf("throttled %d times, want 2", stats.Throttled)
+	}
+}
+
+func TestThrottleDelay(t *testing.T) {
+	tests := []struct {
+		retryAfter string
+		attempt    int
+		want       time.Duration
+	}{
+		{retryAfter: "3", want: 3 * time.Second},
+		{retryAfter: "3600", want: maxThrottleBackoff},
+		{retryAfter: "", attempt: 0, want: defaultThrottleBackoff},
+		{retryAfter: "", attempt: 2, want: 4 * defaultThrottleBackoff},
+		{retryAfter: "invalid", want: defaultThrottleBackoff},
+		{retryAfter: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), want: 0},
+	}
+	for _, test := range tests {
+		res := &http.Response{Header: http.Header{}}
+		if test.retryAfter != "" {
+			res.Header.Set("Retry-After", test.retryAfter)
+		}
+		if delay := throttleDelay(res, test.attempt); delay != test.want {
+			t.Errorf("throttleDelay(%q, %d) = %s, want %s", test.retryAfter, test.attempt, delay, test.want)
+		}
+	}
+}
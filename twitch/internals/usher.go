@@ -1,15 +1,14 @@
 package internals
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 )
 
-const httpEndpoint = "https://usher.ttvnw.net/vod"
-
-func GetPlaylists(videoId string, accessToken string, signature string) (string, error) {
+func GetPlaylists(ctx context.Context, client *Client, videoId string, accessToken string, signature string) (string, error) {
 	params := url.Values{}
 	params.Add("nauth", accessToken)
 	params.Add("nauthsig", signature)
@@ -17,10 +16,15 @@ func GetPlaylists(videoId string, accessToken string, signature string) (string,
 	params.Add("allow_source", "true")
 	params.Add("player", "twitchweb")
 
-	res, responseError := http.Get(fmt.Sprintf("%s/%s?%s", httpEndpoint, videoId, params.Encode()))
+	req, requestError := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/vod/%s?%s", client.UsherBaseURL, videoId, params.Encode()), nil)
+	if requestError != nil {
+		return "", requestError
+	}
+	res, responseError := client.Do(req)
 	if responseError != nil {
 		return "", responseError
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("wrong status code %s", res.Status)
 	}
@@ -0,0 +1,135 @@
+package twitch
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	tsPacketSize = 188  // Taille d'un paquet MPEG-TS
+	tsSyncByte   = 0x47 // Premier octet de chaque paquet MPEG-TS
+	tsNullPid    = 0x1FFF
+)
+
+// Erreur renvoyée lorsqu'un morceau reste invalide après toutes ses tentatives de téléchargement
+var ErrCorruptChunk = errors.New("corrupt chunk")
+
+// Défaut trouvé dans le contenu d'un morceau
+type SegmentError struct {
+	Offset int64  // Position du défaut dans le morceau (en octets)
+	Reason string // Description du défaut
+}
+
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Reason, e.Offset)
+}
+
+// Erreur renvoyée lorsque le CDN répond à la requête d'un morceau par un autre code que 200
+type ChunkStatusError struct {
+	ChunkId    uint64
+	Uri        string
+	StatusCode int
+}
+
+func (e *ChunkStatusError) Error() string {
+	return fmt.Sprintf("chunk %d (%s) request failed with status code %d", e.ChunkId, e.Uri, e.StatusCode)
+}
+
+// Rapport d'un morceau resté invalide, il décrit le défaut de chaque tentative
+type CorruptChunkError struct {
+	ChunkId  uint64
+	Uri      string
+	Attempts []error // Erreur de chaque tentative, dans l'ordre
+}
+
+func (e *CorruptChunkError) Error() string {
+	reasons := make([]string, 0, len(e.Attempts))
+	for i, attempt := range e.Attempts {
+		reasons = append(reasons, fmt.Sprintf("attempt %d: %s", i+1, attempt))
+	}
+	return fmt.Sprintf("chunk %d (%s) is still corrupt after %d attempts: %s", e.ChunkId, e.Uri, len(e.Attempts), strings.Join(reasons, "; "))
+}
+
+func (e *CorruptChunkError) Is(target error) bool {
+	return target == ErrCorruptChunk
+}
+
+// Vérifie un morceau MPEG-TS au fil de son écriture : octet de synchronisation de chaque paquet,
+// alignement sur la taille des paquets et compteurs de continuité de chaque flux
+type segmentValidator struct {
+	written    int64         // Octets reçus
+	packet     []byte        // Paquet en cours de réception
+	continuity map[int]byte  // Dernier compteur de continuité de chaque flux
+	err        *SegmentError // Premier défaut trouvé
+}
+
+func newSegmentValidator() *segmentValidator {
+	return &segmentValidator{
+		packet:     make([]byte, 0, tsPacketSize),
+		continuity: make(map[int]byte),
+	}
+}
+
+// N'échoue jamais pour laisser l'écriture du morceau se terminer, le défaut est donné par check
+func (s *segmentValidator) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if s.err != nil {
+			break
+		}
+		s.packet = append(s.packet, b)
+		if len(s.packet) == tsPacketSize {
+			s.checkPacket(s.written + int64(i) + 1 - tsPacketSize)
+			s.packet = s.packet[:0]
+		}
+	}
+	s.written += int64(len(p))
+	return len(p), nil
+}
+
+func (s *segmentValidator) checkPacket(offset int64) {
+	if s.packet[0] != tsSyncByte {
+		s.err = &SegmentError{Offset: offset, Reason: fmt.Sprintf("sync byte 0x%02x instead of 0x%02x", s.packet[0], tsSyncByte)}
+		return
+	}
+	pid := int(s.packet[1]&0x1f)<<8 | int(s.packet[2])
+	if pid == tsNullPid {
+		return
+	}
+	adaptation := s.packet[3] & 0x20
+	payload := s.packet[3] & 0x10
+	counter := s.packet[3] & 0x0f
+
+	// Le drapeau de discontinuité autorise un nouveau compteur
+	if adaptation != 0 && s.packet[4] > 0 && s.packet[5]&0x80 != 0 {
+		delete(s.continuity, pid)
+	}
+	if payload == 0 {
+		return
+	}
+	last, found := s.continuity[pid]
+	// Un paquet peut être répété une fois avec le même compteur
+	if found && counter != (last+1)&0x0f && counter != last {
+		s.err = &SegmentError{Offset: offset, Reason: fmt.Sprintf("continuity counter %d of pid %d instead of %d", counter, pid, (last+1)&0x0f)}
+		return
+	}
+	s.continuity[pid] = counter
+}
+
+// Renvoie le premier défaut du morceau une fois qu'il a été entièrement reçu,
+// expectedLength est ignoré lorsqu'il est négatif
+func (s *segmentValidator) check(expectedLength int64) error {
+	if s.err != nil {
+		return s.err
+	}
+	if expectedLength >= 0 && s.written != expectedLength {
+		return &SegmentError{Offset: s.written, Reason: fmt.Sprintf("received %d bytes instead of the %d announced", s.written, expectedLength)}
+	}
+	if s.written == 0 {
+		return &SegmentError{Offset: 0, Reason: "empty segment"}
+	}
+	if len(s.packet) > 0 {
+		return &SegmentError{Offset: s.written - int64(len(s.packet)), Reason: fmt.Sprintf("incomplete packet of %d bytes", len(s.packet))}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package twitch
+
+import (
+	"errors"
+	"testing"
+)
+
+// Paquet MPEG-TS du flux pid avec le compteur de continuité donné
+func tsPacket(pid int, counter int, discontinuity bool) []byte {
+	packet := make([]byte, tsPacketSize)
+	packet[0] = tsSyncByte
+	packet[1] = byte(pid >> 8 & 0x1f)
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | byte(counter&0x0f)
+	if discontinuity {
+		packet[3] |= 0x20
+		packet[4] = 1
+		packet[5] = 0x80
+	}
+	return packet
+}
+
+func segment(packets ...[]byte) []byte {
+	data := make([]byte, 0, len(packets)*tsPacketSize)
+	for _, packet := range packets {
+		data = append(data, packet...)
+	}
+	return data
+}
+
+func TestSegmentValidator(t *testing.T) {
+	badSync := tsPacket(256, 1, false)
+	badSync[0] = 0x00
+	tests := []struct {
+		name       string
+		data       []byte
+		length     int64 // Taille annoncée, -1 lorsqu'elle est inconnue
+		wantOffset int64 // Position du défaut attendu, -1 lorsque le morceau est valide
+	}{
+		{name: "valid", data: segment(tsPacket(256, 14, false), tsPacket(256, 15, false), tsPacket(256, 0, false), tsPacket(257, 3, false)), length: -1, wantOffset: -1},
+		{name: "announced length", data: segment(tsPacket(256, 0, false)), length: tsPacketSize, wantOffset: -1},
+		{name: "duplicate packet", data: segment(tsPacket(256, 1, false), tsPacket(256, 1, false), tsPacket(256, 2, false)), length: -1, wantOffset: -1},
+		{name: "discontinuity", data: segment(tsPacket(256, 1, false), tsPacket(256, 9, true)), length: -1, wantOffset: -1},
+		{name: "null packets", data: segment(tsPacket(256, 1, false), tsPacket(tsNullPid, 7, false), tsPacket(256, 2, false)), length: -1, wantOffset: -1},
+		{name: "empty", data: nil, length: -1, wantOffset: 0},
+		{name: "bad sync byte", data: segment(tsPacket(256, 0, false), badSync), length: -1, wantOffset: tsPacketSize},
+		{name: "continuity gap", data: segment(tsPacket(256, 1, false), tsPacket(257, 5, false), tsPacket(256, 3, false)), length: -1, wantOffset: 2 * tsPacketSize},
+		{name: "incomplete packet", data: segment(tsPacket(256, 0, false), tsPacket(256, 1, false)[:100]), length: -1, wantOffset: tsPacketSize},
+		{name: "length mismatch", data: segment(tsPacket(256, 0, false)), length: 2 * tsPacketSize, wantOffset: tsPacketSize},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator := newSegmentValidator()
+			// Écriture en plusieurs fois pour couper les paquets
+			for start := 0; start < len(test.data); start += 100 {
+				validator.Write(test.data[start:min(start+100, len(test.data))])
+			}
+			checkError := validator.check(test.length)
+			if test.wantOffset < 0 {
+				if checkError != nil {
+					t.Errorf("check() = %v, want a valid segment", checkError)
+				}
+				return
+			}
+			var segmentError *SegmentError
+			if !errors.As(checkError, &segmentError) || segmentError.Offset != test.wantOffset {
+				t.Errorf("check() = %v, want a defect at offset %d", checkError, test.wantOffset)
+			}
+		})
+	}
+}
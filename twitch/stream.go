@@ -0,0 +1,96 @@
+package twitch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Nombre de morceaux téléchargés en avance par défaut en mode streaming
+const DefaultStreamWindow = 4
+
+// Télécharge la vidéo en écrivant ses morceaux dans w, dans l'ordre, au fur et à mesure de leur arrivée.
+// Jusqu'à window morceaux sont téléchargés en avance, ce sont les seuls présents sur le disque :
+// chaque morceau est supprimé dès qu'il a été écrit. Checksum est renseigné une fois la vidéo entièrement écrite.
+func (v *Video) Stream(w io.Writer, window int) error {
+	if window <= 0 {
+		window = DefaultStreamWindow
+	}
+	chunks, playlist, chunksError := v.downloadableChunks()
+	if chunksError != nil {
+		return chunksError
+	}
+
+	tmpPath, mkTmpDirError := v.makeWorkDir()
+	if mkTmpDirError != nil {
+		return mkTmpDirError
+	}
+	defer os.RemoveAll(tmpPath)
+	// Seuls les morceaux de la fenêtre et celui en cours d'écriture occupent le disque
+	if spaceError := checkSpace(v.EstimatedSize(playlist)/uint64(len(chunks))*uint64(window+1), tmpPath); spaceError != nil {
+		return spaceError
+	}
+	chunkPath := func(chunk Chunk) string {
+		return path.Join(tmpPath, strconv.FormatUint(chunk.Id, 10))
+	}
+
+	// Les téléchargements en cours s'arrêtent dès que l'écriture échoue
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(v.Context)
+	defer cancel()
+	fetcher := *v
+	fetcher.Context = ctx
+
+	results := make([]chan error, len(chunks))
+	for i := range results {
+		results[i] = make(chan error, 1)
+	}
+	slots := make(chan struct{}, window)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range chunks {
+			select {
+			case <-ctx.Done():
+				return
+			case slots <- struct{}{}:
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] <- fetcher.fetchChunk(chunks[i], chunkPath(chunks[i]))
+			}(i)
+		}
+	}()
+
+	hash := sha256.New()
+	output := io.MultiWriter(w, hash)
+	for i, chunk := range chunks {
+		select {
+		case <-ctx.Done():
+			return v.Context.Err()
+		case fetchError := <-results[i]:
+			if fetchError != nil {
+				return fetchError
+			}
+		}
+		if _, appendError := appendChunk(output, chunkPath(chunk)); appendError != nil {
+			return appendError
+		}
+		os.Remove(chunkPath(chunk))
+		<-slots
+		log.Debug().Msgf("(%d/%d) chunk %d streamed\t(%f%%)\n", i+1, len(chunks), chunk.Id, float32(i+1)/float32(len(chunks))*100)
+	}
+	v.Checksum = hex.EncodeToString(hash.Sum(nil))
+	log.Debug().Msgf("video %s streamed with checksum sha256:%s", v.Id, v.Checksum)
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package twitch_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+
+	"enssat.tv/autovodsaver/twitch/twitchtest"
+)
+
+func TestStream(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	segments := make([][]byte, 10)
+	for i := range segments {
+		segments[i] = twitchtest.TSSegment(i, 4)
+	}
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000", Segments: segments})
+
+	// Les morceaux arrivent dans le désordre avec plusieurs téléchargements en parallèle mais sont écrits dans l'ordre
+	output := &bytes.Buffer{}
+	if streamError := video.Stream(output, 3); streamError != nil {
+		t.Fatalf("Stream() error = %v", streamError)
+	}
+	content := output.Bytes()
+	if !bytes.Equal(content, bytes.Join(segments, nil)) {
+		t.Errorf("streamed %d bytes, want the %d bytes of the concatenated segments", len(content), len(bytes.Join(segments, nil)))
+	}
+	if checksum := sha256.Sum256(content); video.Checksum != hex.EncodeToString(checksum[:]) {
+		t.Errorf("Checksum = %q, want %x", video.Checksum, checksum)
+	}
+}
+
+func TestStreamChunkFailure(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+	server.Fail(twitchtest.SegmentPath("1000", 1), twitchtest.Failure{Status: http.StatusNotFound})
+
+	if streamError := video.Stream(&bytes.Buffer{}, 2); streamError == nil {
+		t.Error("Stream() with a missing chunk succeeded, want an error")
+	}
+	if video.Checksum != "" {
+		t.Errorf("Checksum = %q after a failed stream, want none", video.Checksum)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("upload failed")
+}
+
+func TestStreamWriteFailure(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+
+	// L'erreur de l'écriture est renvoyée telle quelle
+	if streamError := video.Stream(failingWriter{}, 2); streamError == nil || streamError.Error() != "upload failed" {
+		t.Errorf("Stream() error = %v, want the error of the writer", streamError)
+	}
+}
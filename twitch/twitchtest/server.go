@@ -0,0 +1,412 @@
+// Serveur imitant les services de Twitch (api GraphQL, usher, playlists et morceaux) pour les tests
+package twitchtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"enssat.tv/autovodsaver/twitch"
+)
+
+const (
+	GraphQLPath  = "/gql"
+	tsPacketSize = 188
+)
+
+// Vidéo servie par le faux serveur
+type Video struct {
+	Id             string
+	Title          string
+	Description    string
+	PublishedAt    time.Time
+	LengthSeconds  uint
+	Segments       [][]byte // Contenu des morceaux, trois morceaux TS lorsqu'il est vide
+	Live           bool     // La playlist n'est pas terminée, le live est toujours en cours
+	SubscriberOnly bool     // Seul le token OAuth de l'abonné donne accès à la playlist
+	// Qualités réservées aux abonnés ("chunked" ou "360p30"), les autres restent accessibles sans le token de l'abonné
+	RestrictedQualities []string
+	Owner               string // Chaîne ayant publié la vidéo, renseignée par AddVideo
+}
+
+// Échec renvoyé à la place de la réponse normale d'un chemin
+type Failure struct {
+	Status     int    // Code HTTP renvoyé, ignoré lorsque Truncate, Corrupt ou Stall est renseigné
+	RetryAfter string // Valeur de l'en-tête Retry-After
+	Truncate   bool   // La réponse normale est coupée au milieu de son corps
+	Corrupt    bool   // L'octet de synchronisation du deuxième paquet de la réponse normale est remplacé
+	// La réponse normale s'interrompt pendant cette durée au milieu de son corps, sauf si le client abandonne
+	Stall time.Duration
+	Times int // Nombre de requêtes en échec avant de répondre normalement, toutes lorsqu'il est nul
+}
+
+// Faux serveur Twitch
+type Server struct {
+	*httptest.Server
+	OAuthToken string // Token OAuth d'un abonné, il donne accès aux vidéos réservées aux abonnés
+	mu         *sync.Mutex
+	channels   map[string][]string // Identifiants des vidéos de chaque chaîne, de la plus récente à la plus ancienne
+	videos     map[string]*Video
+	failures   map[string]*Failure
+	requests   map[string]int
+	// Message d'erreur GraphQL renvoyé pour chaque opération en échec
+	operationErrors map[string]string
+}
+
+// Démarre un faux serveur, il doit être arrêté avec Close
+func NewServer() *Server {
+	s := &Server{
+		mu:       &sync.Mutex{},
+		channels: make(map[string][]string),
+		videos:   make(map[string]*Video),
+		failures: make(map[string]*Failure),
+		requests: make(map[string]int),
+
+		operationErrors: make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+GraphQLPath, s.handleGraphQL)
+	mux.HandleFunc("GET /vod/{video}", s.handleUsher)
+	mux.HandleFunc("GET /playlist/{video}/{quality}/index-dvr.m3u8", s.handleMediaPlaylist)
+	mux.HandleFunc("GET /playlist/{video}/{quality}/{segment}", s.handleSegment)
+	s.Server = httptest.NewServer(s.failing(mux))
+	return s
+}
+
+// Client Twitch dont toutes les requêtes sont envoyées au faux serveur
+func (s *Server) Client() *twitch.Client {
+	return twitch.NewClient(twitch.ClientOptions{
+		GraphQLBaseURL: s.URL,
+		UsherBaseURL:   s.URL,
+		HTTPClient:     s.Server.Client(),
+	})
+}
+
+// Chemin de la playlist principale d'une vidéo
+func UsherPath(videoId string) string {
+	return "/vod/" + videoId
+}
+
+// Chemin de la playlist de la meilleure qualité d'une vidéo
+func PlaylistPath(videoId string) string {
+	return "/playlist/" + videoId + "/chunked/index-dvr.m3u8"
+}
+
+// Chemin d'un morceau de la meilleure qualité d'une vidéo
+func SegmentPath(videoId string, index int) string {
+	return "/playlist/" + videoId + "/chunked/" + strconv.Itoa(index) + ".ts"
+}
+
+// Ajoute une vidéo en tête de la liste des vidéos de la chaîne
+func (s *Server) AddVideo(channel string, video Video) {
+	if video.Segments == nil {
+		video.Segments = [][]byte{TSSegment(0, 10), TSSegment(1, 10), TSSegment(2, 10)}
+	}
+	if video.PublishedAt.IsZero() {
+		video.PublishedAt = time.Now().Add(-time.Hour).Truncate(time.Second)
+	}
+	video.Owner = channel
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.videos[video.Id] = &video
+	s.channels[channel] = append([]string{video.Id}, s.channels[channel]...)
+}
+
+// Supprime une vidéo, comme lorsqu'elle expire sur Twitch
+func (s *Server) RemoveVideo(videoId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.videos, videoId)
+	for channel, ids := range s.channels {
+		s.channels[channel] = slices.DeleteFunc(ids, func(id string) bool {
+			return id == videoId
+		})
+	}
+}
+
+// Modifie une vidéo déjà servie
+func (s *Server) UpdateVideo(videoId string, update func(video *Video)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if video, found := s.videos[videoId]; found {
+		update(video)
+	}
+}
+
+// Fait échouer les prochaines requêtes vers le chemin
+func (s *Server) Fail(path string, failure Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = &failure
+}
+
+// Fait échouer les prochaines requêtes GraphQL de l'opération avec une erreur dans le tableau "errors"
+func (s *Server) FailOperation(operationName string, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.operationErrors[operationName] = message
+}
+
+// Nombre de requêtes reçues sur le chemin
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// Morceau MPEG-TS valide composé de paquets vides, le numéro permet de distinguer les morceaux
+func TSSegment(sequence int, packets int) []byte {
+	segment := make([]byte, 0, packets*tsPacketSize)
+	for i := 0; i < packets; i++ {
+		packet := make([]byte, tsPacketSize)
+		packet[0] = 0x47
+		packet[1] = 0x01
+		packet[2] = 0x00
+		packet[3] = 0x10 | byte(i&0x0f)
+		for j := 4; j < tsPacketSize; j++ {
+			packet[j] = byte(sequence)
+		}
+		segment = append(segment, packet...)
+	}
+	return segment
+}
+
+// Applique les échecs programmés avant de laisser le gestionnaire répondre
+func (s *Server) failing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		failure, found := s.failures[r.URL.Path]
+		if found && failure.Times > 0 {
+			failure.Times--
+			if failure.Times == 0 {
+				delete(s.failures, r.URL.Path)
+			}
+		}
+		s.mu.Unlock()
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if failure.Truncate || failure.Corrupt || failure.Stall > 0 {
+			recorder := httptest.NewRecorder()
+			next.ServeHTTP(recorder, r)
+			body := recorder.Body.Bytes()
+			for key, values := range recorder.Header() {
+				w.Header()[key] = values
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(recorder.Code)
+			if failure.Stall > 0 {
+				w.Write(body[:len(body)/2])
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(failure.Stall):
+				}
+				w.Write(body[len(body)/2:])
+				return
+			}
+			if failure.Truncate {
+				body = body[:len(body)/2]
+			} else if len(body) > tsPacketSize {
+				body[tsPacketSize] = 0x00
+			}
+			w.Write(body)
+			return
+		}
+		if failure.RetryAfter != "" {
+			w.Header().Set("Retry-After", failure.RetryAfter)
+		}
+		http.Error(w, http.StatusText(failure.Status), failure.Status)
+	})
+}
+
+func writeGraphQLErrors(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"errors": []map[string]any{{"message": message}}})
+}
+
+// Indique si la requête GraphQL est authentifiée par le token de l'abonné
+func (s *Server) subscriber(r *http.Request) bool {
+	return s.OAuthToken != "" && r.Header.Get("Authorization") == "OAuth "+s.OAuthToken
+}
+
+// Copie de la vidéo, pour la lire sans verrou
+func (s *Server) video(videoId string) (Video, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	video, found := s.videos[videoId]
+	if !found {
+		return Video{}, false
+	}
+	return *video, true
+}
+
+type videoNode struct {
+	Id            string    `json:"id"`
+	Title         string    `json:"title"`
+	Description   string    `json:"description"`
+	PublishedAt   time.Time `json:"publishedAt"`
+	BroadcastType string    `json:"broadcastType"`
+	LengthSeconds uint      `json:"lengthSeconds"`
+	Owner         ownerNode `json:"owner"`
+}
+
+type ownerNode struct {
+	Login string `json:"login"`
+}
+
+func newVideoNode(video *Video) *videoNode {
+	return &videoNode{
+		Id:            video.Id,
+		Title:         video.Title,
+		Description:   video.Description,
+		PublishedAt:   video.PublishedAt,
+		BroadcastType: "ARCHIVE",
+		LengthSeconds: video.LengthSeconds,
+		Owner:         ownerNode{Login: video.Owner},
+	}
+}
+
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		OperationName string         `json:"operationName"`
+		Query         string         `json:"query"`
+		Variables     map[string]any `json:"variables"`
+	}
+	if decodeError := json.NewDecoder(r.Body).Decode(&request); decodeError != nil {
+		http.Error(w, decodeError.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Client-Id") == "" {
+		http.Error(w, "missing Client-Id", http.StatusBadRequest)
+		return
+	}
+	variable := func(name string) string {
+		value, _ := request.Variables[name].(string)
+		return value
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if message, found := s.operationErrors[request.OperationName]; found {
+		writeGraphQLErrors(w, message)
+		return
+	}
+	if request.Query == "" {
+		// Aucune requête n'est persistée par le faux serveur
+		writeGraphQLErrors(w, "PersistedQueryNotFound")
+		return
+	}
+	var data any
+	switch request.OperationName {
+	case "PlaybackAccessToken":
+		videoId := variable("id")
+		restricted := make([]string, 0)
+		if video, found := s.videos[videoId]; found && !s.subscriber(r) {
+			if video.SubscriberOnly {
+				restricted = append(restricted, "archives")
+			}
+			restricted = append(restricted, video.RestrictedQualities...)
+		}
+		value, _ := json.Marshal(map[string]any{
+			"authorization": map[string]any{"forbidden": false, "reason": ""},
+			"chansub":       map[string]any{"restricted_bitrates": restricted},
+			"vod_id":        videoId,
+		})
+		data = map[string]any{"videoPlaybackAccessToken": map[string]string{
+			"value":     string(value),
+			"signature": "signature-" + videoId,
+		}}
+	case "ChannelVideos":
+		ids, found := s.channels[variable("login")]
+		if !found {
+			data = map[string]any{"user": nil}
+			break
+		}
+		edges := make([]map[string]any, 0)
+		first, _ := request.Variables["first"].(float64)
+		for _, id := range ids[:min(len(ids), int(first))] {
+			edges = append(edges, map[string]any{"node": newVideoNode(s.videos[id])})
+		}
+		data = map[string]any{"user": map[string]any{"videos": map[string]any{"edges": edges}}}
+	case "VideoMetadata":
+		video, found := s.videos[variable("id")]
+		if !found {
+			data = map[string]any{"video": nil}
+			break
+		}
+		data = map[string]any{"video": newVideoNode(video)}
+	default:
+		writeGraphQLErrors(w, fmt.Sprintf("unknown operation %q", request.OperationName))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func (s *Server) handleUsher(w http.ResponseWriter, r *http.Request) {
+	video, found := s.video(r.PathValue("video"))
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	var token struct {
+		Chansub struct {
+			RestrictedBitrates []string `json:"restricted_bitrates"`
+		} `json:"chansub"`
+	}
+	if unjsonError := json.Unmarshal([]byte(r.URL.Query().Get("nauth")), &token); unjsonError != nil || r.URL.Query().Get("nauthsig") == "" || (video.SubscriberOnly && len(token.Chansub.RestrictedBitrates) > 0) {
+		http.Error(w, `[{"error":"Forbidden","error_code":"vod_manifest_restricted"}]`, http.StatusForbidden)
+		return
+	}
+
+	playlist := bytes.Buffer{}
+	playlist.WriteString("#EXTM3U\n")
+	playlist.WriteString(`#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=640x360,VIDEO="360p30",FRAME-RATE=30.000` + "\n")
+	playlist.WriteString(s.URL + "/playlist/" + video.Id + "/360p30/index-dvr.m3u8\n")
+	playlist.WriteString(`#EXT-X-STREAM-INF:BANDWIDTH=8000000,RESOLUTION=1920x1080,VIDEO="chunked",FRAME-RATE=60.000` + "\n")
+	playlist.WriteString(s.URL + PlaylistPath(video.Id) + "\n")
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write(playlist.Bytes())
+}
+
+func (s *Server) handleMediaPlaylist(w http.ResponseWriter, r *http.Request) {
+	video, found := s.video(r.PathValue("video"))
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	playlist := bytes.Buffer{}
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n")
+	for i := range video.Segments {
+		fmt.Fprintf(&playlist, "#EXTINF:10.000,\n%d.ts\n", i)
+	}
+	if !video.Live {
+		playlist.WriteString("#EXT-X-ENDLIST\n")
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write(playlist.Bytes())
+}
+
+func (s *Server) handleSegment(w http.ResponseWriter, r *http.Request) {
+	video, found := s.video(r.PathValue("video"))
+	index, parseError := strconv.Atoi(strings.TrimSuffix(r.PathValue("segment"), ".ts"))
+	if !found || parseError != nil || index < 0 || index >= len(video.Segments) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(video.Segments[index])
+}
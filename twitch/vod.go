@@ -3,15 +3,23 @@ package twitch
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"enssat.tv/autovodsaver/metrics"
 	"enssat.tv/autovodsaver/twitch/internals"
 	"github.com/grafov/m3u8"
 	"github.com/rs/zerolog/log"
@@ -23,14 +31,40 @@ const (
 	videoPlaybackAccessToken ContextKey = iota
 )
 
+var (
+	// Erreur renvoyée lorsque la vidéo appartient à un live toujours en cours
+	ErrVideoInProgress = errors.New("video is still being recorded")
+	// Erreur renvoyée lorsque Twitch ne connaît pas la vidéo, comme une vidéo supprimée ou expirée
+	ErrVideoNotFound = errors.New("video not found on twitch")
+	// Erreur renvoyée lorsque Twitch ne connaît pas la chaîne, comme une chaîne renommée
+	ErrChannelNotFound = errors.New("channel not found on twitch")
+	// Erreur renvoyée lorsque le token d'accès ne permet pas de regarder la vidéo, comme pour les vidéos réservées aux abonnés
+	ErrVideoRestricted = errors.New("video is restricted to subscribers")
+)
+
+const (
+	// Nombre de vidéos récupérées lors de la requête des vidéos d'une chaîne
+	VideosPageSize = 10
+	// Nombre de téléchargements d'un morceau avant d'abandonner la vidéo
+	maxChunkAttempts = 3
+)
+
 // Représente une VOD Twitch
 type Video struct {
 	Context       context.Context
-	Id            string    `json:"id"`            // Identifiant de la vidéo
-	Title         string    `json:"title"`         // Nom de la vidéo
-	Description   string    `json:"description"`   // Description de la vidéo
-	PublishedAt   time.Time `json:"publishedAt"`   // Date de publication
-	LengthSeconds uint      `json:"lengthSeconds"` // Longueur de la vidéo (en secondes)
+	Client        *Client    `json:"-"`             // Client utilisé pour télécharger la vidéo, DefaultClient lorsqu'il est nul
+	Id            string     `json:"id"`            // Identifiant de la vidéo
+	Title         string     `json:"title"`         // Nom de la vidéo
+	Description   string     `json:"description"`   // Description de la vidéo
+	PublishedAt   time.Time  `json:"publishedAt"`   // Date de publication
+	LengthSeconds uint       `json:"lengthSeconds"` // Longueur de la vidéo (en secondes)
+	Owner         VideoOwner `json:"owner"`         // Chaîne ayant publié la vidéo, renseignée par les requêtes GraphQL
+	Checksum      string     `json:"-"`             // Empreinte SHA-256 en hexadécimal du fichier de la vidéo, renseignée par Download
+}
+
+// Représente la chaîne ayant publié une vidéo
+type VideoOwner struct {
+	Login string `json:"login"` // Nom de la chaîne
 }
 
 // Représente un token permettant d'accéder à la vidéo depuis le CDN de Twitch
@@ -39,12 +73,46 @@ type VideoPlaybackAccessToken struct {
 	Signature string `json:"signature"` // Signature du token
 }
 
+// Représente les droits décrits par la valeur d'un token d'accès
+type playbackTokenValue struct {
+	Authorization struct {
+		Forbidden bool   `json:"forbidden"` // Est-ce que l'accès à la vidéo est refusé
+		Reason    string `json:"reason"`    // Raison du refus
+	} `json:"authorization"`
+	Chansub struct {
+		RestrictedBitrates []string `json:"restricted_bitrates"` // Qualités réservées aux abonnés
+	} `json:"chansub"`
+}
+
+// Qualité restreinte par Twitch lorsque toute la vidéo est réservée aux abonnés
+const restrictedArchives = "archives"
+
+// Indique si le token ne permet de regarder aucune qualité de la vidéo
+func (t VideoPlaybackAccessToken) Restricted() bool {
+	var value playbackTokenValue
+	if unjsonError := json.Unmarshal([]byte(t.Value), &value); unjsonError != nil {
+		return false
+	}
+	return value.Authorization.Forbidden || slices.Contains(value.Chansub.RestrictedBitrates, restrictedArchives)
+}
+
+// Qualités de la vidéo réservées aux abonnés, nommées comme les variantes de la playlist principale
+func (t VideoPlaybackAccessToken) RestrictedQualities() []string {
+	var value playbackTokenValue
+	if unjsonError := json.Unmarshal([]byte(t.Value), &value); unjsonError != nil {
+		return nil
+	}
+	return value.Chansub.RestrictedBitrates
+}
+
 // Représente une playlist M3U8
 type PlaylistInfo struct {
 	Url        string  // Lien vers la playlist
 	Resolution string  // Résolution des médias dans la playlist
 	Framerate  float64 // Fréquences d'images des médias dans la playlist
 	Chunked    bool    // Est-ce que la playlist contient plusieurs médias
+	Ended      bool    // Est-ce que la playlist est terminée (EXT-X-ENDLIST), faux tant que le live est en cours
+	Bandwidth  uint32  // Débit maximal annoncé des médias (en bits par seconde)
 }
 
 // Représente un morceau de média dans une playlist M3U8
@@ -59,20 +127,20 @@ type Chunk struct {
 // Représente une réponse de l'api GraphQL de Twitch lors de la requête d'information sur une vidéo
 type videoResponse struct {
 	Data struct {
-		Video Video `json:"video"`
+		Video *Video `json:"video"` // Nul lorsque la vidéo n'existe pas
 	} `json:"data"`
 }
 
 // Représente une réponse de l'api GraphQL de Twitch lors de la requête d'information sur une liste de vidéos d'une chaîne
 type userVideosResponse struct {
 	Data struct {
-		User struct {
+		User *struct {
 			Videos struct {
 				Edges []struct {
 					Node Video `json:"node"`
 				} `json:"edges"`
 			} `json:"videos"`
-		} `json:"user"`
+		} `json:"user"` // Nul lorsque la chaîne n'existe pas
 	} `json:"data"`
 }
 
@@ -83,78 +151,95 @@ type tokenPlaybackResponse struct {
 	} `json:"data"`
 }
 
+// Champs des vidéos demandés à l'api GraphQL
+const videoFields = `
+	id
+	title
+	description
+	publishedAt
+	broadcastType
+	lengthSeconds
+	owner {
+		login
+	}
+`
+
 // Requête GraphQL pour récupéré les informations d'une vidéo à partir de son identifiant
-func getVideoQuery(videoId string) string {
-	return `{
-		video(id: "` + videoId + `") {
-			id
-			title
-			description
-			publishedAt
-			broadcastType
-			lengthSeconds
-		}
-	}`
+func getVideoQuery(videoId string) internals.Request {
+	return internals.Request{
+		OperationName: "VideoMetadata",
+		Query: `query VideoMetadata($id: ID!) {
+			video(id: $id) {` + videoFields + `}
+		}`,
+		Variables: map[string]any{"id": videoId},
+	}
 }
 
 // Requête GraphQL pour récupéré le token d'accès à une vidéo à partir de son identifiant
-func getPlaybackTokenQuery(videoId string) string {
-	return `{
-		videoPlaybackAccessToken(
-			id: "` + videoId + `",
-            params: {
-                platform: "web",
-                playerBackend: "mediaplayer",
-                playerType: "site"
-            }
-		) {
-            value
-			signature
-        }
-	}`
+func getPlaybackTokenQuery(videoId string) internals.Request {
+	return internals.Request{
+		OperationName: "PlaybackAccessToken",
+		Query: `query PlaybackAccessToken($id: ID!) {
+			videoPlaybackAccessToken(
+				id: $id,
+				params: {
+					platform: "web",
+					playerBackend: "mediaplayer",
+					playerType: "site"
+				}
+			) {
+				value
+				signature
+			}
+		}`,
+		Variables: map[string]any{"id": videoId},
+	}
 }
 
 // Requête GraphQL pour récupéré la liste des vidéos disponibles pour une chaîne donnée
-func getVideosByChannel(channelName string) string {
-	return `{
-		user(login: "` + channelName + `") {
-			videos(first: 10, type: ARCHIVE) {
-				edges {
-					node {
-						id
-						title
-						description
-						publishedAt
-						broadcastType
-						lengthSeconds
+func getVideosByChannel(channelName string) internals.Request {
+	return internals.Request{
+		OperationName: "ChannelVideos",
+		Query: `query ChannelVideos($login: String!, $first: Int!) {
+			user(login: $login) {
+				videos(first: $first, type: ARCHIVE) {
+					edges {
+						node {` + videoFields + `}
 					}
 				}
 			}
-		}
-	}`
+		}`,
+		Variables: map[string]any{"login": channelName, "first": VideosPageSize},
+	}
 }
 
-// Récupère la playlist M3U8 ayant la meilleur qualité
-func parseM3U8(content string) *PlaylistInfo {
+// Récupère la playlist M3U8 ayant la meilleur qualité parmi celles qui ne sont pas restreintes,
+// ErrVideoRestricted lorsque toutes les qualités le sont
+func parseM3U8(content string, restricted []string) (*PlaylistInfo, error) {
 	buffer := bytes.NewBufferString(content)
 	playlist, playlistType, err := m3u8.Decode(*buffer, true)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid master playlist: %w", err)
 	}
 	if playlistType != m3u8.MASTER {
-		return nil
+		return nil, fmt.Errorf("playlist is not a master playlist")
 	}
 	p := playlist.(*m3u8.MasterPlaylist)
 	// Extract the highest resolution master
 	var master PlaylistInfo
 	maxRes := 0
+	restrictedVariants := 0
 	for _, v := range p.Variants {
 		if len(v.Resolution) == 0 {
 			continue
 		}
-		dim := strings.Split(v.Resolution, "x")
-		width, _ := strconv.Atoi(dim[0])
-		height, _ := strconv.Atoi(dim[1])
+		if slices.Contains(restricted, v.Video) {
+			restrictedVariants++
+			continue
+		}
+		widthText, heightText, _ := strings.Cut(v.Resolution, "x")
+		width, _ := strconv.Atoi(widthText)
+		height, _ := strconv.Atoi(heightText)
 		res := width * height
 		if res > maxRes {
 			master = PlaylistInfo{
@@ -162,6 +247,7 @@ func parseM3U8(content string) *PlaylistInfo {
 				Resolution: v.Resolution,
 				Framerate:  v.FrameRate,
 				Chunked:    false,
+				Bandwidth:  v.Bandwidth,
 			}
 			if v.Video == "chunked" {
 				master.Chunked = true
@@ -169,146 +255,198 @@ func parseM3U8(content string) *PlaylistInfo {
 			maxRes = res
 		}
 	}
-	return &master
+	if maxRes == 0 && restrictedVariants > 0 {
+		return nil, ErrVideoRestricted
+	}
+	if maxRes == 0 {
+		return nil, fmt.Errorf("no video variant found in the master playlist")
+	}
+	return &master, nil
+}
+
+// Client utilisé pour les requêtes de la vidéo
+func (v *Video) client() *Client {
+	if v.Client == nil {
+		return DefaultClient
+	}
+	return v.Client
 }
 
 // Récupère le token d'accès de la vidéo
-func (v *Video) getPlaybackToken() VideoPlaybackAccessToken {
-	tokens, err := internals.PostGraphQL[tokenPlaybackResponse](getPlaybackTokenQuery(v.Id))
+func (v *Video) getPlaybackToken() (VideoPlaybackAccessToken, error) {
+	tokens, err := internals.PostGraphQL[tokenPlaybackResponse](v.Context, v.client().api, getPlaybackTokenQuery(v.Id))
 	if err != nil {
-		panic(err)
+		return VideoPlaybackAccessToken{}, err
+	}
+	return tokens.Data.VideoPlaybackAccessToken, nil
+}
+
+// Récupère le token d'accès de la vidéo une seule fois, il est conservé dans le contexte de la vidéo
+func (v *Video) playbackToken() (VideoPlaybackAccessToken, error) {
+	if value := v.Context.Value(videoPlaybackAccessToken); value != nil {
+		return value.(VideoPlaybackAccessToken), nil
 	}
-	return tokens.Data.VideoPlaybackAccessToken
+	token, tokenError := v.getPlaybackToken()
+	if tokenError != nil {
+		return token, tokenError
+	}
+	v.Context = context.WithValue(v.Context, videoPlaybackAccessToken, token)
+	return token, nil
 }
 
-// Récupère les informations de la vidéo à partir de son identifiant
-func GetVideo(videoId string) Video {
+// Récupère les informations de la vidéo à partir de son identifiant, ErrVideoNotFound lorsqu'elle n'existe pas
+func GetVideo(videoId string) (Video, error) {
 	return GetVideoWithContext(context.Background(), videoId)
 }
 
 // Récupère les informations de la vidéo à partir de son identifiant, avec un contexte
-func GetVideoWithContext(ctx context.Context, videoId string) Video {
-	video, err := internals.PostGraphQL[videoResponse](getVideoQuery(videoId))
-	if err != nil {
-		panic(err)
-	}
-	video.Data.Video.Context = ctx
-	return video.Data.Video
+func GetVideoWithContext(ctx context.Context, videoId string) (Video, error) {
+	return DefaultClient.GetVideo(ctx, videoId)
 }
 
-// Récupère les informations des vidéos d'une chaîne
-func GetVideos(channelName string) []Video {
+// Récupère les informations des vidéos d'une chaîne, ErrChannelNotFound lorsqu'elle n'existe pas
+func GetVideos(channelName string) ([]Video, error) {
 	return GetVideosWithContext(context.Background(), channelName)
 }
 
 // Récupère les informations des vidéos d'une chaîne, avec un contexte
-func GetVideosWithContext(ctx context.Context, channelName string) []Video {
-	data, err := internals.PostGraphQL[userVideosResponse](getVideosByChannel(channelName))
-	if err != nil {
-		panic(err)
-	}
-	videos := make([]Video, 0)
-	for _, edge := range data.Data.User.Videos.Edges {
-		edge.Node.Context = ctx
-		videos = append(videos, edge.Node)
-	}
-	return videos
+func GetVideosWithContext(ctx context.Context, channelName string) ([]Video, error) {
+	return DefaultClient.GetVideos(ctx, channelName)
 }
 
 // Récupère la playlist de la vidéo
-func (v *Video) GetPlaylist() *PlaylistInfo {
-	value := v.Context.Value(videoPlaybackAccessToken)
-	if value == nil {
-		v.Context = context.WithValue(v.Context, videoPlaybackAccessToken, v.getPlaybackToken())
-		return v.GetPlaylist()
-	}
-	tokens := value.(VideoPlaybackAccessToken)
-	playlist, getPlayListError := internals.GetPlaylists(v.Id, tokens.Value, tokens.Signature)
+func (v *Video) GetPlaylist() (*PlaylistInfo, error) {
+	tokens, tokenError := v.playbackToken()
+	if tokenError != nil {
+		return nil, tokenError
+	}
+	playlist, getPlayListError := internals.GetPlaylists(v.Context, v.client().api, v.Id, tokens.Value, tokens.Signature)
 	if getPlayListError != nil {
-		return nil
+		return nil, getPlayListError
 	}
-	return parseM3U8(playlist)
+	return parseM3U8(playlist, tokens.RestrictedQualities())
 }
 
 // Récupère les médias de la vidéo à partir d'une playlist
-func (v *Video) GetChunks(playlist *PlaylistInfo) []Chunk {
-	res, httpGetError := http.Get(playlist.Url)
+func (v *Video) GetChunks(playlist *PlaylistInfo) ([]Chunk, error) {
+	req, requestError := http.NewRequestWithContext(v.Context, http.MethodGet, playlist.Url, nil)
+	if requestError != nil {
+		return nil, requestError
+	}
+	res, httpGetError := v.client().do(req)
 	if httpGetError != nil {
-		panic(httpGetError)
+		return nil, httpGetError
 	}
 
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("playlist %s request failed with status code %d", playlist.Url, res.StatusCode)
+	}
 	data, readAllError := io.ReadAll(res.Body)
 	if readAllError != nil {
-		panic(readAllError)
+		return nil, readAllError
 	}
 
 	untypedMedia, playlistType, decodeError := m3u8.Decode(*bytes.NewBuffer(data), true)
 	if decodeError != nil {
-		panic(decodeError)
+		return nil, fmt.Errorf("invalid media playlist: %w", decodeError)
 	}
 	if playlistType != m3u8.MEDIA {
-		return make([]Chunk, 0)
+		return nil, fmt.Errorf("playlist %s is not a media playlist", playlist.Url)
 	}
 
-	baseUrl := fmt.Sprintf("https://%s", path.Dir(strings.Replace(playlist.Url, "https://", "", 1)))
+	// Les URI des morceaux sont relatives à la playlist
+	baseUrl, parseError := url.Parse(playlist.Url)
+	if parseError != nil {
+		return nil, parseError
+	}
 	medias := untypedMedia.(*m3u8.MediaPlaylist)
+	playlist.Ended = medias.Closed
 	chunks := make([]Chunk, 0)
 	for _, s := range medias.GetAllSegments() {
 		chunks = append(chunks, Chunk{
 			Id:         s.SeqId,
-			Uri:        fmt.Sprintf("%s/%s", baseUrl, s.URI),
+			Uri:        resolveReference(baseUrl, s.URI),
 			Duration:   s.Duration,
 			Downloaded: false,
 		})
 	}
 
-	return chunks
+	return chunks, nil
 }
 
-func (v *Video) Download(outputPath string) error {
+// Vérifie que la vidéo peut être téléchargée et renvoie ses morceaux dans l'ordre avec leur playlist
+func (v *Video) downloadableChunks() ([]Chunk, *PlaylistInfo, error) {
+	// Subscriber-only videos need the token of a subscriber
+	token, tokenError := v.playbackToken()
+	if contextError := v.Context.Err(); contextError != nil {
+		return nil, nil, contextError
+	}
+	if tokenError != nil {
+		return nil, nil, tokenError
+	}
+	if token.Restricted() {
+		return nil, nil, ErrVideoRestricted
+	}
+
 	// Get all chunks download URI
-	playlist := v.GetPlaylist()
-	if playlist == nil {
-		return fmt.Errorf("video could not be retrieved (the vod is behind a paywall or an internal error occured)")
+	playlist, playlistError := v.GetPlaylist()
+	if contextError := v.Context.Err(); contextError != nil {
+		return nil, nil, contextError
+	}
+	if playlistError != nil {
+		return nil, nil, fmt.Errorf("video could not be retrieved (the vod is behind a paywall or an internal error occured): %w", playlistError)
 	}
 	log.Debug().Msgf("found playlist: %s (resolution=%s;framerate=%f)\n", playlist.Url, playlist.Resolution, playlist.Framerate)
-	chunks := v.GetChunks(playlist)
+	chunks, chunksError := v.GetChunks(playlist)
+	if contextError := v.Context.Err(); contextError != nil {
+		return nil, nil, contextError
+	}
+	if chunksError != nil {
+		return nil, nil, chunksError
+	}
 	if len(chunks) == 0 {
-		return fmt.Errorf("no chunk found in the playlist")
+		return nil, nil, fmt.Errorf("no chunk found in the playlist")
 	}
 	log.Debug().Msgf("found %d chunks\n", len(chunks))
+	if !playlist.Ended {
+		// The stream is still live, the playlist will keep growing until it ends
+		return nil, nil, ErrVideoInProgress
+	}
+	if !isSorted(&chunks) {
+		return nil, nil, fmt.Errorf("chunks are not in the right order")
+	}
+	return chunks, playlist, nil
+}
+
+func (v *Video) Download(outputPath string) error {
+	chunks, playlist, chunksError := v.downloadableChunks()
+	if chunksError != nil {
+		return chunksError
+	}
 
 	// Create temporary directory to store all chunks
-	tmpPath, mkTmpDirError := os.MkdirTemp(os.TempDir(), fmt.Sprintf("%s_*", v.Id))
+	tmpPath, mkTmpDirError := v.makeWorkDir()
 	if mkTmpDirError != nil {
 		return mkTmpDirError
 	}
-	log.Debug().Msgf("temporary folder created: %s\n", tmpPath)
-	defer os.Remove(tmpPath)
+	defer os.RemoveAll(tmpPath)
+	// Chunks are removed once concatenated, so each filesystem holds at most about one copy of the video
+	if spaceError := checkSpace(v.EstimatedSize(playlist), tmpPath, filepath.Dir(outputPath)); spaceError != nil {
+		return spaceError
+	}
 
 	// Download all chunks and store them in the temporary directory
 	// We don't use a (for range) because it yield a copy of chunk struct
 	// As we made modification to chunks, we use a classic for loop over our array
 	for i := 0; i < len(chunks); i++ {
-		chunkFilePath := path.Join(tmpPath, strconv.Itoa(int(chunks[i].Id)))
-		chunkFile, openChunkError := os.OpenFile(chunkFilePath, os.O_CREATE|os.O_WRONLY, 0660)
-		if openChunkError != nil {
-			return openChunkError
-		}
-		defer chunkFile.Close()
-
-		response, getChunkError := http.Get(chunks[i].Uri)
-		if getChunkError != nil {
-			return getChunkError
-		}
-		defer response.Body.Close()
-
-		bytesWritten, copyError := io.Copy(chunkFile, response.Body)
-		if copyError != nil {
-			return copyError
+		// Stop as soon as the download is cancelled
+		if contextError := v.Context.Err(); contextError != nil {
+			return contextError
 		}
-		if bytesWritten == 0 {
-			log.Warn().Msgf("[WARN] No bytes written for chunk %d", chunks[i].Id)
+		chunkFilePath := path.Join(tmpPath, strconv.Itoa(int(chunks[i].Id)))
+		if fetchError := v.fetchChunk(chunks[i], chunkFilePath); fetchError != nil {
+			return fetchError
 		}
 		chunks[i].Downloaded = true
 		chunks[i].Path = chunkFilePath
@@ -316,35 +454,168 @@ func (v *Video) Download(outputPath string) error {
 	}
 
 	// Concatenate all chunks together in a single file
-	if !isSorted(&chunks) {
-		return fmt.Errorf("chunks are not in the right order")
+	for _, chunk := range chunks {
+		if !chunk.Downloaded {
+			return fmt.Errorf("chunk %d has not been downloaded", chunk.Id)
+		}
 	}
-	outputFile, outputFileError := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY, 0660)
-	if outputFileError != nil {
-		return outputFileError
+	// The checksum follows the video up to the storage
+	checksum, concatenateError := concatenateChunks(chunks, outputPath)
+	if concatenateError != nil {
+		return concatenateError
 	}
-	defer outputFile.Close()
-	for i, chunk := range chunks {
-		chunkFilePath := chunk.Path
-		chunkFile, openChunkError := os.OpenFile(chunkFilePath, os.O_RDONLY, 0660)
-		if openChunkError != nil {
-			return openChunkError
+	v.Checksum = checksum
+	log.Debug().Msgf("video %s downloaded with checksum sha256:%s", v.Id, v.Checksum)
+
+	return nil
+}
+
+// Concatène les morceaux dans un fichier temporaire à côté de outputPath puis le renomme, un fichier existant
+// n'est donc remplacé que par une vidéo complète. Chaque morceau est supprimé une fois écrit.
+// Renvoie l'empreinte SHA-256 de la vidéo en hexadécimal.
+func concatenateChunks(chunks []Chunk, outputPath string) (checksum string, err error) {
+	outputFile, createError := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".*.part")
+	if createError != nil {
+		return "", createError
+	}
+	defer func() {
+		outputFile.Close()
+		if err != nil {
+			os.Remove(outputFile.Name())
 		}
-		defer chunkFile.Close()
+	}()
+	if chmodError := outputFile.Chmod(0660); chmodError != nil {
+		return "", chmodError
+	}
 
-		bytesWritten, copyError := io.Copy(outputFile, chunkFile)
-		if copyError != nil {
-			return copyError
+	hash := sha256.New()
+	output := io.MultiWriter(outputFile, hash)
+	for i, chunk := range chunks {
+		bytesWritten, appendError := appendChunk(output, chunk.Path)
+		if appendError != nil {
+			return "", appendError
 		}
 		if bytesWritten == 0 {
 			log.Warn().Msgf("[WARN] No bytes written for chunk %d in output file", chunk.Id)
 		}
-		log.Debug().Msgf("(%d/%d) chunk %d concatenated\t(%f%%)\n", i+1, len(chunks), chunks[i].Id, float32(i+1)/float32(len(chunks))*100)
+		os.Remove(chunk.Path)
+		log.Debug().Msgf("(%d/%d) chunk %d concatenated\t(%f%%)\n", i+1, len(chunks), chunk.Id, float32(i+1)/float32(len(chunks))*100)
+	}
+	if closeError := outputFile.Close(); closeError != nil {
+		return "", closeError
+	}
+	if renameError := os.Rename(outputFile.Name(), outputPath); renameError != nil {
+		return "", renameError
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Écrit le contenu du fichier d'un morceau dans w, le fichier est fermé avant de passer au morceau suivant
+func appendChunk(w io.Writer, chunkFilePath string) (int64, error) {
+	chunkFile, openChunkError := os.Open(chunkFilePath)
+	if openChunkError != nil {
+		return 0, openChunkError
+	}
+	defer chunkFile.Close()
+	return io.Copy(w, chunkFile)
+}
+
+// Télécharge un morceau dans chunkFilePath, un morceau corrompu ou dont le transfert échoue est téléchargé à nouveau
+// et la vidéo échoue lorsqu'il le reste
+func (v *Video) fetchChunk(chunk Chunk, chunkFilePath string) error {
+	attempts := make([]error, 0, maxChunkAttempts)
+	for len(attempts) < maxChunkAttempts {
+		downloadError := v.downloadChunk(chunk, chunkFilePath)
+		if downloadError == nil {
+			return nil
+		}
+		if contextError := v.Context.Err(); contextError != nil {
+			return contextError
+		}
+		// Le CDN refuse le morceau, le télécharger à nouveau ne changerait rien
+		var statusError *ChunkStatusError
+		if errors.As(downloadError, &statusError) && statusError.StatusCode < http.StatusInternalServerError {
+			return downloadError
+		}
+		attempts = append(attempts, downloadError)
+		// Seul un contenu refusé par la validation rend le morceau corrompu, une coupure du transfert ne dit rien de son contenu
+		var segmentError *SegmentError
+		switch {
+		case errors.As(downloadError, &segmentError):
+			metrics.CorruptChunks.Inc()
+			log.Warn().Msgf("chunk %d of video %s is corrupt (attempt %d/%d): %s", chunk.Id, v.Id, len(attempts), maxChunkAttempts, downloadError.Error())
+		case errors.As(downloadError, &statusError):
+			metrics.ChunkErrors.Inc("status")
+			log.Warn().Msgf("chunk %d of video %s could not be downloaded (attempt %d/%d): %s", chunk.Id, v.Id, len(attempts), maxChunkAttempts, downloadError.Error())
+		default:
+			metrics.ChunkErrors.Inc("transport")
+			log.Warn().Msgf("chunk %d of video %s could not be downloaded (attempt %d/%d): %s", chunk.Id, v.Id, len(attempts), maxChunkAttempts, downloadError.Error())
+		}
 	}
+	var segmentError *SegmentError
+	if !errors.As(attempts[len(attempts)-1], &segmentError) {
+		return fmt.Errorf("chunk %d (%s) could not be downloaded after %d attempts: %w", chunk.Id, chunk.Uri, len(attempts), attempts[len(attempts)-1])
+	}
+	return &CorruptChunkError{ChunkId: chunk.Id, Uri: chunk.Uri, Attempts: attempts}
+}
 
+// Télécharge un morceau dans un fichier temporaire en vérifiant son contenu, puis le renomme en chunkFilePath :
+// le fichier d'un morceau n'existe que lorsqu'il est complet et valide
+func (v *Video) downloadChunk(chunk Chunk, chunkFilePath string) (err error) {
+	partPath := chunkFilePath + ".part"
+	chunkFile, openChunkError := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0660)
+	if openChunkError != nil {
+		return openChunkError
+	}
+	defer func() {
+		chunkFile.Close()
+		if err != nil {
+			os.Remove(partPath)
+		}
+	}()
+
+	chunkStart := time.Now()
+	request, requestError := http.NewRequestWithContext(v.Context, http.MethodGet, chunk.Uri, nil)
+	if requestError != nil {
+		return requestError
+	}
+	response, getChunkError := v.client().do(request)
+	if getChunkError != nil {
+		return getChunkError
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return &ChunkStatusError{ChunkId: chunk.Id, Uri: chunk.Uri, StatusCode: response.StatusCode}
+	}
+
+	validator := newSegmentValidator()
+	bytesWritten, copyError := io.Copy(io.MultiWriter(chunkFile, validator), v.client().bandwidth.Reader(v.Context, response.Body))
+	if copyError != nil {
+		return copyError
+	}
+	if validationError := validator.check(response.ContentLength); validationError != nil {
+		return validationError
+	}
+	if closeError := chunkFile.Close(); closeError != nil {
+		return closeError
+	}
+	if renameError := os.Rename(partPath, chunkFilePath); renameError != nil {
+		return renameError
+	}
+	metrics.ChunkLatency.Observe(time.Since(chunkStart).Seconds())
+	metrics.ChunksDownloaded.Inc()
+	metrics.BytesDownloaded.Add(float64(bytesWritten))
 	return nil
 }
 
+func resolveReference(base *url.URL, reference string) string {
+	referenceUrl, parseError := url.Parse(reference)
+	if parseError != nil {
+		return reference
+	}
+	return base.ResolveReference(referenceUrl).String()
+}
+
 func isSorted(chunks *[]Chunk) bool {
 	for i := 1; i < len(*chunks); i++ {
 		if (*chunks)[i].Id != (*chunks)[i-1].Id+1 {
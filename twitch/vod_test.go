@@ -0,0 +1,444 @@
+package twitch_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/bandwidth"
+	"enssat.tv/autovodsaver/metrics"
+	"enssat.tv/autovodsaver/twitch"
+	"enssat.tv/autovodsaver/twitch/twitchtest"
+)
+
+func newFakeVideo(t *testing.T, server *twitchtest.Server, video twitchtest.Video) twitch.Video {
+	t.Helper()
+	server.AddVideo("channel", video)
+	return getVideo(t, server.Client(), video.Id)
+}
+
+func getVideo(t *testing.T, client *twitch.Client, videoId string) twitch.Video {
+	t.Helper()
+	fetched, getVideoError := client.GetVideo(context.Background(), videoId)
+	if getVideoError != nil || fetched.Id != videoId {
+		t.Fatalf("GetVideo(%q) = %q, %v", videoId, fetched.Id, getVideoError)
+	}
+	return fetched
+}
+
+func TestDownload(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	segments := [][]byte{twitchtest.TSSegment(0, 4), twitchtest.TSSegment(1, 4), twitchtest.TSSegment(2, 4)}
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000", Title: "vod", Segments: segments})
+
+	output := filepath.Join(t.TempDir(), "1000.mp4")
+	if downloadError := video.Download(output); downloadError != nil {
+		t.Fatalf("Download() error = %v", downloadError)
+	}
+
+	content, readError := os.ReadFile(output)
+	if readError != nil {
+		t.Fatal(readError)
+	}
+	if !bytes.Equal(content, bytes.Join(segments, nil)) {
+		t.Errorf("downloaded %d bytes, want the %d bytes of the concatenated segments", len(content), len(bytes.Join(segments, nil)))
+	}
+	if checksum := sha256.Sum256(content); video.Checksum != hex.EncodeToString(checksum[:]) {
+		t.Errorf("Checksum = %q, want %x", video.Checksum, checksum)
+	}
+	if requests := server.Requests(twitchtest.PlaylistPath("1000")); requests != 1 {
+		t.Errorf("best quality playlist requested %d times, want 1", requests)
+	}
+}
+
+func TestDownloadLiveVideo(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000", Live: true})
+
+	downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4"))
+	if !errors.Is(downloadError, twitch.ErrVideoInProgress) {
+		t.Errorf("Download() error = %v, want %v", downloadError, twitch.ErrVideoInProgress)
+	}
+	if requests := server.Requests(twitchtest.SegmentPath("1000", 0)); requests != 0 {
+		t.Errorf("segments of a live video requested %d times, want 0", requests)
+	}
+}
+
+func TestDownloadFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		video   twitchtest.Video
+		path    string
+		failure twitchtest.Failure
+	}{
+		{name: "playlist not found", video: twitchtest.Video{Id: "1000"}, path: twitchtest.UsherPath("1000"), failure: twitchtest.Failure{Status: http.StatusNotFound}},
+		{name: "playlist always rate limited", video: twitchtest.Video{Id: "1000"}, path: twitchtest.UsherPath("1000"), failure: twitchtest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "0"}},
+		{name: "media playlist server error", video: twitchtest.Video{Id: "1000"}, path: twitchtest.PlaylistPath("1000"), failure: twitchtest.Failure{Status: http.StatusInternalServerError}},
+		{name: "truncated segment", video: twitchtest.Video{Id: "1000"}, path: twitchtest.SegmentPath("1000", 1), failure: twitchtest.Failure{Truncate: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := twitchtest.NewServer()
+			defer server.Close()
+			video := newFakeVideo(t, server, test.video)
+			if test.path != "" {
+				server.Fail(test.path, test.failure)
+			}
+
+			if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError == nil {
+				t.Error("Download() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestDownloadCorruptChunk(t *testing.T) {
+	for _, times := range []int{1, 0} {
+		server := twitchtest.NewServer()
+		defer server.Close()
+		video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+		server.Fail(twitchtest.SegmentPath("1000", 1), twitchtest.Failure{Corrupt: true, Times: times})
+
+		downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4"))
+		if times == 1 {
+			// Le morceau corrompu une seule fois est téléchargé à nouveau
+			if downloadError != nil {
+				t.Errorf("Download() error = %v, want the corrupt chunk to be downloaded again", downloadError)
+			}
+			if requests := server.Requests(twitchtest.SegmentPath("1000", 1)); requests != 2 {
+				t.Errorf("corrupt chunk requested %d times, want 2", requests)
+			}
+			continue
+		}
+		var corruptError *twitch.CorruptChunkError
+		if !errors.Is(downloadError, twitch.ErrCorruptChunk) || !errors.As(downloadError, &corruptError) {
+			t.Fatalf("Download() error = %v, want %v", downloadError, twitch.ErrCorruptChunk)
+		}
+		if corruptError.ChunkId != 1 || len(corruptError.Attempts) != 3 {
+			t.Errorf("report = %v, want 3 attempts of chunk 1", corruptError)
+		}
+	}
+}
+
+// Valeur d'une série de compteur, nulle tant qu'elle n'existe pas
+func counterValue(t *testing.T, counter *metrics.CounterVec, series string) float64 {
+	t.Helper()
+	exposition := bytes.Buffer{}
+	if writeError := counter.Write(&exposition); writeError != nil {
+		t.Fatal(writeError)
+	}
+	for _, line := range strings.Split(exposition.String(), "\n") {
+		if value, found := strings.CutPrefix(line, series+" "); found {
+			parsed, parseError := strconv.ParseFloat(value, 64)
+			if parseError != nil {
+				t.Fatal(parseError)
+			}
+			return parsed
+		}
+	}
+	return 0
+}
+
+func TestDownloadChunkErrorMetrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		failure   twitchtest.Failure
+		corrupt   float64
+		transport float64
+		status    float64
+	}{
+		{name: "corrupt", failure: twitchtest.Failure{Corrupt: true, Times: 1}, corrupt: 1},
+		{name: "truncated", failure: twitchtest.Failure{Truncate: true, Times: 1}, transport: 1},
+		{name: "server error", failure: twitchtest.Failure{Status: http.StatusBadGateway, Times: 1}, status: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := twitchtest.NewServer()
+			defer server.Close()
+			video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+			server.Fail(twitchtest.SegmentPath("1000", 1), test.failure)
+
+			corrupt := counterValue(t, metrics.CorruptChunks, "autovodsaver_corrupt_chunks_total")
+			transport := counterValue(t, metrics.ChunkErrors, `autovodsaver_chunk_errors_total{type="transport"}`)
+			status := counterValue(t, metrics.ChunkErrors, `autovodsaver_chunk_errors_total{type="status"}`)
+			if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError != nil {
+				t.Fatalf("Download() error = %v, want the chunk to be downloaded again", downloadError)
+			}
+			// Seuls les morceaux refusés par la validation sont comptés comme corrompus
+			if delta := counterValue(t, metrics.CorruptChunks, "autovodsaver_corrupt_chunks_total") - corrupt; delta != test.corrupt {
+				t.Errorf("corrupt chunks counter moved by %v, want %v", delta, test.corrupt)
+			}
+			if delta := counterValue(t, metrics.ChunkErrors, `autovodsaver_chunk_errors_total{type="transport"}`) - transport; delta != test.transport {
+				t.Errorf("transport errors counter moved by %v, want %v", delta, test.transport)
+			}
+			if delta := counterValue(t, metrics.ChunkErrors, `autovodsaver_chunk_errors_total{type="status"}`) - status; delta != test.status {
+				t.Errorf("status errors counter moved by %v, want %v", delta, test.status)
+			}
+		})
+	}
+
+	// Un transfert qui échoue à chaque tentative n'est pas rapporté comme un morceau corrompu
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+	server.Fail(twitchtest.SegmentPath("1000", 1), twitchtest.Failure{Truncate: true})
+	if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError == nil || errors.Is(downloadError, twitch.ErrCorruptChunk) {
+		t.Errorf("Download() of an always truncated chunk error = %v, want a transfer error", downloadError)
+	}
+}
+
+func TestDownloadRateLimited(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+	server.Fail(twitchtest.UsherPath("1000"), twitchtest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "1", Times: 1})
+	server.Fail(twitchtest.SegmentPath("1000", 1), twitchtest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "0", Times: 1})
+
+	start := time.Now()
+	if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError != nil {
+		t.Fatalf("Download() error = %v, want the throttled requests to be retried", downloadError)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Download() took %s, want the Retry-After of 1s to be honoured", elapsed)
+	}
+	for _, path := range []string{twitchtest.UsherPath("1000"), twitchtest.SegmentPath("1000", 1)} {
+		if requests := server.Requests(path); requests != 2 {
+			t.Errorf("%s requested %d times, want 2", path, requests)
+		}
+	}
+	for _, stats := range video.Client.LimiterStats() {
+		if stats.Name == "media" && stats.Throttled != 2 {
+			t.Errorf("media limiter throttled %d times, want 2", stats.Throttled)
+		}
+	}
+}
+
+func TestDownloadBandwidth(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "1000", Segments: [][]byte{twitchtest.TSSegment(0, 100), twitchtest.TSSegment(1, 100), twitchtest.TSSegment(2, 100)}})
+	client := twitch.NewClient(twitch.ClientOptions{
+		GraphQLBaseURL: server.URL,
+		UsherBaseURL:   server.URL,
+		HTTPClient:     server.Server.Client(),
+		Bandwidth:      bandwidth.NewLimits(bandwidth.Schedule{Rate: 100 << 10}, bandwidth.Schedule{}),
+	})
+	video := getVideo(t, client, "1000")
+
+	start := time.Now()
+	if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError != nil {
+		t.Fatal(downloadError)
+	}
+	// Trois morceaux de 100 paquets de 188 octets
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("55K downloaded in %s, want at least 550ms at 100K/s", elapsed)
+	}
+}
+
+func TestDownloadBandwidthWithTimeout(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	// Un morceau de 376 Ko met près de deux secondes à arriver sous le plafond, bien plus que le délai
+	server.AddVideo("channel", twitchtest.Video{Id: "1000", Segments: [][]byte{twitchtest.TSSegment(0, 2000)}})
+	client := twitch.NewClient(twitch.ClientOptions{
+		GraphQLBaseURL: server.URL,
+		UsherBaseURL:   server.URL,
+		HTTPClient:     server.Server.Client(),
+		Timeout:        time.Second,
+		Bandwidth:      bandwidth.NewLimits(bandwidth.Schedule{}, bandwidth.Schedule{Rate: 200 << 10}),
+	})
+	video := getVideo(t, client, "1000")
+
+	start := time.Now()
+	if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError != nil {
+		t.Fatalf("Download() under a bandwidth cap error = %v, want the chunk downloaded", downloadError)
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("376K downloaded in %s, want at least 1.5s at 200K/s", elapsed)
+	}
+}
+
+func TestDownloadStalledChunk(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "1000"})
+	client := twitch.NewClient(twitch.ClientOptions{
+		GraphQLBaseURL: server.URL,
+		UsherBaseURL:   server.URL,
+		HTTPClient:     server.Server.Client(),
+		Timeout:        200 * time.Millisecond,
+	})
+	video := getVideo(t, client, "1000")
+	server.Fail(twitchtest.SegmentPath("1000", 1), twitchtest.Failure{Stall: time.Minute})
+
+	// Le morceau s'interrompt au milieu de son corps, la lecture est abandonnée après le délai
+	start := time.Now()
+	downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4"))
+	if downloadError == nil || !strings.Contains(downloadError.Error(), "twitch sent nothing for 200ms") {
+		t.Errorf("Download() of a stalled chunk error = %v, want a timeout", downloadError)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Download() gave up after %s, want a few timeouts", elapsed)
+	}
+}
+
+func TestDownloadSubscriberOnly(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.OAuthToken = "subscriber-token"
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000", SubscriberOnly: true})
+
+	downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4"))
+	if !errors.Is(downloadError, twitch.ErrVideoRestricted) {
+		t.Errorf("anonymous Download() error = %v, want %v", downloadError, twitch.ErrVideoRestricted)
+	}
+	if requests := server.Requests(twitchtest.UsherPath("1000")); requests != 0 {
+		t.Errorf("playlist of a restricted video requested %d times, want 0", requests)
+	}
+
+	for token, wantError := range map[string]error{"other-token": twitch.ErrVideoRestricted, "subscriber-token": nil} {
+		authenticated := getVideo(t, server.Client().WithOAuthToken(token), "1000")
+		downloadError := authenticated.Download(filepath.Join(t.TempDir(), "1000.mp4"))
+		if !errors.Is(downloadError, wantError) {
+			t.Errorf("Download() with token %s error = %v, want %v", token, downloadError, wantError)
+		}
+	}
+}
+
+func TestDownloadRestrictedQualities(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.OAuthToken = "subscriber-token"
+	server.AddVideo("channel", twitchtest.Video{Id: "1000", RestrictedQualities: []string{"chunked"}})
+	server.AddVideo("channel", twitchtest.Video{Id: "2000", RestrictedQualities: []string{"chunked", "360p30"}})
+	lowQuality := "/playlist/1000/360p30/index-dvr.m3u8"
+
+	// Seule la meilleure qualité est réservée aux abonnés, la suivante est téléchargée
+	video := getVideo(t, server.Client(), "1000")
+	if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError != nil {
+		t.Fatalf("Download() with the best quality restricted error = %v", downloadError)
+	}
+	if best, low := server.Requests(twitchtest.PlaylistPath("1000")), server.Requests(lowQuality); best != 0 || low != 1 {
+		t.Errorf("playlists requested %d times for the restricted quality and %d times for the other one, want 0 and 1", best, low)
+	}
+
+	// L'abonné télécharge la meilleure qualité
+	subscribed := getVideo(t, server.Client().WithOAuthToken("subscriber-token"), "1000")
+	if downloadError := subscribed.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError != nil {
+		t.Fatalf("Download() with the subscriber token error = %v", downloadError)
+	}
+	if best := server.Requests(twitchtest.PlaylistPath("1000")); best != 1 {
+		t.Errorf("playlist of the best quality requested %d times by the subscriber, want 1", best)
+	}
+
+	// Toutes les qualités sont réservées aux abonnés
+	restricted := getVideo(t, server.Client(), "2000")
+	if downloadError := restricted.Download(filepath.Join(t.TempDir(), "2000.mp4")); !errors.Is(downloadError, twitch.ErrVideoRestricted) {
+		t.Errorf("Download() with every quality restricted error = %v, want %v", downloadError, twitch.ErrVideoRestricted)
+	}
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	video.Context = ctx
+	if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError == nil {
+		t.Error("Download() of a cancelled video succeeded, want an error")
+	}
+}
+
+func TestGetVideos(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	for _, id := range []string{"1", "2", "3"} {
+		server.AddVideo("channel", twitchtest.Video{Id: id, Title: "vod " + id, LengthSeconds: 60})
+	}
+	server.AddVideo("other", twitchtest.Video{Id: "4"})
+
+	videos, getVideosError := server.Client().GetVideos(context.Background(), "channel")
+	if getVideosError != nil || len(videos) != 3 {
+		t.Fatalf("GetVideos() = %d videos, %v, want 3 videos", len(videos), getVideosError)
+	}
+	for i, id := range []string{"3", "2", "1"} {
+		if videos[i].Id != id || videos[i].Title != "vod "+id || videos[i].LengthSeconds != 60 {
+			t.Errorf("GetVideos()[%d] = %+v, want video %s", i, videos[i], id)
+		}
+	}
+	if unknown, getVideosError := server.Client().GetVideos(context.Background(), "unknown"); !errors.Is(getVideosError, twitch.ErrChannelNotFound) || len(unknown) != 0 {
+		t.Errorf("GetVideos() of an unknown channel = %d videos, %v, want %v", len(unknown), getVideosError, twitch.ErrChannelNotFound)
+	}
+}
+
+func TestGetVideosEscapesChannel(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	channel := `mistermv") { videos { edges { node { id } } } } #`
+	server.AddVideo(channel, twitchtest.Video{Id: "1"})
+
+	if videos, getVideosError := server.Client().GetVideos(context.Background(), channel); len(videos) != 1 {
+		t.Errorf("GetVideos(%q) = %d videos, %v, want 1 video", channel, len(videos), getVideosError)
+	}
+}
+
+func TestGetVideoGraphQLError(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	video := newFakeVideo(t, server, twitchtest.Video{Id: "1000"})
+	server.FailOperation("PlaybackAccessToken", "service unavailable")
+
+	downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4"))
+	if downloadError == nil || !strings.Contains(downloadError.Error(), "service unavailable") {
+		t.Errorf("Download() error = %v, want the GraphQL error", downloadError)
+	}
+}
+
+func TestGetVideosGraphQLError(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("mistermv", twitchtest.Video{Id: "1"})
+	server.FailOperation("ChannelVideos", "service unavailable")
+
+	// L'erreur est renvoyée à l'appelant au lieu d'arrêter le processus
+	videos, getVideosError := server.Client().GetVideos(context.Background(), "mistermv")
+	if getVideosError == nil || !strings.Contains(getVideosError.Error(), "service unavailable") || len(videos) != 0 {
+		t.Errorf("GetVideos() = %d videos, %v, want the GraphQL error", len(videos), getVideosError)
+	}
+}
+
+func TestGetVideosRateLimited(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("mistermv", twitchtest.Video{Id: "1"})
+	server.Fail("/gql", twitchtest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "0", Times: 2})
+
+	if videos, getVideosError := server.Client().GetVideos(context.Background(), "mistermv"); len(videos) != 1 {
+		t.Errorf("GetVideos() = %d videos, %v, want 1 video", len(videos), getVideosError)
+	}
+	if requests := server.Requests("/gql"); requests != 3 {
+		t.Errorf("/gql requested %d times, want 3", requests)
+	}
+}
+
+func TestGetVideoNotFound(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+
+	if video, getVideoError := server.Client().GetVideo(context.Background(), "404"); !errors.Is(getVideoError, twitch.ErrVideoNotFound) || video.Id != "" {
+		t.Errorf("GetVideo() of an unknown video = %q, %v, want %v", video.Id, getVideoError, twitch.ErrVideoNotFound)
+	}
+}
@@ -0,0 +1,84 @@
+package twitch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"enssat.tv/autovodsaver/diskspace"
+	"github.com/rs/zerolog/log"
+)
+
+// Préfixe des dossiers temporaires des téléchargements, il permet de les reconnaître dans le dossier de travail
+const WorkDirPrefix = "autovodsaver-"
+
+// Dossier dans lequel les morceaux des vidéos sont téléchargés, le dossier temporaire du système par défaut
+func (c *Client) WorkDir() string {
+	if c.workDir == "" {
+		return os.TempDir()
+	}
+	return c.workDir
+}
+
+// Crée le dossier temporaire du téléchargement de la vidéo dans le dossier de travail du client
+func (v *Video) makeWorkDir() (string, error) {
+	workDir := v.client().WorkDir()
+	if mkdirError := os.MkdirAll(workDir, 0770); mkdirError != nil {
+		return "", mkdirError
+	}
+	tmpPath, mkTmpDirError := os.MkdirTemp(workDir, fmt.Sprintf("%s%s_*", WorkDirPrefix, v.Id))
+	if mkTmpDirError != nil {
+		return "", mkTmpDirError
+	}
+	log.Debug().Msgf("temporary folder created: %s\n", tmpPath)
+	return tmpPath, nil
+}
+
+// Taille estimée de la vidéo (en octets) à partir du débit de la playlist et de la durée de la vidéo,
+// nulle lorsque la playlist n'annonce pas de débit
+func (v *Video) EstimatedSize(playlist *PlaylistInfo) uint64 {
+	return uint64(playlist.Bandwidth) / 8 * uint64(v.LengthSeconds)
+}
+
+// Vérifie que chaque dossier dispose de l'espace nécessaire, la vérification est ignorée lorsque la taille est inconnue
+func checkSpace(required uint64, paths ...string) error {
+	if required == 0 {
+		return nil
+	}
+	for _, path := range paths {
+		if checkError := diskspace.Check(path, required); checkError != nil {
+			return checkError
+		}
+	}
+	return nil
+}
+
+// Supprime les dossiers temporaires de téléchargement laissés dans le dossier de travail et modifiés avant la date donnée,
+// comme ceux d'un processus arrêté brutalement. Renvoie les chemins supprimés.
+func CleanWorkDir(workDir string, before time.Time) ([]string, error) {
+	entries, readDirError := os.ReadDir(workDir)
+	if os.IsNotExist(readDirError) {
+		return nil, nil
+	}
+	if readDirError != nil {
+		return nil, readDirError
+	}
+	removed := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), WorkDirPrefix) {
+			continue
+		}
+		info, infoError := entry.Info()
+		if infoError != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		stalePath := filepath.Join(workDir, entry.Name())
+		if removeError := os.RemoveAll(stalePath); removeError != nil {
+			return removed, removeError
+		}
+		removed = append(removed, stalePath)
+	}
+	return removed, nil
+}
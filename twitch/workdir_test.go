@@ -0,0 +1,114 @@
+package twitch_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/diskspace"
+	"enssat.tv/autovodsaver/twitch"
+	"enssat.tv/autovodsaver/twitch/twitchtest"
+)
+
+func newWorkDirClient(server *twitchtest.Server, workDir string) *twitch.Client {
+	return twitch.NewClient(twitch.ClientOptions{
+		GraphQLBaseURL: server.URL,
+		UsherBaseURL:   server.URL,
+		HTTPClient:     server.Server.Client(),
+		WorkDir:        workDir,
+	})
+}
+
+func TestDownloadWorkDir(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "1000", LengthSeconds: 30})
+	workDir := filepath.Join(t.TempDir(), "work")
+	video := getVideo(t, newWorkDirClient(server, workDir), "1000")
+
+	if downloadError := video.Download(filepath.Join(t.TempDir(), "1000.mp4")); downloadError != nil {
+		t.Fatalf("Download() error = %v", downloadError)
+	}
+	// Les morceaux et leur dossier temporaire sont supprimés après le téléchargement
+	entries, readDirError := os.ReadDir(workDir)
+	if readDirError != nil {
+		t.Fatal(readDirError)
+	}
+	if len(entries) != 0 {
+		t.Errorf("work directory holds %d entries after the download, want 0", len(entries))
+	}
+}
+
+func TestDownloadInsufficientSpace(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	// 8 Mbit/s pendant plusieurs siècles ne tiennent sur aucun disque
+	server.AddVideo("channel", twitchtest.Video{Id: "1000", LengthSeconds: 1 << 40})
+	video := getVideo(t, newWorkDirClient(server, t.TempDir()), "1000")
+
+	for name, download := range map[string]func() error{
+		"Download": func() error { return video.Download(filepath.Join(t.TempDir(), "1000.mp4")) },
+		"Stream":   func() error { return video.Stream(&discard{}, 2) },
+	} {
+		downloadError := download()
+		var spaceError *diskspace.InsufficientSpaceError
+		if !errors.Is(downloadError, diskspace.ErrInsufficientSpace) || !errors.As(downloadError, &spaceError) {
+			t.Errorf("%s() error = %v, want %v", name, downloadError, diskspace.ErrInsufficientSpace)
+			continue
+		}
+		if spaceError.Required <= spaceError.Available {
+			t.Errorf("%s() report = %v, want more space required than available", name, spaceError)
+		}
+	}
+	if requests := server.Requests(twitchtest.SegmentPath("1000", 0)); requests != 0 {
+		t.Errorf("segments requested %d times without space to store them, want 0", requests)
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestCleanWorkDir(t *testing.T) {
+	workDir := t.TempDir()
+	stale := filepath.Join(workDir, twitch.WorkDirPrefix+"1000_123")
+	recent := filepath.Join(workDir, twitch.WorkDirPrefix+"2000_456")
+	other := filepath.Join(workDir, "other")
+	for _, dir := range []string{stale, recent, other} {
+		if mkdirError := os.MkdirAll(filepath.Join(dir, "chunks"), 0770); mkdirError != nil {
+			t.Fatal(mkdirError)
+		}
+	}
+	startup := time.Now()
+	old := startup.Add(-time.Hour)
+	for _, dir := range []string{stale, other} {
+		if chtimesError := os.Chtimes(dir, old, old); chtimesError != nil {
+			t.Fatal(chtimesError)
+		}
+	}
+	if chtimesError := os.Chtimes(recent, startup.Add(time.Minute), startup.Add(time.Minute)); chtimesError != nil {
+		t.Fatal(chtimesError)
+	}
+
+	removed, cleanError := twitch.CleanWorkDir(workDir, startup)
+	if cleanError != nil {
+		t.Fatalf("CleanWorkDir() error = %v", cleanError)
+	}
+	if len(removed) != 1 || removed[0] != stale {
+		t.Errorf("CleanWorkDir() removed %v, want only %s", removed, stale)
+	}
+	// Les dossiers récents et ceux qui ne sont pas des téléchargements sont conservés
+	for dir, kept := range map[string]bool{stale: false, recent: true, other: true} {
+		if _, statError := os.Stat(dir); (statError == nil) != kept {
+			t.Errorf("%s kept = %v, want %v", dir, statError == nil, kept)
+		}
+	}
+
+	if removed, cleanError := twitch.CleanWorkDir(filepath.Join(workDir, "missing"), startup); cleanError != nil || len(removed) != 0 {
+		t.Errorf("CleanWorkDir() of a missing directory = %v, %v, want nothing removed", removed, cleanError)
+	}
+}
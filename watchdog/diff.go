@@ -0,0 +1,79 @@
+package watchdog
+
+import (
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/twitch"
+)
+
+type videosDiff struct {
+	Added       []twitch.Video
+	Changed     []constants.VideoWatched // Known videos whose metadata changed, carrying the new metadata
+	Grown       map[string]bool          // Changed videos whose length grew, like the ones of an ongoing stream
+	Stable      []constants.VideoWatched // Known videos whose metadata did not change since the last poll
+	Disappeared []constants.VideoWatched // Known videos no longer listed by Twitch although they fall inside the listed window
+	Unlisted    []constants.VideoWatched // Known videos older than the listed window, they may still exist on Twitch
+}
+
+// Compare the videos listed by Twitch with the ones already known
+func diffVideos(listed []twitch.Video, known []constants.VideoWatched) videosDiff {
+	diff := videosDiff{
+		Added:       make([]twitch.Video, 0),
+		Changed:     make([]constants.VideoWatched, 0),
+		Grown:       make(map[string]bool),
+		Stable:      make([]constants.VideoWatched, 0),
+		Disappeared: make([]constants.VideoWatched, 0),
+		Unlisted:    make([]constants.VideoWatched, 0),
+	}
+
+	knownById := make(map[string]constants.VideoWatched, len(known))
+	for _, video := range known {
+		knownById[video.Id] = video
+	}
+	listedById := make(map[string]bool, len(listed))
+	for _, video := range listed {
+		listedById[video.Id] = true
+		previous, found := knownById[video.Id]
+		if !found {
+			diff.Added = append(diff.Added, video)
+			continue
+		}
+		if previous.Title != video.Title || previous.Description != video.Description || previous.LengthSeconds != video.LengthSeconds {
+			diff.Changed = append(diff.Changed, constants.VideoWatched{
+				Video:     video,
+				ChannelId: previous.ChannelId,
+				Status:    previous.Status,
+			})
+			if video.LengthSeconds > previous.LengthSeconds {
+				diff.Grown[video.Id] = true
+			}
+			continue
+		}
+		diff.Stable = append(diff.Stable, previous)
+	}
+
+	// Twitch only lists its latest videos, so older ones are only considered gone when they fall inside the listed window.
+	// An empty listing tells nothing about the known videos.
+	var windowStart time.Time
+	if len(listed) >= twitch.VideosPageSize {
+		windowStart = listed[0].PublishedAt
+		for _, video := range listed {
+			if video.PublishedAt.Before(windowStart) {
+				windowStart = video.PublishedAt
+			}
+		}
+	}
+	for _, video := range known {
+		if listedById[video.Id] {
+			continue
+		}
+		if len(listed) == 0 || video.PublishedAt.Before(windowStart) {
+			diff.Unlisted = append(diff.Unlisted, video)
+			continue
+		}
+		diff.Disappeared = append(diff.Disappeared, video)
+	}
+
+	return diff
+}
@@ -0,0 +1,82 @@
+package watchdog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/twitch"
+)
+
+func TestDiffVideos(t *testing.T) {
+	published := time.Date(2024, time.March, 1, 20, 0, 0, 0, time.UTC)
+	video := func(id string, title string, length uint) twitch.Video {
+		return twitch.Video{Id: id, Title: title, LengthSeconds: length, PublishedAt: published}
+	}
+	known := []constants.VideoWatched{
+		{Video: video("stable", "stable", 60), ChannelId: "channel", Status: constants.VideoStatusArchived},
+		{Video: video("renamed", "before", 60), ChannelId: "channel", Status: constants.VideoStatusQueued},
+		{Video: video("growing", "live", 60), ChannelId: "channel", Status: constants.VideoStatusRecording},
+		{Video: video("gone", "gone", 60), ChannelId: "channel", Status: constants.VideoStatusQueued},
+	}
+	listed := []twitch.Video{video("new", "new", 60), video("stable", "stable", 60), video("renamed", "after", 60), video("growing", "live", 120)}
+
+	diff := diffVideos(listed, known)
+	if len(diff.Added) != 1 || diff.Added[0].Id != "new" {
+		t.Errorf("Added = %v, want video new", diff.Added)
+	}
+	if len(diff.Stable) != 1 || diff.Stable[0].Id != "stable" {
+		t.Errorf("Stable = %v, want video stable", diff.Stable)
+	}
+	if len(diff.Disappeared) != 1 || diff.Disappeared[0].Id != "gone" {
+		t.Errorf("Disappeared = %v, want video gone", diff.Disappeared)
+	}
+	if len(diff.Changed) != 2 {
+		t.Fatalf("Changed = %v, want videos renamed and growing", diff.Changed)
+	}
+	for _, changed := range diff.Changed {
+		// Changed videos carry the new metadata with the channel and status already known
+		if changed.ChannelId != "channel" {
+			t.Errorf("channel of changed video %s = %q, want %q", changed.Id, changed.ChannelId, "channel")
+		}
+		previous := known[1]
+		if changed.Id == "growing" {
+			previous = known[2]
+		}
+		if changed.Status != previous.Status {
+			t.Errorf("status of changed video %s = %s, want %s", changed.Id, changed.Status, previous.Status)
+		}
+	}
+	if diff.Changed[0].Title != "after" {
+		t.Errorf("title of changed video renamed = %q, want %q", diff.Changed[0].Title, "after")
+	}
+	if !diff.Grown["growing"] || diff.Grown["renamed"] {
+		t.Errorf("Grown = %v, want only video growing", diff.Grown)
+	}
+}
+
+func TestDiffVideosListedWindow(t *testing.T) {
+	start := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	listed := make([]twitch.Video, 0)
+	for i := 0; i < twitch.VideosPageSize; i++ {
+		listed = append(listed, twitch.Video{Id: fmt.Sprintf("listed%d", i), PublishedAt: start.Add(time.Duration(i) * time.Hour)})
+	}
+	known := []constants.VideoWatched{
+		{Video: twitch.Video{Id: "older", PublishedAt: start.Add(-time.Hour)}, ChannelId: "channel"},
+		{Video: twitch.Video{Id: "inside", PublishedAt: start.Add(90 * time.Minute)}, ChannelId: "channel"},
+	}
+
+	// Videos older than a full page may still exist on Twitch
+	diff := diffVideos(listed, known)
+	if len(diff.Unlisted) != 1 || diff.Unlisted[0].Id != "older" {
+		t.Errorf("Unlisted = %v, want video older", diff.Unlisted)
+	}
+	if len(diff.Disappeared) != 1 || diff.Disappeared[0].Id != "inside" {
+		t.Errorf("Disappeared = %v, want video inside", diff.Disappeared)
+	}
+	// An empty listing tells nothing about the known videos
+	if empty := diffVideos(nil, known); len(empty.Disappeared) != 0 || len(empty.Unlisted) != 2 {
+		t.Errorf("diff of an empty listing = %d disappeared and %d unlisted, want 0 and 2", len(empty.Disappeared), len(empty.Unlisted))
+	}
+}
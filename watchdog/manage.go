@@ -0,0 +1,110 @@
+package watchdog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/metrics"
+	"enssat.tv/autovodsaver/twitch"
+)
+
+var (
+	ErrVideoNotFound     = errors.New("video not found")
+	ErrInvalidTransition = errors.New("video status does not allow this operation")
+	ErrForeignVideo      = errors.New("video belongs to another channel")
+)
+
+// Add a video to the download queue, it is fetched from Twitch when it is not known yet and must have been
+// published by the channel of the watchdog
+func (wd *Watchdog) EnqueueVideo(videoId string) (constants.VideoWatched, error) {
+	video, getVideoError := wd.GetVideo(videoId)
+	if errors.Is(getVideoError, ErrVideoNotFound) {
+		vod, twitchError := wd.Twitch.GetVideo(wd.Context, videoId)
+		if errors.Is(twitchError, twitch.ErrVideoNotFound) {
+			return video, ErrVideoNotFound
+		}
+		if twitchError != nil {
+			return video, fmt.Errorf("video %s could not be fetched from twitch: %w", videoId, twitchError)
+		}
+		if !strings.EqualFold(vod.Owner.Login, wd.ChannelId) {
+			return video, fmt.Errorf("%w: video %s is published by %q, not %s", ErrForeignVideo, videoId, vod.Owner.Login, wd.ChannelId)
+		}
+		// Newly added videos are queued by the watchdog as soon as they are discovered
+		if addVideoError := wd.addVideo(vod); addVideoError != nil {
+			return video, addVideoError
+		}
+		video, getVideoError = wd.GetVideo(videoId)
+	}
+	if getVideoError != nil {
+		return video, getVideoError
+	}
+
+	switch video.Status {
+	case constants.VideoStatusQueued:
+		return video, nil
+	case constants.VideoStatusMissing:
+		return wd.queueVideo(video, constants.VideoStatusMissing)
+	}
+	return video, fmt.Errorf("%w: video %s is %s", ErrInvalidTransition, videoId, video.Status)
+}
+
+// Queue again a video whose download failed, was restricted or was cancelled
+func (wd *Watchdog) RetryVideo(videoId string) (constants.VideoWatched, error) {
+	video, getVideoError := wd.GetVideo(videoId)
+	if getVideoError != nil {
+		return video, getVideoError
+	}
+	queued, queueError := wd.queueVideo(video, constants.VideoStatusExpired, constants.VideoStatusLost, constants.VideoStatusCancelled, constants.VideoStatusRestricted)
+	if queueError == nil {
+		metrics.DownloadRetries.Inc(wd.ChannelId)
+	}
+	return queued, queueError
+}
+
+// Remove a video from the download queue or abort its download
+func (wd *Watchdog) CancelVideo(videoId string) (constants.VideoWatched, error) {
+	video, getVideoError := wd.GetVideo(videoId)
+	if getVideoError != nil {
+		return video, getVideoError
+	}
+	if updateError := wd.updateVideoStatus(video.Video, constants.VideoStatusCancelled, constants.VideoStatusMissing, constants.VideoStatusQueued, constants.VideoStatusRecording); updateError != nil {
+		return video, updateError
+	}
+	wd.Queues.DownloadQueue.Remove(videoId)
+	wd.cancelDownload(videoId)
+	video.Status = constants.VideoStatusCancelled
+	return video, nil
+}
+
+// Record that the video has been stored, for videos uploaded outside of the watchdog
+func (wd *Watchdog) MarkArchived(videoId string) error {
+	video, getVideoError := wd.GetVideo(videoId)
+	if getVideoError != nil {
+		return getVideoError
+	}
+	return wd.updateVideoStatus(video.Video, constants.VideoStatusArchived)
+}
+
+// Record the SHA-256 of a file holding the video, like a file downloaded outside of the watchdog
+func (wd *Watchdog) SetChecksum(videoId string, checksum string) error {
+	if _, getVideoError := wd.GetVideo(videoId); getVideoError != nil {
+		return getVideoError
+	}
+	return wd.Repository.SetChecksum(videoId, checksum)
+}
+
+// List the videos waiting in the download queue, in download order
+func (wd *Watchdog) QueuedVideos() []*constants.VideoWatched {
+	return wd.Queues.DownloadQueue.Snapshot()
+}
+
+func (wd *Watchdog) queueVideo(video constants.VideoWatched, from ...constants.VideoStatus) (constants.VideoWatched, error) {
+	if updateError := wd.updateVideoStatus(video.Video, constants.VideoStatusQueued, from...); updateError != nil {
+		return video, updateError
+	}
+	video.Status = constants.VideoStatusQueued
+	wd.Queues.DownloadQueue.Enqueue(&video)
+	return video, nil
+}
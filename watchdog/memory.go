@@ -0,0 +1,246 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+)
+
+type memoryVideo struct {
+	video          constants.VideoWatched
+	lostAt         time.Time
+	leasedBy       string
+	leaseExpiresAt time.Time
+}
+
+// Repository keeping the videos in memory, they are lost when the process exits
+type MemoryRepository struct {
+	Context  context.Context
+	mu       *sync.Mutex
+	videos   map[string]*memoryVideo
+	channels map[string]bool
+	seeded   bool
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return NewMemoryRepositoryWithContext(context.Background())
+}
+
+func NewMemoryRepositoryWithContext(ctx context.Context) *MemoryRepository {
+	return &MemoryRepository{
+		Context:  ctx,
+		mu:       &sync.Mutex{},
+		videos:   make(map[string]*memoryVideo),
+		channels: make(map[string]bool),
+	}
+}
+
+func (r *MemoryRepository) Open() error {
+	return nil
+}
+
+func (r *MemoryRepository) Close() error {
+	return nil
+}
+
+func (r *MemoryRepository) Ping(_ context.Context) error {
+	return nil
+}
+
+func (r *MemoryRepository) copyVideo(record *memoryVideo) constants.VideoWatched {
+	video := record.video
+	video.Context = r.Context
+	return video
+}
+
+func (r *MemoryRepository) ListVideos(filter VideoFilter) ([]constants.VideoWatched, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	videos := make([]constants.VideoWatched, 0)
+	for _, record := range r.videos {
+		if filter.ChannelId != "" && record.video.ChannelId != filter.ChannelId {
+			continue
+		}
+		if filter.Status != "" && record.video.Status != filter.Status {
+			continue
+		}
+		if !filter.PublishedAfter.IsZero() && record.video.PublishedAt.Before(filter.PublishedAfter) {
+			continue
+		}
+		videos = append(videos, r.copyVideo(record))
+	}
+	slices.SortFunc(videos, func(a, b constants.VideoWatched) int {
+		return b.PublishedAt.Compare(a.PublishedAt)
+	})
+	if filter.Limit > 0 && len(videos) > filter.Limit {
+		videos = videos[:filter.Limit]
+	}
+	return videos, nil
+}
+
+func (r *MemoryRepository) VideosWithStatus(channelId string, statuses ...constants.VideoStatus) ([]constants.VideoWatched, error) {
+	videos, listError := r.ListVideos(VideoFilter{ChannelId: channelId})
+	if listError != nil {
+		return nil, listError
+	}
+	return slices.DeleteFunc(videos, func(video constants.VideoWatched) bool {
+		return !slices.Contains(statuses, video.Status)
+	}), nil
+}
+
+func (r *MemoryRepository) GetVideo(videoId string) (constants.VideoWatched, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, found := r.videos[videoId]
+	if !found {
+		return constants.VideoWatched{}, ErrVideoNotFound
+	}
+	return r.copyVideo(record), nil
+}
+
+func (r *MemoryRepository) UpsertVideo(video constants.VideoWatched) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, found := r.videos[video.Id]
+	if !found {
+		r.videos[video.Id] = &memoryVideo{video: video}
+		return nil
+	}
+	record.video.Title = video.Title
+	record.video.Description = video.Description
+	record.video.LengthSeconds = video.LengthSeconds
+	return nil
+}
+
+func (r *MemoryRepository) SetChecksum(videoId string, checksum string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, found := r.videos[videoId]
+	if !found {
+		return ErrVideoNotFound
+	}
+	record.video.Checksum = checksum
+	return nil
+}
+
+func (r *MemoryRepository) TransitionStatus(videoId string, to constants.VideoStatus, from ...constants.VideoStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, found := r.videos[videoId]
+	if !found {
+		return ErrVideoNotFound
+	}
+	if len(from) > 0 && !slices.Contains(from, record.video.Status) {
+		return fmt.Errorf("%w: video %s is %s", ErrInvalidTransition, videoId, record.video.Status)
+	}
+	record.video.Status = to
+	record.leasedBy = ""
+	record.leaseExpiresAt = time.Time{}
+	return nil
+}
+
+func (r *MemoryRepository) MarkLost(videoId string, lostAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, found := r.videos[videoId]
+	if !found {
+		return ErrVideoNotFound
+	}
+	record.video.Status = constants.VideoStatusLost
+	record.lostAt = lostAt
+	return nil
+}
+
+func (r *MemoryRepository) LostVideos(channelId string) ([]LostVideo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	videos := make([]LostVideo, 0)
+	for _, record := range r.videos {
+		if record.video.ChannelId != channelId || record.video.Status != constants.VideoStatusLost {
+			continue
+		}
+		videos = append(videos, LostVideo{VideoWatched: r.copyVideo(record), LostAt: record.lostAt})
+	}
+	slices.SortFunc(videos, func(a, b LostVideo) int {
+		return a.LostAt.Compare(b.LostAt)
+	})
+	return videos, nil
+}
+
+func (r *MemoryRepository) ClaimOrphanVideos(channelId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, record := range r.videos {
+		if record.video.ChannelId == "" {
+			record.video.ChannelId = channelId
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) LeaseVideo(videoId string, holder string, until time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	record, found := r.videos[videoId]
+	if !found || record.video.Status != constants.VideoStatusQueued {
+		return false, nil
+	}
+	if record.leasedBy != "" && record.leasedBy != holder && record.leaseExpiresAt.After(time.Now()) {
+		return false, nil
+	}
+	record.leasedBy = holder
+	record.leaseExpiresAt = until
+	return true, nil
+}
+
+func (r *MemoryRepository) RenewLease(videoId string, holder string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if record, found := r.videos[videoId]; found && record.leasedBy == holder {
+		record.leaseExpiresAt = until
+	}
+	return nil
+}
+
+func (r *MemoryRepository) WatchedChannels() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	channels := make([]string, 0, len(r.channels))
+	for channelId := range r.channels {
+		channels = append(channels, channelId)
+	}
+	slices.Sort(channels)
+	return channels, nil
+}
+
+func (r *MemoryRepository) WatchChannel(channelId string) error {
+	r.mu.Lock()
+	r.channels[channelId] = true
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *MemoryRepository) UnwatchChannel(channelId string) error {
+	r.mu.Lock()
+	delete(r.channels, channelId)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *MemoryRepository) SeedChannels(channelIds ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seeded {
+		return nil
+	}
+	r.seeded = true
+	for _, channelId := range channelIds {
+		r.channels[channelId] = true
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package watchdog
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+)
+
+type LostVideo struct {
+	constants.VideoWatched
+	LostAt time.Time
+}
+
+// How long the video stayed available on Twitch
+func (v LostVideo) Lifetime() time.Duration {
+	return v.LostAt.Sub(v.PublishedAt)
+}
+
+// Write a summary of the videos we failed to save, the shortest lifetime hints at the polling interval needed to catch them
+func WriteLostReport(w io.Writer, videos []LostVideo) error {
+	if len(videos) == 0 {
+		_, writeError := fmt.Fprintln(w, "no video has been lost")
+		return writeError
+	}
+
+	var shortest, total time.Duration
+	for i, video := range videos {
+		lifetime := video.Lifetime()
+		if i == 0 || lifetime < shortest {
+			shortest = lifetime
+		}
+		total += lifetime
+		if _, writeError := fmt.Fprintf(w, "%s\t%s\tpublished %s\tlost %s\tlifetime %s\n", video.Id, video.Title, video.PublishedAt.Format(time.RFC3339), video.LostAt.Format(time.RFC3339), lifetime.Round(time.Minute)); writeError != nil {
+			return writeError
+		}
+	}
+	_, writeError := fmt.Fprintf(w, "%d video(s) lost, shortest lifetime %s, average lifetime %s\n", len(videos), shortest.Round(time.Minute), (total / time.Duration(len(videos))).Round(time.Minute))
+	return writeError
+}
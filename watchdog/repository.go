@@ -0,0 +1,57 @@
+package watchdog
+
+import (
+	"context"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+)
+
+type VideoFilter struct {
+	ChannelId      string                // Only videos of this channel, any channel when empty
+	Status         constants.VideoStatus // Only videos with this status, any status when empty
+	PublishedAfter time.Time             // Only videos published after this date, any date when zero
+	Limit          int                   // Maximum number of videos, unlimited when zero
+}
+
+// Where the watchdog keeps the status of the videos, the videos of several channels may share a repository
+type VideoRepository interface {
+	// Connect to the storage and bring its schema up to date, does nothing when already open
+	Open() error
+	Close() error
+	Ping(ctx context.Context) error
+
+	// List the videos matching the filter, the most recent first
+	ListVideos(filter VideoFilter) ([]constants.VideoWatched, error)
+	// List the videos of a channel having one of the statuses
+	VideosWithStatus(channelId string, statuses ...constants.VideoStatus) ([]constants.VideoWatched, error)
+	// Returns ErrVideoNotFound when the video is unknown
+	GetVideo(videoId string) (constants.VideoWatched, error)
+	// Insert the video, or refresh its title, description and length when it is already known
+	UpsertVideo(video constants.VideoWatched) error
+	// Change the status of a video and release its lease, only when its current status is one of from (any status
+	// when from is empty), returns ErrInvalidTransition otherwise
+	TransitionStatus(videoId string, to constants.VideoStatus, from ...constants.VideoStatus) error
+	// Record the SHA-256 of the downloaded file, returns ErrVideoNotFound when the video is unknown
+	SetChecksum(videoId string, checksum string) error
+	MarkLost(videoId string, lostAt time.Time) error
+	LostVideos(channelId string) ([]LostVideo, error)
+	// Give the videos without channel, written before channels were recorded, to the channel
+	ClaimOrphanVideos(channelId string) error
+
+	// Take the download lease of a queued video until the expiry date, reports whether the lease has been taken
+	LeaseVideo(videoId string, holder string, until time.Time) (bool, error)
+	RenewLease(videoId string, holder string, until time.Time) error
+}
+
+// Where the channels watched by the daemon are kept across restarts
+type ChannelRepository interface {
+	// List the watched channels, in alphabetical order
+	WatchedChannels() ([]string, error)
+	// Record that the channel is watched, does nothing when it already is
+	WatchChannel(channelId string) error
+	UnwatchChannel(channelId string) error
+	// Watch the channels the first time the repository is used only, afterwards the recorded channels are kept
+	// as they are, even when every channel has been unwatched
+	SeedChannels(channelIds ...string) error
+}
@@ -0,0 +1,69 @@
+package watchdog_test
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/watchdog"
+	"enssat.tv/autovodsaver/watchdog/repositorytest"
+)
+
+func TestMemoryRepositoryConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repositorytest.Repository {
+		return watchdog.NewMemoryRepository()
+	})
+}
+
+func TestSQLiteRepositoryConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repositorytest.Repository {
+		return watchdog.NewSQLiteRepository(filepath.Join(t.TempDir(), "db.sqlite"))
+	})
+}
+
+// Runs against the database of AUTOVODSAVER_POSTGRES_URL, each test in its own schema dropped afterwards
+func TestPostgresRepositoryConformance(t *testing.T) {
+	dataSource := os.Getenv("AUTOVODSAVER_POSTGRES_URL")
+	if dataSource == "" {
+		t.Skip("AUTOVODSAVER_POSTGRES_URL is not set")
+	}
+	db, openError := sql.Open("postgres", dataSource)
+	if openError != nil {
+		t.Fatal(openError)
+	}
+	defer db.Close()
+
+	repositorytest.Run(t, func(t *testing.T) repositorytest.Repository {
+		schema := fmt.Sprintf("autovodsaver_test_%d", time.Now().UnixNano())
+		if _, createError := db.Exec("CREATE SCHEMA " + schema); createError != nil {
+			t.Fatal(createError)
+		}
+		t.Cleanup(func() {
+			if _, dropError := db.Exec("DROP SCHEMA " + schema + " CASCADE"); dropError != nil {
+				t.Errorf("drop schema %s: %v", schema, dropError)
+			}
+		})
+		return watchdog.NewPostgresRepository(withSearchPath(t, dataSource, schema))
+	})
+}
+
+// Connection string whose tables are created and read in the schema
+func withSearchPath(t *testing.T, dataSource string, schema string) string {
+	if !strings.Contains(dataSource, "://") {
+		// Keyword/value connection string
+		return dataSource + " search_path=" + schema
+	}
+	parsed, parseError := url.Parse(dataSource)
+	if parseError != nil {
+		t.Fatal(parseError)
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
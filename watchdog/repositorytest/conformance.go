@@ -0,0 +1,369 @@
+// Behaviour every VideoRepository implementation must have
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/twitch"
+	"enssat.tv/autovodsaver/watchdog"
+)
+
+// Repository keeping both the videos and the watched channels, like the SQL and memory repositories
+type Repository interface {
+	watchdog.VideoRepository
+	watchdog.ChannelRepository
+}
+
+var published = time.Date(2024, time.March, 1, 20, 30, 0, 0, time.UTC)
+
+// Run the conformance suite, newRepository must return an empty repository on each call, it is opened by the suite
+func Run(t *testing.T, newRepository func(t *testing.T) Repository) {
+	open := func(t *testing.T) Repository {
+		t.Helper()
+		repository := newRepository(t)
+		if openError := repository.Open(); openError != nil {
+			t.Fatalf("Open() error = %v", openError)
+		}
+		t.Cleanup(func() { repository.Close() })
+		// Opening again does nothing
+		if openError := repository.Open(); openError != nil {
+			t.Fatalf("second Open() error = %v", openError)
+		}
+		return repository
+	}
+
+	t.Run("Ping", func(t *testing.T) {
+		if pingError := open(t).Ping(context.Background()); pingError != nil {
+			t.Errorf("Ping() error = %v", pingError)
+		}
+	})
+	t.Run("UpsertThenGet", func(t *testing.T) {
+		testUpsertThenGet(t, open(t))
+	})
+	t.Run("UpsertRefreshesMetadata", func(t *testing.T) {
+		testUpsertRefreshesMetadata(t, open(t))
+	})
+	t.Run("ListVideos", func(t *testing.T) {
+		testListVideos(t, open(t))
+	})
+	t.Run("VideosWithStatus", func(t *testing.T) {
+		testVideosWithStatus(t, open(t))
+	})
+	t.Run("TransitionStatus", func(t *testing.T) {
+		testTransitionStatus(t, open(t))
+	})
+	t.Run("SetChecksum", func(t *testing.T) {
+		testSetChecksum(t, open(t))
+	})
+	t.Run("LostVideos", func(t *testing.T) {
+		testLostVideos(t, open(t))
+	})
+	t.Run("ClaimOrphanVideos", func(t *testing.T) {
+		testClaimOrphanVideos(t, open(t))
+	})
+	t.Run("Lease", func(t *testing.T) {
+		testLease(t, open(t))
+	})
+	t.Run("WatchedChannels", func(t *testing.T) {
+		testWatchedChannels(t, open(t))
+	})
+	t.Run("SeedChannels", func(t *testing.T) {
+		testSeedChannels(t, open(t))
+	})
+}
+
+func newVideo(id string, channelId string, status constants.VideoStatus, publishedAt time.Time) constants.VideoWatched {
+	return constants.VideoWatched{
+		Video: twitch.Video{
+			Id:            id,
+			Title:         "Video " + id,
+			Description:   "Description of video " + id,
+			PublishedAt:   publishedAt,
+			LengthSeconds: 3600,
+		},
+		ChannelId: channelId,
+		Status:    status,
+	}
+}
+
+func upsert(t *testing.T, repository Repository, videos ...constants.VideoWatched) {
+	t.Helper()
+	for _, video := range videos {
+		if upsertError := repository.UpsertVideo(video); upsertError != nil {
+			t.Fatalf("UpsertVideo(%s) error = %v", video.Id, upsertError)
+		}
+	}
+}
+
+func ids[T any](videos []T, id func(T) string) []string {
+	result := make([]string, 0, len(videos))
+	for _, video := range videos {
+		result = append(result, id(video))
+	}
+	return result
+}
+
+func videoIds(videos []constants.VideoWatched) []string {
+	return ids(videos, func(video constants.VideoWatched) string { return video.Id })
+}
+
+func getStatus(t *testing.T, repository Repository, videoId string) constants.VideoStatus {
+	t.Helper()
+	video, getVideoError := repository.GetVideo(videoId)
+	if getVideoError != nil {
+		t.Fatalf("GetVideo(%s) error = %v", videoId, getVideoError)
+	}
+	return video.Status
+}
+
+func testUpsertThenGet(t *testing.T, repository Repository) {
+	video := newVideo("1", "channel", constants.VideoStatusQueued, published)
+	video.Checksum = "c0ffee"
+	upsert(t, repository, video)
+
+	got, getVideoError := repository.GetVideo("1")
+	if getVideoError != nil {
+		t.Fatalf("GetVideo() error = %v", getVideoError)
+	}
+	if got.Id != video.Id || got.Title != video.Title || got.Description != video.Description || got.LengthSeconds != video.LengthSeconds ||
+		got.ChannelId != video.ChannelId || got.Status != video.Status || got.Checksum != video.Checksum || !got.PublishedAt.Equal(video.PublishedAt) {
+		t.Errorf("GetVideo() = %+v, want %+v", got, video)
+	}
+	if _, getVideoError := repository.GetVideo("404"); !errors.Is(getVideoError, watchdog.ErrVideoNotFound) {
+		t.Errorf("GetVideo() of an unknown video error = %v, want %v", getVideoError, watchdog.ErrVideoNotFound)
+	}
+}
+
+func testUpsertRefreshesMetadata(t *testing.T, repository Repository) {
+	upsert(t, repository, newVideo("1", "channel", constants.VideoStatusArchived, published))
+	updated := newVideo("1", "other", constants.VideoStatusQueued, published)
+	updated.Title, updated.Description, updated.LengthSeconds = "Renamed", "Edited", 7200
+	upsert(t, repository, updated)
+
+	// Only the metadata coming from Twitch is refreshed, the channel and the status stay
+	got, getVideoError := repository.GetVideo("1")
+	if getVideoError != nil {
+		t.Fatal(getVideoError)
+	}
+	if got.Title != "Renamed" || got.Description != "Edited" || got.LengthSeconds != 7200 {
+		t.Errorf("GetVideo() = %+v, want the refreshed title, description and length", got)
+	}
+	if got.ChannelId != "channel" || got.Status != constants.VideoStatusArchived {
+		t.Errorf("channel %q and status %s after upsert, want channel and %s", got.ChannelId, got.Status, constants.VideoStatusArchived)
+	}
+}
+
+func testListVideos(t *testing.T, repository Repository) {
+	upsert(t, repository,
+		newVideo("old", "channel", constants.VideoStatusArchived, published.Add(-48*time.Hour)),
+		newVideo("recent", "channel", constants.VideoStatusQueued, published),
+		newVideo("middle", "channel", constants.VideoStatusArchived, published.Add(-24*time.Hour)),
+		newVideo("other", "other", constants.VideoStatusQueued, published.Add(time.Hour)),
+	)
+
+	tests := []struct {
+		name   string
+		filter watchdog.VideoFilter
+		want   []string
+	}{
+		{"every video, most recent first", watchdog.VideoFilter{}, []string{"other", "recent", "middle", "old"}},
+		{"channel", watchdog.VideoFilter{ChannelId: "channel"}, []string{"recent", "middle", "old"}},
+		{"status", watchdog.VideoFilter{Status: constants.VideoStatusArchived}, []string{"middle", "old"}},
+		{"published after", watchdog.VideoFilter{ChannelId: "channel", PublishedAfter: published.Add(-24 * time.Hour)}, []string{"recent", "middle"}},
+		{"limit", watchdog.VideoFilter{Limit: 2}, []string{"other", "recent"}},
+	}
+	for _, test := range tests {
+		videos, listError := repository.ListVideos(test.filter)
+		if listError != nil {
+			t.Fatalf("ListVideos(%s) error = %v", test.name, listError)
+		}
+		if got := videoIds(videos); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ListVideos(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func testVideosWithStatus(t *testing.T, repository Repository) {
+	upsert(t, repository,
+		newVideo("queued", "channel", constants.VideoStatusQueued, published),
+		newVideo("recording", "channel", constants.VideoStatusRecording, published.Add(-time.Hour)),
+		newVideo("archived", "channel", constants.VideoStatusArchived, published.Add(-2*time.Hour)),
+		newVideo("other", "other", constants.VideoStatusQueued, published),
+	)
+
+	videos, listError := repository.VideosWithStatus("channel", constants.VideoStatusQueued, constants.VideoStatusRecording)
+	if listError != nil {
+		t.Fatal(listError)
+	}
+	if got := videoIds(videos); !reflect.DeepEqual(got, []string{"queued", "recording"}) {
+		t.Errorf("VideosWithStatus() = %v, want [queued recording]", got)
+	}
+	if videos, _ := repository.VideosWithStatus("channel"); len(videos) != 0 {
+		t.Errorf("VideosWithStatus() without status = %v, want none", videoIds(videos))
+	}
+}
+
+func testTransitionStatus(t *testing.T, repository Repository) {
+	upsert(t, repository, newVideo("1", "channel", constants.VideoStatusMissing, published))
+
+	if transitionError := repository.TransitionStatus("1", constants.VideoStatusQueued, constants.VideoStatusMissing); transitionError != nil {
+		t.Fatalf("TransitionStatus() from the current status error = %v", transitionError)
+	}
+	transitionError := repository.TransitionStatus("1", constants.VideoStatusQueued, constants.VideoStatusMissing)
+	if !errors.Is(transitionError, watchdog.ErrInvalidTransition) {
+		t.Errorf("TransitionStatus() from another status error = %v, want %v", transitionError, watchdog.ErrInvalidTransition)
+	}
+	if status := getStatus(t, repository, "1"); status != constants.VideoStatusQueued {
+		t.Errorf("status = %s after a refused transition, want %s", status, constants.VideoStatusQueued)
+	}
+	// Without from, any status can be left
+	if transitionError := repository.TransitionStatus("1", constants.VideoStatusArchived); transitionError != nil {
+		t.Errorf("TransitionStatus() without from error = %v", transitionError)
+	}
+	if transitionError := repository.TransitionStatus("404", constants.VideoStatusQueued); !errors.Is(transitionError, watchdog.ErrVideoNotFound) {
+		t.Errorf("TransitionStatus() of an unknown video error = %v, want %v", transitionError, watchdog.ErrVideoNotFound)
+	}
+}
+
+func testSetChecksum(t *testing.T, repository Repository) {
+	upsert(t, repository, newVideo("1", "channel", constants.VideoStatusDownloaded, published))
+
+	if checksumError := repository.SetChecksum("1", "c0ffee"); checksumError != nil {
+		t.Fatalf("SetChecksum() error = %v", checksumError)
+	}
+	if video, _ := repository.GetVideo("1"); video.Checksum != "c0ffee" {
+		t.Errorf("Checksum = %q, want c0ffee", video.Checksum)
+	}
+	if checksumError := repository.SetChecksum("404", "c0ffee"); !errors.Is(checksumError, watchdog.ErrVideoNotFound) {
+		t.Errorf("SetChecksum() of an unknown video error = %v, want %v", checksumError, watchdog.ErrVideoNotFound)
+	}
+}
+
+func testLostVideos(t *testing.T, repository Repository) {
+	upsert(t, repository,
+		newVideo("first", "channel", constants.VideoStatusQueued, published),
+		newVideo("second", "channel", constants.VideoStatusQueued, published),
+		newVideo("kept", "channel", constants.VideoStatusQueued, published),
+		newVideo("other", "other", constants.VideoStatusQueued, published),
+	)
+	lostAt := published.Add(7 * 24 * time.Hour)
+	for videoId, at := range map[string]time.Time{"second": lostAt.Add(time.Hour), "first": lostAt, "other": lostAt} {
+		if markError := repository.MarkLost(videoId, at); markError != nil {
+			t.Fatalf("MarkLost(%s) error = %v", videoId, markError)
+		}
+	}
+
+	lost, lostError := repository.LostVideos("channel")
+	if lostError != nil {
+		t.Fatal(lostError)
+	}
+	// Oldest loss first
+	if got := ids(lost, func(video watchdog.LostVideo) string { return video.Id }); !reflect.DeepEqual(got, []string{"first", "second"}) {
+		t.Fatalf("LostVideos() = %v, want [first second]", got)
+	}
+	if !lost[0].LostAt.Equal(lostAt) || lost[0].Status != constants.VideoStatusLost {
+		t.Errorf("LostVideos()[0] lost at %s with status %s, want %s and %s", lost[0].LostAt, lost[0].Status, lostAt, constants.VideoStatusLost)
+	}
+}
+
+func testClaimOrphanVideos(t *testing.T, repository Repository) {
+	upsert(t, repository,
+		newVideo("orphan", "", constants.VideoStatusArchived, published),
+		newVideo("owned", "other", constants.VideoStatusArchived, published),
+	)
+	if claimError := repository.ClaimOrphanVideos("channel"); claimError != nil {
+		t.Fatal(claimError)
+	}
+	for videoId, channelId := range map[string]string{"orphan": "channel", "owned": "other"} {
+		if video, _ := repository.GetVideo(videoId); video.ChannelId != channelId {
+			t.Errorf("channel of video %s = %q, want %q", videoId, video.ChannelId, channelId)
+		}
+	}
+}
+
+func testLease(t *testing.T, repository Repository) {
+	upsert(t, repository,
+		newVideo("queued", "channel", constants.VideoStatusQueued, published),
+		newVideo("archived", "channel", constants.VideoStatusArchived, published),
+	)
+	lease := func(videoId string, holder string, until time.Time) bool {
+		t.Helper()
+		leased, leaseError := repository.LeaseVideo(videoId, holder, until)
+		if leaseError != nil {
+			t.Fatalf("LeaseVideo(%s, %s) error = %v", videoId, holder, leaseError)
+		}
+		return leased
+	}
+	later := time.Now().Add(time.Hour)
+
+	if !lease("queued", "first", later) {
+		t.Fatal("LeaseVideo() of a queued video failed")
+	}
+	if lease("queued", "second", later) {
+		t.Error("LeaseVideo() succeeded while another instance holds the lease")
+	}
+	if !lease("queued", "first", later) {
+		t.Error("LeaseVideo() by the holder of the lease failed")
+	}
+	if lease("archived", "first", later) || lease("404", "first", later) {
+		t.Error("LeaseVideo() of a video that is not queued succeeded")
+	}
+
+	// An expired lease can be taken over, until it is renewed
+	if renewError := repository.RenewLease("queued", "first", time.Now().Add(-time.Minute)); renewError != nil {
+		t.Fatalf("RenewLease() error = %v", renewError)
+	}
+	if !lease("queued", "second", later) {
+		t.Error("LeaseVideo() of a video whose lease expired failed")
+	}
+
+	// Changing the status releases the lease
+	if transitionError := repository.TransitionStatus("queued", constants.VideoStatusQueued); transitionError != nil {
+		t.Fatal(transitionError)
+	}
+	if !lease("queued", "third", later) {
+		t.Error("LeaseVideo() after a status change failed, want the lease released")
+	}
+}
+
+func testWatchedChannels(t *testing.T, repository Repository) {
+	for _, channelId := range []string{"second", "first", "second"} {
+		if watchError := repository.WatchChannel(channelId); watchError != nil {
+			t.Fatalf("WatchChannel(%s) error = %v", channelId, watchError)
+		}
+	}
+	channels, listError := repository.WatchedChannels()
+	if listError != nil || !reflect.DeepEqual(channels, []string{"first", "second"}) {
+		t.Errorf("WatchedChannels() = %v, %v, want [first second]", channels, listError)
+	}
+
+	if unwatchError := repository.UnwatchChannel("first"); unwatchError != nil {
+		t.Fatalf("UnwatchChannel() error = %v", unwatchError)
+	}
+	channels, listError = repository.WatchedChannels()
+	if listError != nil || !reflect.DeepEqual(channels, []string{"second"}) {
+		t.Errorf("WatchedChannels() = %v, %v after unwatching first, want [second]", channels, listError)
+	}
+}
+
+func testSeedChannels(t *testing.T, repository Repository) {
+	if seedError := repository.SeedChannels("default"); seedError != nil {
+		t.Fatalf("SeedChannels() error = %v", seedError)
+	}
+	if unwatchError := repository.UnwatchChannel("default"); unwatchError != nil {
+		t.Fatalf("UnwatchChannel() error = %v", unwatchError)
+	}
+
+	// Seeding again, like on restart, does not bring back the removed channel
+	if seedError := repository.SeedChannels("default"); seedError != nil {
+		t.Fatalf("SeedChannels() error = %v", seedError)
+	}
+	if channels, listError := repository.WatchedChannels(); listError != nil || len(channels) != 0 {
+		t.Errorf("WatchedChannels() = %v, %v after seeding twice, want no channel", channels, listError)
+	}
+}
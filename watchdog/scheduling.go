@@ -0,0 +1,168 @@
+package watchdog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+)
+
+const (
+	defaultRetention     = 7 * 24 * time.Hour
+	defaultChannelWeight = 1.0
+	bumpStep             = 24 * time.Hour
+)
+
+// Can be shared between the watchdogs of every channel so their scores can be compared
+type SchedulingPolicy struct {
+	mu             *sync.Mutex
+	Retention      time.Duration            // How long a channel keeps its vods on Twitch, unless set for the channel
+	Retentions     map[string]time.Duration // Retention of each channel
+	ChannelWeights map[string]float64       // Higher weight means the channel is served first
+	bumps          map[string]int
+}
+
+func NewSchedulingPolicy(retention time.Duration) *SchedulingPolicy {
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+	return &SchedulingPolicy{
+		mu:             &sync.Mutex{},
+		Retention:      retention,
+		Retentions:     make(map[string]time.Duration),
+		ChannelWeights: make(map[string]float64),
+		bumps:          make(map[string]int),
+	}
+}
+
+// Each bump moves the video one day closer to its expiry in the eyes of the scheduler
+func (p *SchedulingPolicy) Bump(videoId string, levels int) {
+	p.mu.Lock()
+	p.bumps[videoId] += levels
+	p.mu.Unlock()
+}
+
+// Drop the bumps of a video that left the download queue for good
+func (p *SchedulingPolicy) Forget(videoId string) {
+	p.mu.Lock()
+	delete(p.bumps, videoId)
+	p.mu.Unlock()
+}
+
+func (p *SchedulingPolicy) SetChannelWeight(channelId string, weight float64) {
+	p.mu.Lock()
+	p.ChannelWeights[channelId] = weight
+	p.mu.Unlock()
+}
+
+func (p *SchedulingPolicy) SetChannelRetention(channelId string, retention time.Duration) {
+	p.mu.Lock()
+	p.Retentions[channelId] = retention
+	p.mu.Unlock()
+}
+
+// Score returns the remaining hours before the video expires, shortened by manual bumps
+// and scaled by the channel weight, videos with the lowest score are downloaded first
+func (p *SchedulingPolicy) Score(channelId string, video *constants.VideoWatched) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	retention, found := p.Retentions[channelId]
+	if !found || retention <= 0 {
+		retention = p.Retention
+	}
+	remaining := time.Until(video.PublishedAt.Add(retention))
+	remaining -= time.Duration(p.bumps[video.Id]) * bumpStep
+
+	weight, found := p.ChannelWeights[channelId]
+	if !found || weight <= 0 {
+		weight = defaultChannelWeight
+	}
+	// Overdue videos have a negative score, a heavier channel must push it further down, not back up
+	if remaining < 0 {
+		return remaining.Hours() * weight
+	}
+	return remaining.Hours() / weight
+}
+
+// DownloadSlots bounds the downloads running at once across the watchdogs sharing it,
+// a freed slot goes to the waiting video with the lowest score whatever its channel
+type DownloadSlots struct {
+	mu      *sync.Mutex
+	free    int
+	next    uint64
+	waiting map[uint64]*slotRequest
+}
+
+type slotRequest struct {
+	score   float64
+	granted chan struct{}
+}
+
+func NewDownloadSlots(limit int) *DownloadSlots {
+	if limit <= 0 {
+		limit = 1
+	}
+	return &DownloadSlots{
+		mu:      &sync.Mutex{},
+		free:    limit,
+		waiting: make(map[uint64]*slotRequest),
+	}
+}
+
+// Wait for a slot, the returned function gives it back once the download is over
+func (s *DownloadSlots) Acquire(ctx context.Context, score float64) (func(), error) {
+	s.mu.Lock()
+	if s.free > 0 && len(s.waiting) == 0 {
+		s.free--
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	ticket := s.next
+	s.next++
+	request := &slotRequest{score: score, granted: make(chan struct{})}
+	s.waiting[ticket] = request
+	s.mu.Unlock()
+
+	select {
+	case <-request.granted:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		_, stillWaiting := s.waiting[ticket]
+		delete(s.waiting, ticket)
+		s.mu.Unlock()
+		if !stillWaiting {
+			// Granted while giving up, hand it over to the next one
+			s.release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *DownloadSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best uint64
+	var bestRequest *slotRequest
+	for ticket, request := range s.waiting {
+		// Ties are served in arrival order
+		if bestRequest == nil || request.score < bestRequest.score || (request.score == bestRequest.score && ticket < best) {
+			best, bestRequest = ticket, request
+		}
+	}
+	if bestRequest == nil {
+		s.free++
+		return
+	}
+	delete(s.waiting, best)
+	close(bestRequest.granted)
+}
+
+// Number of videos waiting for a slot
+func (s *DownloadSlots) Waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiting)
+}
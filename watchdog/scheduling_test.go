@@ -0,0 +1,131 @@
+package watchdog
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/queue"
+	"enssat.tv/autovodsaver/twitch"
+)
+
+func publishedAgo(id string, ago time.Duration) *constants.VideoWatched {
+	return &constants.VideoWatched{Video: twitch.Video{Id: id, PublishedAt: time.Now().Add(-ago)}}
+}
+
+func TestSchedulingPolicyScore(t *testing.T) {
+	policy := NewSchedulingPolicy(7 * 24 * time.Hour)
+	policy.SetChannelRetention("short", 24*time.Hour)
+	policy.SetChannelWeight("heavy", 2)
+
+	recent := publishedAgo("recent", 12*time.Hour)
+	// The retention of the channel decides how close the video is to its expiry
+	if short, other := policy.Score("short", recent), policy.Score("other", recent); short >= other {
+		t.Errorf("Score() = %.1f with a 1 day retention, want less than %.1f with the default retention", short, other)
+	}
+
+	// A heavier channel goes first, whether the video expires later or is already overdue
+	for _, video := range []*constants.VideoWatched{recent, publishedAgo("overdue", 10*24*time.Hour)} {
+		if heavy, other := policy.Score("heavy", video), policy.Score("other", video); heavy >= other {
+			t.Errorf("Score(heavy, %s) = %.1f, want less than %.1f without weight", video.Id, heavy, other)
+		}
+	}
+
+	// Each bump is worth a day
+	before := policy.Score("other", recent)
+	policy.Bump(recent.Id, 2)
+	if bumped := policy.Score("other", recent); before-bumped < 47.9 || before-bumped > 48.1 {
+		t.Errorf("Score() moved by %.1f hours after 2 bumps, want 48", before-bumped)
+	}
+	// The bumps of a video that left the queue are not kept
+	policy.Forget(recent.Id)
+	if forgotten := policy.Score("other", recent); forgotten-before > 0.1 || len(policy.bumps) != 0 {
+		t.Errorf("Score() = %.1f with %d bumps kept after Forget(), want %.1f without bumps", forgotten, len(policy.bumps), before)
+	}
+}
+
+func TestSharedPolicyOrdersChannels(t *testing.T) {
+	policy := NewSchedulingPolicy(7 * 24 * time.Hour)
+	policy.SetChannelWeight("favorite", 4)
+	q := queue.NewPriority(func(video *constants.VideoWatched) float64 {
+		return policy.Score(video.ChannelId, video)
+	})
+	videos := []*constants.VideoWatched{
+		publishedAgo("other-old", 6*24*time.Hour),
+		publishedAgo("favorite-new", time.Hour),
+		publishedAgo("other-new", 2*time.Hour),
+	}
+	videos[0].ChannelId, videos[1].ChannelId, videos[2].ChannelId = "other", "favorite", "other"
+	for _, video := range videos {
+		q.Enqueue(video)
+	}
+
+	// 24 hours left for other-old, 167 hours divided by 4 for favorite-new, 166 hours for other-new
+	got := make([]string, 0)
+	for _, video := range q.Snapshot() {
+		got = append(got, video.Id)
+	}
+	if want := []string{"other-old", "favorite-new", "other-new"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
+
+func TestDownloadSlotsServeLowestScore(t *testing.T) {
+	slots := NewDownloadSlots(1)
+	release, acquireError := slots.Acquire(context.Background(), 100)
+	if acquireError != nil {
+		t.Fatalf("Acquire() error = %v", acquireError)
+	}
+
+	mu := &sync.Mutex{}
+	order := make([]string, 0)
+	waiters := &sync.WaitGroup{}
+	for name, score := range map[string]float64{"late": 50, "urgent": -10, "soon": 5} {
+		waiters.Add(1)
+		go func() {
+			defer waiters.Done()
+			releaseWaiter, waitError := slots.Acquire(context.Background(), score)
+			if waitError != nil {
+				t.Errorf("Acquire(%s) error = %v", name, waitError)
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			releaseWaiter()
+		}()
+	}
+	for slots.Waiting() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	waiters.Wait()
+
+	if want := []string{"urgent", "soon", "late"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("slots granted to %v, want %v", order, want)
+	}
+}
+
+func TestDownloadSlotsCancelledWait(t *testing.T) {
+	slots := NewDownloadSlots(1)
+	release, _ := slots.Acquire(context.Background(), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, acquireError := slots.Acquire(ctx, 0); acquireError == nil {
+		t.Fatal("Acquire() with a cancelled context succeeded while the slot is taken")
+	}
+	if waiting := slots.Waiting(); waiting != 0 {
+		t.Errorf("Waiting() = %d after a cancelled wait, want 0", waiting)
+	}
+
+	// The slot is free again once released
+	release()
+	releaseAgain, acquireError := slots.Acquire(context.Background(), 0)
+	if acquireError != nil {
+		t.Fatalf("Acquire() after release error = %v", acquireError)
+	}
+	releaseAgain()
+}
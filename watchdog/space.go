@@ -0,0 +1,62 @@
+package watchdog
+
+import (
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/diskspace"
+	"github.com/rs/zerolog"
+)
+
+const defaultSpaceCheckInterval = time.Minute
+
+// Directories the downloads write to, the output directory is not used when streaming
+func (wd *Watchdog) downloadDirectories() []string {
+	if wd.Storage != nil {
+		return []string{wd.Twitch.WorkDir()}
+	}
+	return []string{wd.Twitch.WorkDir(), "."}
+}
+
+// Fails with a diskspace.InsufficientSpaceError when a download directory has less than MinFreeSpace available
+func (wd *Watchdog) checkFreeSpace() error {
+	for _, directory := range wd.downloadDirectories() {
+		if checkError := diskspace.Check(directory, wd.MinFreeSpace); checkError != nil {
+			return checkError
+		}
+	}
+	return nil
+}
+
+// Hold the download queue while the free space is below MinFreeSpace, reports false when the watchdog stopped meanwhile
+func (wd *Watchdog) waitForSpace() bool {
+	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	if wd.MinFreeSpace == 0 {
+		return true
+	}
+	interval := wd.SpaceCheckInterval
+	if interval <= 0 {
+		interval = defaultSpaceCheckInterval
+	}
+	paused := false
+	for {
+		spaceError := wd.checkFreeSpace()
+		if spaceError == nil {
+			if paused {
+				logger.Info().Msgf("download queue of channel %s resumed, free space is back above %s", wd.ChannelId, diskspace.FormatSize(wd.MinFreeSpace))
+			}
+			return true
+		}
+		if !paused {
+			logger.Warn().Msgf("download queue of channel %s paused until space is freed: %s", wd.ChannelId, spaceError.Error())
+			paused = true
+		}
+		wd.heartbeat("downloader")
+		select {
+		case <-wd.runContext.Done():
+			return false
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package watchdog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/twitch"
+)
+
+const videosStatusColumns = "id, title, description, published_at, duration, status, channel_id, checksum"
+
+const createWatchedChannelsTableStatement = `
+	CREATE TABLE IF NOT EXISTS watched_channels (
+		channel_id VARCHAR(50) NOT NULL PRIMARY KEY
+	);
+`
+
+// Markers of the one-time initializations, like the seeding of the watched channels
+const createRepositoryMarkersTableStatement = `
+	CREATE TABLE IF NOT EXISTS repository_markers (
+		name VARCHAR(50) NOT NULL PRIMARY KEY
+	);
+`
+
+const channelsSeededMarker = "channels_seeded"
+
+// What differs between the SQL databases supported by the repository
+type sqlDialect interface {
+	driverName() string
+	// Statements creating the schema, safe to run on an existing database
+	schema() []string
+	// Type of the columns storing a date
+	timestampType() string
+	// Add a column to a table unless it already exists
+	ensureColumn(db *sql.DB, table string, column string, definition string) error
+	// Convert a query written with ? placeholders to the placeholders of the database
+	rebind(query string) string
+	// Query taking a download lease on a queued video, arguments are the lease holder, the lease expiry,
+	// the video id, the queued status, the lease holder again and the current time
+	leaseStatement() string
+}
+
+// Repository keeping the videos in a SQL database
+type SQLRepository struct {
+	Context    context.Context
+	Database   *sql.DB
+	DataSource string
+	dialect    sqlDialect
+}
+
+func newSQLRepository(ctx context.Context, dialect sqlDialect, dataSource string) *SQLRepository {
+	return &SQLRepository{
+		Context:    ctx,
+		DataSource: dataSource,
+		dialect:    dialect,
+	}
+}
+
+func (r *SQLRepository) Open() error {
+	if r.Database != nil {
+		return nil
+	}
+
+	// Open connection to the database
+	db, openDatabaseError := sql.Open(r.dialect.driverName(), r.DataSource)
+	if openDatabaseError != nil {
+		return openDatabaseError
+	}
+
+	// Create table "videos_status"
+	for _, statement := range r.dialect.schema() {
+		if _, createError := db.Exec(statement); createError != nil {
+			db.Close()
+			return createError
+		}
+	}
+	// Add the columns introduced after the table was first created
+	for _, column := range [][2]string{
+		{"lost_at", r.dialect.timestampType()},
+		{"channel_id", "VARCHAR(50) NOT NULL DEFAULT ''"},
+		{"leased_by", "VARCHAR(100)"},
+		{"lease_expires_at", r.dialect.timestampType()},
+		{"checksum", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	} {
+		if addColumnError := r.dialect.ensureColumn(db, "videos_status", column[0], column[1]); addColumnError != nil {
+			db.Close()
+			return addColumnError
+		}
+	}
+
+	r.Database = db
+	return nil
+}
+
+func (r *SQLRepository) Close() error {
+	if r.Database == nil {
+		return nil
+	}
+	closeError := r.Database.Close()
+	r.Database = nil
+	return closeError
+}
+
+func (r *SQLRepository) Ping(ctx context.Context) error {
+	if r.Database == nil {
+		return fmt.Errorf("database is not open")
+	}
+	return r.Database.PingContext(ctx)
+}
+
+func (r *SQLRepository) ListVideos(filter VideoFilter) ([]constants.VideoWatched, error) {
+	query := "SELECT " + videosStatusColumns + " FROM videos_status WHERE 1 = 1"
+	args := []any{}
+	if filter.ChannelId != "" {
+		query += " AND channel_id = ?"
+		args = append(args, filter.ChannelId)
+	}
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	if !filter.PublishedAfter.IsZero() {
+		query += " AND published_at >= ?"
+		args = append(args, filter.PublishedAfter)
+	}
+	query += " ORDER BY published_at DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	return r.queryVideos(query, args...)
+}
+
+func (r *SQLRepository) VideosWithStatus(channelId string, statuses ...constants.VideoStatus) ([]constants.VideoWatched, error) {
+	if len(statuses) == 0 {
+		return []constants.VideoWatched{}, nil
+	}
+	args := []any{channelId}
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+	return r.queryVideos("SELECT "+videosStatusColumns+" FROM videos_status WHERE channel_id = ? AND status IN ("+placeholders(len(statuses))+") ORDER BY published_at DESC", args...)
+}
+
+func (r *SQLRepository) queryVideos(query string, args ...any) ([]constants.VideoWatched, error) {
+	rows, execError := r.Database.QueryContext(r.Context, r.dialect.rebind(query), args...)
+	if execError != nil {
+		return nil, execError
+	}
+	defer rows.Close()
+
+	videos := make([]constants.VideoWatched, 0)
+	for rows.Next() {
+		video, scanError := r.scanVideo(rows)
+		if scanError != nil {
+			return nil, scanError
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+func (r *SQLRepository) GetVideo(videoId string) (constants.VideoWatched, error) {
+	row := r.Database.QueryRowContext(r.Context, r.dialect.rebind("SELECT "+videosStatusColumns+" FROM videos_status WHERE id = ?"), videoId)
+	video, scanError := r.scanVideo(row)
+	if errors.Is(scanError, sql.ErrNoRows) {
+		return video, ErrVideoNotFound
+	}
+	return video, scanError
+}
+
+func (r *SQLRepository) scanVideo(row interface{ Scan(...any) error }) (constants.VideoWatched, error) {
+	var (
+		id           string
+		title        string
+		description  string
+		published_at time.Time
+		duration     uint
+		status       constants.VideoStatus
+		channel_id   string
+		checksum     string
+	)
+	if scanError := row.Scan(&id, &title, &description, &published_at, &duration, &status, &channel_id, &checksum); scanError != nil {
+		return constants.VideoWatched{}, scanError
+	}
+	return constants.VideoWatched{
+		Status:    status,
+		ChannelId: channel_id,
+		Video: twitch.Video{
+			Context:       r.Context,
+			Id:            id,
+			Title:         title,
+			Description:   description,
+			PublishedAt:   published_at,
+			LengthSeconds: duration,
+			Checksum:      checksum,
+		},
+	}, nil
+}
+
+func (r *SQLRepository) UpsertVideo(video constants.VideoWatched) error {
+	_, execError := r.Database.ExecContext(r.Context, r.dialect.rebind(`INSERT INTO videos_status (`+videosStatusColumns+`) VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET title = excluded.title, description = excluded.description, duration = excluded.duration`),
+		video.Id, video.Title, video.Description, video.PublishedAt, video.LengthSeconds, video.Status, video.ChannelId, video.Checksum)
+	return execError
+}
+
+func (r *SQLRepository) TransitionStatus(videoId string, to constants.VideoStatus, from ...constants.VideoStatus) error {
+	query := "UPDATE videos_status SET status = ?, leased_by = NULL, lease_expires_at = NULL WHERE id = ?"
+	args := []any{to, videoId}
+	if len(from) > 0 {
+		query += " AND status IN (" + placeholders(len(from)) + ")"
+		for _, status := range from {
+			args = append(args, status)
+		}
+	}
+	result, execError := r.Database.ExecContext(r.Context, r.dialect.rebind(query), args...)
+	if execError != nil {
+		return execError
+	}
+	affected, affectedError := result.RowsAffected()
+	if affectedError != nil {
+		return affectedError
+	}
+	if affected == 1 {
+		return nil
+	}
+	// Tell an unknown video from a forbidden transition
+	video, getVideoError := r.GetVideo(videoId)
+	if getVideoError != nil {
+		return getVideoError
+	}
+	return fmt.Errorf("%w: video %s is %s", ErrInvalidTransition, videoId, video.Status)
+}
+
+func (r *SQLRepository) MarkLost(videoId string, lostAt time.Time) error {
+	_, execError := r.Database.ExecContext(r.Context, r.dialect.rebind("UPDATE videos_status SET status = ?, lost_at = ? WHERE id = ?"), constants.VideoStatusLost, lostAt, videoId)
+	return execError
+}
+
+func (r *SQLRepository) LostVideos(channelId string) ([]LostVideo, error) {
+	rows, queryError := r.Database.QueryContext(r.Context, r.dialect.rebind("SELECT "+videosStatusColumns+", lost_at FROM videos_status WHERE status = ? AND channel_id = ? ORDER BY lost_at"), constants.VideoStatusLost, channelId)
+	if queryError != nil {
+		return nil, queryError
+	}
+	defer rows.Close()
+
+	videos := make([]LostVideo, 0)
+	for rows.Next() {
+		var (
+			video   LostVideo
+			lost_at sql.NullTime
+		)
+		if scanError := rows.Scan(&video.Id, &video.Title, &video.Description, &video.PublishedAt, &video.LengthSeconds, &video.Status, &video.ChannelId, &video.Checksum, &lost_at); scanError != nil {
+			return nil, scanError
+		}
+		video.Context = r.Context
+		video.LostAt = lost_at.Time
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+func (r *SQLRepository) SetChecksum(videoId string, checksum string) error {
+	result, execError := r.Database.ExecContext(r.Context, r.dialect.rebind("UPDATE videos_status SET checksum = ? WHERE id = ?"), checksum, videoId)
+	if execError != nil {
+		return execError
+	}
+	affected, affectedError := result.RowsAffected()
+	if affectedError != nil {
+		return affectedError
+	}
+	if affected == 0 {
+		return ErrVideoNotFound
+	}
+	return nil
+}
+
+func (r *SQLRepository) ClaimOrphanVideos(channelId string) error {
+	_, claimError := r.Database.ExecContext(r.Context, r.dialect.rebind("UPDATE videos_status SET channel_id = ? WHERE channel_id = ''"), channelId)
+	return claimError
+}
+
+func (r *SQLRepository) LeaseVideo(videoId string, holder string, until time.Time) (bool, error) {
+	result, execError := r.Database.ExecContext(r.Context, r.dialect.rebind(r.dialect.leaseStatement()), holder, until, videoId, constants.VideoStatusQueued, holder, time.Now())
+	if execError != nil {
+		return false, execError
+	}
+	affected, affectedError := result.RowsAffected()
+	if affectedError != nil {
+		return false, affectedError
+	}
+	return affected == 1, nil
+}
+
+func (r *SQLRepository) RenewLease(videoId string, holder string, until time.Time) error {
+	_, execError := r.Database.ExecContext(r.Context, r.dialect.rebind("UPDATE videos_status SET lease_expires_at = ? WHERE id = ? AND leased_by = ?"), until, videoId, holder)
+	return execError
+}
+
+func (r *SQLRepository) WatchedChannels() ([]string, error) {
+	rows, queryError := r.Database.QueryContext(r.Context, "SELECT channel_id FROM watched_channels ORDER BY channel_id")
+	if queryError != nil {
+		return nil, queryError
+	}
+	defer rows.Close()
+	channels := make([]string, 0)
+	for rows.Next() {
+		var channelId string
+		if scanError := rows.Scan(&channelId); scanError != nil {
+			return nil, scanError
+		}
+		channels = append(channels, channelId)
+	}
+	return channels, rows.Err()
+}
+
+func (r *SQLRepository) WatchChannel(channelId string) error {
+	_, execError := r.Database.ExecContext(r.Context, r.dialect.rebind("INSERT INTO watched_channels (channel_id) VALUES (?) ON CONFLICT DO NOTHING"), channelId)
+	return execError
+}
+
+func (r *SQLRepository) UnwatchChannel(channelId string) error {
+	_, execError := r.Database.ExecContext(r.Context, r.dialect.rebind("DELETE FROM watched_channels WHERE channel_id = ?"), channelId)
+	return execError
+}
+
+func (r *SQLRepository) SeedChannels(channelIds ...string) error {
+	tx, beginError := r.Database.BeginTx(r.Context, nil)
+	if beginError != nil {
+		return beginError
+	}
+	defer tx.Rollback()
+
+	result, markError := tx.ExecContext(r.Context, r.dialect.rebind("INSERT INTO repository_markers (name) VALUES (?) ON CONFLICT DO NOTHING"), channelsSeededMarker)
+	if markError != nil {
+		return markError
+	}
+	marked, affectedError := result.RowsAffected()
+	if affectedError != nil {
+		return affectedError
+	}
+	// Databases recording channels before the marker existed have already been seeded
+	var recorded int
+	if countError := tx.QueryRowContext(r.Context, "SELECT COUNT(*) FROM watched_channels").Scan(&recorded); countError != nil {
+		return countError
+	}
+	if marked == 1 && recorded == 0 {
+		for _, channelId := range channelIds {
+			if _, watchError := tx.ExecContext(r.Context, r.dialect.rebind("INSERT INTO watched_channels (channel_id) VALUES (?) ON CONFLICT DO NOTHING"), channelId); watchError != nil {
+				return watchError
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// "?, ?, ?" for n = 3
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
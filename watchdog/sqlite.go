@@ -3,228 +3,87 @@ package watchdog
 import (
 	"context"
 	"database/sql"
-	"time"
+	"fmt"
 
-	"enssat.tv/autovodsaver/constants"
-	"enssat.tv/autovodsaver/queue"
-	"enssat.tv/autovodsaver/twitch"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/rs/zerolog"
 )
 
-const (
-	refreshInterval                  = 15
-	createVideosStatusTableStatement = `
-		CREATE TABLE IF NOT EXISTS videos_status (
-			id VARCHAR(50) NOT NULL PRIMARY KEY,
-			title VARCHAR(255) NOT NULL,
-			description TEXT NOT NULL,
-			published_at DATETIME NOT NULL,
-			duration INTEGER NOT NULL,
-			status VARCHAR(50) NOT NULL
-		);
-	`
-)
+const createSQLiteVideosStatusTableStatement = `
+	CREATE TABLE IF NOT EXISTS videos_status (
+		id VARCHAR(50) NOT NULL PRIMARY KEY,
+		title VARCHAR(255) NOT NULL,
+		description TEXT NOT NULL,
+		published_at DATETIME NOT NULL,
+		duration INTEGER NOT NULL,
+		status VARCHAR(50) NOT NULL,
+		lost_at DATETIME,
+		channel_id VARCHAR(50) NOT NULL DEFAULT '',
+		leased_by VARCHAR(100),
+		lease_expires_at DATETIME
+	);
+`
+
+func NewSQLiteRepository(dataSource string) *SQLRepository {
+	return NewSQLiteRepositoryWithContext(context.Background(), dataSource)
+}
 
-type SQLiteWatchdog struct {
-	Watchdog
-	Database         *sql.DB
-	DatabaseFilePath string
+func NewSQLiteRepositoryWithContext(ctx context.Context, dataSource string) *SQLRepository {
+	return newSQLRepository(ctx, sqliteDialect{}, dataSource)
 }
 
-func NewSQLiteWatchdog(channelId string) *SQLiteWatchdog {
+// Watchdog keeping the videos in the local SQLite database
+func NewSQLiteWatchdog(channelId string) *Watchdog {
 	return NewSQLiteWatchdogWithContext(context.Background(), channelId)
 }
 
-func NewSQLiteWatchdogWithContext(ctx context.Context, channelId string) *SQLiteWatchdog {
-	ch := make(chan UpdateMessage, 100)
-	return &SQLiteWatchdog{
-		DatabaseFilePath: "./db.sqlite",
-		Watchdog: Watchdog{
-			Context:              ctx,
-			Status:               WatchdogStatusStop,
-			ChannelId:            channelId,
-			OnVideoUpdateChannel: &ch,
-			Queues: struct{ DownloadQueue *queue.FifoQueue }{
-				DownloadQueue: queue.NewFifo(),
-			},
-		},
-	}
+func NewSQLiteWatchdogWithContext(ctx context.Context, channelId string) *Watchdog {
+	return NewWatchdogWithContext(ctx, channelId, NewSQLiteRepositoryWithContext(ctx, "./db.sqlite"))
 }
 
-func (wd *SQLiteWatchdog) Run() error {
-	// Open connection to the database
-	db, openDatabaseError := sql.Open("sqlite3", wd.DatabaseFilePath)
-	if openDatabaseError != nil {
-		return openDatabaseError
-	}
+type sqliteDialect struct{}
 
-	// Create table "videos_status"
-	_, createVideoTableError := db.Exec(createVideosStatusTableStatement)
-	if createVideoTableError != nil {
-		return createVideoTableError
-	}
-
-	wd.Status = WatchdogStatusRun
-	wd.Database = db
-	go wd.watchdogTwitchVideos()
-	go wd.watchdogDownloadQueue()
-	return nil
+func (sqliteDialect) driverName() string {
+	return "sqlite3"
 }
 
-func (wd *SQLiteWatchdog) Stop() error {
-	wd.Status = WatchdogStatusStop
-	if closeError := wd.Database.Close(); closeError != nil {
-		return closeError
-	}
-	if wd.OnVideoUpdateChannel != nil {
-		close(*wd.OnVideoUpdateChannel)
-	}
-	return nil
+func (sqliteDialect) schema() []string {
+	return []string{createSQLiteVideosStatusTableStatement, createWatchedChannelsTableStatement, createRepositoryMarkersTableStatement}
 }
 
-func (wd *SQLiteWatchdog) watchdogTwitchVideos() {
-	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
-
-	go func() {
-		for msg := range *wd.OnVideoUpdateChannel {
-			if msg.Status == constants.VideoStatusMissing {
-				wd.updateVideoStatus(msg.Video, constants.VideoStatusQueued)
-				wd.Queues.DownloadQueue.Enqueue(&msg.VideoWatched)
-				logger.Info().Msgf("video %s added to download queue (size: %d)", msg.Id, wd.Queues.DownloadQueue.Size())
-			}
-		}
-	}()
-
-	for wd.Status == WatchdogStatusRun {
-		logger.Info().Msgf("synchronizing videos from twitch channel %s", wd.ChannelId)
-		if errSyncVideos := wd.syncVideos(); errSyncVideos != nil {
-			logger.Error().Msg(errSyncVideos.Error())
-		}
-		time.Sleep(refreshInterval * time.Second)
-	}
+func (sqliteDialect) timestampType() string {
+	return "DATETIME"
 }
 
-func (wd *SQLiteWatchdog) watchdogDownloadQueue() {
-	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
-	for video := wd.Queues.DownloadQueue.Dequeue(); true; {
-		logger.Info().Msgf("video %s is being downloaded", video.Id)
-		if downloadError := video.Download(video.Id); downloadError != nil {
-			logger.Error().Msg(downloadError.Error())
-			video.Status = constants.VideoStatusExpired
-			wd.updateVideoStatus(video.Video, constants.VideoStatusExpired)
-			continue
-		}
-		video.Status = constants.VideoStatusDownloaded
-		wd.updateVideoStatus(video.Video, constants.VideoStatusDownloaded)
-		logger.Info().Msgf("video %s has been downloaded", video.Id)
+func (sqliteDialect) ensureColumn(db *sql.DB, table string, column string, definition string) error {
+	rows, queryError := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if queryError != nil {
+		return queryError
 	}
-}
-
-func (wd *SQLiteWatchdog) syncVideos() error {
-	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
-	// List available vods
-	vods := twitch.GetVideos(wd.ChannelId)
-	logger.Debug().Msgf("found %d vods for the channel %s", len(vods), wd.ChannelId)
-
-	// Get vods from local database
-	dbVods, errGetVideos := wd.getVideos()
-	if errGetVideos != nil {
-		return errGetVideos
-	}
-
-	// Update database with missing vods
-	for _, vod := range vods {
-		// Search for the vod in local database
-		exist := false
-		for _, dbVod := range dbVods {
-			if vod.Id == dbVod.Id {
-				exist = true
-				*wd.OnVideoUpdateChannel <- UpdateMessage{
-					VideoWatched: dbVod,
-				}
-				continue
-			}
-		}
-		// If the vod exists skip
-		if exist {
-			continue
+	found := false
+	for rows.Next() {
+		var name string
+		if scanError := rows.Scan(&name); scanError != nil {
+			rows.Close()
+			return scanError
 		}
-		// Else insert into the local database
-		if addVideoError := wd.addVideo(vod); addVideoError != nil {
-			logger.Error().Msg(addVideoError.Error())
-			continue
+		if name == column {
+			found = true
 		}
-		logger.Debug().Msgf("add vod %s to database", vod.Id)
 	}
-	return nil
-}
-
-func (wd *SQLiteWatchdog) getVideos() ([]constants.VideoWatched, error) {
-	rows, execError := wd.Database.QueryContext(wd.Context, "SELECT * FROM videos_status")
-	if execError != nil {
-		return nil, execError
-	}
-	defer rows.Close()
-
-	videos := make([]constants.VideoWatched, 0)
-	for rows.Next() {
-		var (
-			id           string
-			title        string
-			description  string
-			published_at time.Time
-			duration     uint
-			status       constants.VideoStatus
-		)
-		rows.Scan(&id, &title, &description, &published_at, &duration, &status)
-		videos = append(videos, constants.VideoWatched{
-			Status: status,
-			Video: twitch.Video{
-				Context:       wd.Context,
-				Id:            id,
-				Title:         title,
-				Description:   description,
-				PublishedAt:   published_at,
-				LengthSeconds: duration,
-			},
-		})
+	rows.Close()
+	if found {
+		return nil
 	}
-
-	return videos, nil
+	_, alterError := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return alterError
 }
 
-func (wd *SQLiteWatchdog) addVideo(video twitch.Video) error {
-	stmt, prepareError := wd.Database.PrepareContext(wd.Context, "INSERT INTO videos_status VALUES(?, ?, ?, ?, ?, ?)")
-	if prepareError != nil {
-		return prepareError
-	}
-	if _, execError := stmt.ExecContext(wd.Context, video.Id, video.Title, video.Description, video.PublishedAt, video.LengthSeconds, constants.VideoStatusMissing); execError != nil {
-		return execError
-	}
-	*wd.OnVideoUpdateChannel <- UpdateMessage{
-		VideoWatched: constants.VideoWatched{
-			Video:  video,
-			Status: constants.VideoStatusMissing,
-		},
-	}
-	return nil
+func (sqliteDialect) rebind(query string) string {
+	return query
 }
 
-func (wd *SQLiteWatchdog) updateVideoStatus(video twitch.Video, newStatus constants.VideoStatus) error {
-	// TODO: Cringe function, it should take an watchedVideo in parameter and change the instance status to avoid doing two things separatly
-	stmt, prepareError := wd.Database.PrepareContext(wd.Context, "UPDATE videos_status SET status = ? WHERE id = ?")
-	if prepareError != nil {
-		return prepareError
-	}
-	if _, execError := stmt.ExecContext(wd.Context, newStatus, video.Id); execError != nil {
-		return execError
-	}
-	*wd.OnVideoUpdateChannel <- UpdateMessage{
-		VideoWatched: constants.VideoWatched{
-			Video:  video,
-			Status: newStatus,
-		},
-	}
-	return nil
+// SQLite serializes writes, a conditional update is enough to lease a video
+func (sqliteDialect) leaseStatement() string {
+	return `UPDATE videos_status SET leased_by = ?, lease_expires_at = ?
+		WHERE id = ? AND status = ? AND (leased_by IS NULL OR leased_by = ? OR lease_expires_at < ?)`
 }
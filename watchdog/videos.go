@@ -0,0 +1,259 @@
+package watchdog
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/metrics"
+	"enssat.tv/autovodsaver/twitch"
+	"github.com/rs/zerolog"
+)
+
+// Synchronize the videos of the channel once, without starting the watchdog
+func (wd *Watchdog) Reconcile() error {
+	return wd.syncVideos()
+}
+
+// Enqueue the videos that are queued in the repository but not in memory, like the ones queued by a previous run
+// or by the command line, missing videos are also queued when includeMissing is set
+func (wd *Watchdog) restoreQueue(includeMissing bool) error {
+	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	statuses := []constants.VideoStatus{constants.VideoStatusQueued}
+	if includeMissing {
+		statuses = append(statuses, constants.VideoStatusMissing)
+	}
+	videos, getVideosError := wd.Repository.VideosWithStatus(wd.ChannelId, statuses...)
+	if getVideosError != nil {
+		return getVideosError
+	}
+	for _, video := range videos {
+		if wd.Queues.DownloadQueue.Contains(video.Id) || wd.isDownloading(video.Id) {
+			continue
+		}
+		if video.Status == constants.VideoStatusMissing {
+			if updateError := wd.updateVideoStatus(video.Video, constants.VideoStatusQueued, constants.VideoStatusMissing); updateError != nil {
+				logger.Error().Msg(updateError.Error())
+				continue
+			}
+			video.Status = constants.VideoStatusQueued
+		}
+		wd.Queues.DownloadQueue.Enqueue(&video)
+		logger.Info().Msgf("video %s restored in download queue", video.Id)
+	}
+	return nil
+}
+
+func (wd *Watchdog) syncVideos() error {
+	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+	start := time.Now()
+	defer func() {
+		metrics.SyncDuration.Observe(time.Since(start).Seconds(), wd.ChannelId)
+	}()
+	// List available vods, Stop cancels an in-flight poll
+	ctx := wd.Context
+	if wd.runContext != nil {
+		ctx = wd.runContext
+	}
+	vods, listError := wd.Twitch.GetVideos(ctx, wd.ChannelId)
+	if listError != nil {
+		metrics.Syncs.Inc(wd.ChannelId, "error")
+		return fmt.Errorf("videos of channel %s could not be listed: %w", wd.ChannelId, listError)
+	}
+	logger.Debug().Msgf("found %d vods for the channel %s", len(vods), wd.ChannelId)
+
+	// Get vods from the repository
+	dbVods, errGetVideos := wd.getVideos()
+	if errGetVideos != nil {
+		metrics.Syncs.Inc(wd.ChannelId, "error")
+		return errGetVideos
+	}
+
+	diff := diffVideos(vods, dbVods)
+	metrics.Syncs.Inc(wd.ChannelId, "success")
+	metrics.VideosDiscovered.Add(float64(len(diff.Added)), wd.ChannelId)
+
+	// Insert new vods into the repository and queue them
+	for _, vod := range diff.Added {
+		if addVideoError := wd.addVideo(vod); addVideoError != nil {
+			logger.Error().Msg(addVideoError.Error())
+			continue
+		}
+		logger.Debug().Msgf("add vod %s to database", vod.Id)
+		if _, queueError := wd.queueVideo(constants.VideoWatched{Video: vod, ChannelId: wd.ChannelId, Status: constants.VideoStatusMissing}); queueError != nil {
+			logger.Error().Msg(queueError.Error())
+			continue
+		}
+		logger.Info().Msgf("video %s added to download queue (size: %d)", vod.Id, wd.Queues.DownloadQueue.Size())
+	}
+
+	// Refresh the metadata of vods that changed since the last poll
+	for _, vod := range diff.Changed {
+		if updateVideoError := wd.updateVideo(vod); updateVideoError != nil {
+			logger.Error().Msg(updateVideoError.Error())
+			continue
+		}
+		logger.Debug().Msgf("vod %s updated (title: %s, duration: %d)", vod.Id, vod.Title, vod.LengthSeconds)
+
+		// A growing vod belongs to a live stream, wait for it to end before downloading it. An edited title or
+		// description does not postpone the download, a playlist without end is caught by the download itself.
+		if diff.Grown[vod.Id] && (vod.Status == constants.VideoStatusMissing || vod.Status == constants.VideoStatusQueued) {
+			if updateError := wd.updateVideoStatus(vod.Video, constants.VideoStatusRecording, constants.VideoStatusMissing, constants.VideoStatusQueued); updateError != nil {
+				logger.Error().Msg(updateError.Error())
+				continue
+			}
+			logger.Info().Msgf("vod %s is still being recorded, download postponed", vod.Id)
+		}
+	}
+
+	// A recording vod whose length stopped changing may have ended, check its playlist again
+	for _, vod := range diff.Stable {
+		if vod.Status != constants.VideoStatusRecording {
+			continue
+		}
+		if updateError := wd.updateVideoStatus(vod.Video, constants.VideoStatusQueued, constants.VideoStatusRecording); updateError != nil {
+			logger.Error().Msg(updateError.Error())
+			continue
+		}
+		vod.Status = constants.VideoStatusQueued
+		wd.Queues.DownloadQueue.Enqueue(&vod)
+		logger.Info().Msgf("vod %s length is stable, added back to download queue", vod.Id)
+	}
+
+	// Report vods that are not listed anymore, once per run
+	for _, vod := range diff.Disappeared {
+		if wd.disappeared[vod.Id] {
+			continue
+		}
+		if isPending(vod.Status) {
+			// Lost videos are confirmed below
+			continue
+		}
+		wd.disappeared[vod.Id] = true
+		logger.Debug().Msgf("vod %s is no longer listed on twitch", vod.Id)
+		wd.publish(UpdateMessage{
+			VideoWatched: vod,
+			Kind:         UpdateKindDisappeared,
+		})
+	}
+
+	// A vod that is not listed, or older than the listed ones, is only lost once Twitch no longer knows it
+	for _, vod := range append(diff.Disappeared, diff.Unlisted...) {
+		if !isPending(vod.Status) {
+			continue
+		}
+		if _, checkError := wd.Twitch.GetVideo(ctx, vod.Id); !errors.Is(checkError, twitch.ErrVideoNotFound) {
+			if checkError != nil {
+				logger.Error().Msgf("vod %s could not be checked on twitch: %s", vod.Id, checkError.Error())
+			}
+			continue
+		}
+		logger.Debug().Msgf("vod %s is no longer available on twitch", vod.Id)
+		wd.publish(UpdateMessage{
+			VideoWatched: vod,
+			Kind:         UpdateKindDisappeared,
+		})
+
+		// The vod vanished before we could save it
+		if markLostError := wd.markVideoLost(vod.Video, time.Now()); markLostError != nil {
+			logger.Error().Msg(markLostError.Error())
+			continue
+		}
+		logger.Warn().Msgf("vod %s (%s) disappeared from twitch before being archived, %s after its publication", vod.Id, vod.Title, time.Since(vod.PublishedAt).Round(time.Minute))
+	}
+	return nil
+}
+
+// Whether the video still has to be downloaded, it is lost when it disappears from Twitch
+func isPending(status constants.VideoStatus) bool {
+	return status == constants.VideoStatusMissing || status == constants.VideoStatusQueued || status == constants.VideoStatusRecording
+}
+
+func (wd *Watchdog) getVideos() ([]constants.VideoWatched, error) {
+	return wd.ListVideos(VideoFilter{})
+}
+
+// List the videos of the watched channel matching the filter
+func (wd *Watchdog) ListVideos(filter VideoFilter) ([]constants.VideoWatched, error) {
+	filter.ChannelId = wd.ChannelId
+	return wd.Repository.ListVideos(filter)
+}
+
+func (wd *Watchdog) GetVideo(videoId string) (constants.VideoWatched, error) {
+	video, getVideoError := wd.Repository.GetVideo(videoId)
+	if getVideoError == nil && video.ChannelId != wd.ChannelId {
+		return constants.VideoWatched{}, ErrVideoNotFound
+	}
+	return video, getVideoError
+}
+
+// List the videos that disappeared from Twitch before being archived
+func (wd *Watchdog) GetLostVideos() ([]LostVideo, error) {
+	return wd.Repository.LostVideos(wd.ChannelId)
+}
+
+func (wd *Watchdog) addVideo(video twitch.Video) error {
+	watched := constants.VideoWatched{
+		Video:     video,
+		ChannelId: wd.ChannelId,
+		Status:    constants.VideoStatusMissing,
+	}
+	if upsertError := wd.Repository.UpsertVideo(watched); upsertError != nil {
+		return upsertError
+	}
+	wd.publish(UpdateMessage{
+		VideoWatched: watched,
+		Kind:         UpdateKindAdded,
+	})
+	return nil
+}
+
+func (wd *Watchdog) updateVideo(video constants.VideoWatched) error {
+	if upsertError := wd.Repository.UpsertVideo(video); upsertError != nil {
+		return upsertError
+	}
+	wd.publish(UpdateMessage{
+		VideoWatched: video,
+		Kind:         UpdateKindChanged,
+	})
+	return nil
+}
+
+// Change the status of the video when its current status is one of from, or whatever its status when from is empty
+func (wd *Watchdog) updateVideoStatus(video twitch.Video, newStatus constants.VideoStatus, from ...constants.VideoStatus) error {
+	if transitionError := wd.Repository.TransitionStatus(video.Id, newStatus, from...); transitionError != nil {
+		return transitionError
+	}
+	switch newStatus {
+	case constants.VideoStatusArchived, constants.VideoStatusDownloaded, constants.VideoStatusCancelled:
+		// Not queued again unless retried, which starts without bumps
+		wd.Scheduling.Forget(video.Id)
+	}
+	wd.publish(UpdateMessage{
+		VideoWatched: constants.VideoWatched{
+			Video:     video,
+			ChannelId: wd.ChannelId,
+			Status:    newStatus,
+		},
+		Kind: UpdateKindStatus,
+	})
+	return nil
+}
+
+func (wd *Watchdog) markVideoLost(video twitch.Video, lostAt time.Time) error {
+	if markLostError := wd.Repository.MarkLost(video.Id, lostAt); markLostError != nil {
+		return markLostError
+	}
+	wd.Scheduling.Forget(video.Id)
+	wd.publish(UpdateMessage{
+		VideoWatched: constants.VideoWatched{
+			Video:     video,
+			ChannelId: wd.ChannelId,
+			Status:    constants.VideoStatusLost,
+		},
+		Kind: UpdateKindStatus,
+	})
+	return nil
+}
@@ -2,30 +2,539 @@ package watchdog
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/diskspace"
+	"enssat.tv/autovodsaver/events"
+	"enssat.tv/autovodsaver/health"
+	"enssat.tv/autovodsaver/metrics"
 	"enssat.tv/autovodsaver/queue"
+	"enssat.tv/autovodsaver/storage"
+	"enssat.tv/autovodsaver/twitch"
+	"github.com/rs/zerolog"
 )
 
 const (
 	WatchdogStatusRun  = "WATCHDOG_STATUS_RUN"
 	WatchdogStatusStop = "WATCHDOG_STATUS_STOP"
+
+	refreshInterval     = 15
+	defaultDrainTimeout = 30 * time.Second
+	maxSyncAge          = 4 * refreshInterval * time.Second
+	leaseDuration       = 10 * time.Minute
 )
 
+// Host and process holding the download leases taken by this instance
+var instanceId = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}()
+
 type WatchdogStatus string
 
 type Watchdog struct {
-	Context              context.Context
-	Status               WatchdogStatus
-	ChannelId            string
-	OnVideoUpdateChannel *chan UpdateMessage
-	Queues               struct {
-		DownloadQueue *queue.FifoQueue
+	Context    context.Context
+	ChannelId  string
+	Repository VideoRepository
+	Twitch     *twitch.Client
+	Events     *events.Bus[UpdateMessage] // Every update of the watchdog, can be shared between watchdogs
+	Scheduling *SchedulingPolicy          // Can be shared between watchdogs, along with Slots
+	// Shared between watchdogs to bound the downloads running at once, the most urgent video of any channel
+	// is downloaded first, each watchdog downloads one video at a time regardless when nil
+	Slots        *DownloadSlots
+	DrainTimeout time.Duration // How long Stop waits for an in-flight download before cancelling it
+	// Videos are uploaded to the storage while they are downloaded when set, without a local copy,
+	// they are downloaded to a local file otherwise
+	Storage      storage.StreamStorager
+	StreamWindow int // Chunks downloaded ahead when streaming, twitch.DefaultStreamWindow when zero
+	// Downloads are paused while the work directory or the output directory has less bytes available, never when zero
+	MinFreeSpace       uint64
+	SpaceCheckInterval time.Duration // How often the free space is checked while paused
+	Queues             struct {
+		DownloadQueue *queue.PriorityQueue
 	}
+
+	status      atomic.Value    // WatchdogStatus, read while the watchdog starts and stops
+	runContext  context.Context // Cancelled when the watchdog stops polling and dequeuing
+	cancelRun   context.CancelFunc
+	workContext context.Context // Cancelled when in-flight downloads must be aborted
+	cancelWork  context.CancelFunc
+	workers     *sync.WaitGroup
+	inFlightMu  *sync.Mutex
+	inFlight    map[string]context.CancelFunc // Cancel functions of the downloads in progress
+	healthMu    *sync.Mutex
+	alive       map[string]bool      // Whether each worker goroutine is still running
+	heartbeats  map[string]time.Time // Last time each worker reported progress
+	lastSync    time.Time            // Last successful synchronization with Twitch
+	syncError   error                // Error of the last synchronization, nil when it succeeded
+	disappeared map[string]bool      // Videos already reported as no longer listed
 }
 
+func NewWatchdog(channelId string, repository VideoRepository) *Watchdog {
+	return NewWatchdogWithContext(context.Background(), channelId, repository)
+}
+
+func NewWatchdogWithContext(ctx context.Context, channelId string, repository VideoRepository) *Watchdog {
+	wd := &Watchdog{
+		Context:     ctx,
+		ChannelId:   channelId,
+		Repository:  repository,
+		Twitch:      twitch.DefaultClient,
+		Events:      events.NewBus[UpdateMessage](),
+		Scheduling:  NewSchedulingPolicy(defaultRetention),
+		disappeared: make(map[string]bool),
+	}
+	wd.Queues.DownloadQueue = queue.NewPriority(wd.scoreVideo)
+	return wd
+}
+
+const (
+	UpdateKindAdded       = "UPDATE_KIND_ADDED"       // A new video has been discovered
+	UpdateKindChanged     = "UPDATE_KIND_CHANGED"     // The metadata of a known video changed
+	UpdateKindDisappeared = "UPDATE_KIND_DISAPPEARED" // A known video is no longer listed by Twitch
+	UpdateKindStatus      = "UPDATE_KIND_STATUS"      // The status of a video changed
+)
+
+type UpdateKind string
+
 type UpdateMessage struct {
 	constants.VideoWatched
+	Kind UpdateKind
+}
+
+// Move a video ahead in the download queue, negative levels move it back
+func (wd *Watchdog) BumpPriority(videoId string, levels int) (constants.VideoWatched, error) {
+	video, getVideoError := wd.GetVideo(videoId)
+	if getVideoError != nil {
+		return constants.VideoWatched{}, getVideoError
+	}
+	wd.Scheduling.Bump(videoId, levels)
+	wd.Queues.DownloadQueue.Reprioritize()
+	return video, nil
+}
+
+func (wd *Watchdog) scoreVideo(video *constants.VideoWatched) float64 {
+	return wd.Scheduling.Score(wd.ChannelId, video)
+}
+
+func (wd *Watchdog) start() {
+	wd.runContext, wd.cancelRun = context.WithCancel(wd.Context)
+	wd.workContext, wd.cancelWork = context.WithCancel(wd.Context)
+	wd.workers = &sync.WaitGroup{}
+	wd.inFlightMu = &sync.Mutex{}
+	wd.inFlight = make(map[string]context.CancelFunc)
+	wd.healthMu = &sync.Mutex{}
+	wd.alive = make(map[string]bool)
+	wd.heartbeats = make(map[string]time.Time)
+	wd.status.Store(WatchdogStatus(WatchdogStatusRun))
+}
+
+// Whether the watchdog is running or stopped
+func (wd *Watchdog) Status() WatchdogStatus {
+	if status, stored := wd.status.Load().(WatchdogStatus); stored {
+		return status
+	}
+	return WatchdogStatusStop
+}
+
+func (wd *Watchdog) trackDownload(videoId string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(wd.workContext)
+	wd.inFlightMu.Lock()
+	wd.inFlight[videoId] = cancel
+	wd.inFlightMu.Unlock()
+	return ctx, cancel
+}
+
+func (wd *Watchdog) untrackDownload(videoId string, cancel context.CancelFunc) {
+	wd.inFlightMu.Lock()
+	delete(wd.inFlight, videoId)
+	wd.inFlightMu.Unlock()
+	cancel()
+}
+
+func (wd *Watchdog) isDownloading(videoId string) bool {
+	if wd.inFlightMu == nil {
+		// Never started
+		return false
+	}
+	wd.inFlightMu.Lock()
+	_, found := wd.inFlight[videoId]
+	wd.inFlightMu.Unlock()
+	return found
+}
+
+// Abort the download of the video if it is in progress, reports whether a download was cancelled
+func (wd *Watchdog) cancelDownload(videoId string) bool {
+	if wd.inFlightMu == nil {
+		// Never started
+		return false
+	}
+	wd.inFlightMu.Lock()
+	cancel, found := wd.inFlight[videoId]
+	wd.inFlightMu.Unlock()
+	if found {
+		cancel()
+	}
+	return found
+}
+
+func (wd *Watchdog) spawn(name string, worker func()) {
+	wd.workers.Add(1)
+	wd.healthMu.Lock()
+	wd.alive[name] = true
+	wd.heartbeats[name] = time.Now()
+	wd.healthMu.Unlock()
+	go func() {
+		defer wd.workers.Done()
+		defer func() {
+			wd.healthMu.Lock()
+			wd.alive[name] = false
+			wd.healthMu.Unlock()
+		}()
+		worker()
+	}()
+}
+
+func (wd *Watchdog) heartbeat(name string) {
+	wd.healthMu.Lock()
+	wd.heartbeats[name] = time.Now()
+	wd.healthMu.Unlock()
+}
+
+// Record the outcome of a synchronization for the readiness probe
+func (wd *Watchdog) syncDone(syncError error) {
+	wd.healthMu.Lock()
+	if syncError == nil {
+		wd.lastSync = time.Now()
+	}
+	wd.syncError = syncError
+	wd.healthMu.Unlock()
+}
+
+// Fails when a worker goroutine exited while the watchdog is running
+func (wd *Watchdog) probeWorkers(_ context.Context) error {
+	if wd.Status() != WatchdogStatusRun {
+		return fmt.Errorf("watchdog is stopped")
+	}
+	wd.healthMu.Lock()
+	defer wd.healthMu.Unlock()
+	for name, alive := range wd.alive {
+		if !alive {
+			return fmt.Errorf("worker %s is not running (last heartbeat %s)", name, wd.heartbeats[name].Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Fails when Twitch has not been synchronized for a while
+func (wd *Watchdog) probeSync(_ context.Context) error {
+	wd.healthMu.Lock()
+	defer wd.healthMu.Unlock()
+	if wd.lastSync.IsZero() {
+		if wd.syncError != nil {
+			return fmt.Errorf("twitch has not been synchronized yet, last attempt failed: %w", wd.syncError)
+		}
+		return fmt.Errorf("twitch has not been synchronized yet")
+	}
+	if since := time.Since(wd.lastSync); since > maxSyncAge {
+		if wd.syncError != nil {
+			return fmt.Errorf("last successful twitch synchronization %s ago, last attempt failed: %w", since.Round(time.Second), wd.syncError)
+		}
+		return fmt.Errorf("last successful twitch synchronization %s ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+// Stop accepting new work, then give in-flight downloads DrainTimeout to finish before cancelling them, a cancelled
+// download stays queued and is downloaded again from scratch on next start
+func (wd *Watchdog) drain() {
+	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	wd.status.Store(WatchdogStatus(WatchdogStatusStop))
+	if wd.cancelRun == nil {
+		// Never started
+		return
+	}
+	wd.cancelRun()
+	wd.Queues.DownloadQueue.Close()
+
+	done := make(chan struct{})
+	go func() {
+		wd.workers.Wait()
+		close(done)
+	}()
+
+	drainTimeout := wd.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		logger.Warn().Msgf("in-flight work did not finish within %s, cancelling it", drainTimeout)
+		wd.cancelWork()
+		<-done
+	}
+	wd.cancelWork()
+}
+
+func (wd *Watchdog) publish(msg UpdateMessage) {
+	wd.Events.Publish(msg)
+}
+
+func (wd *Watchdog) acquireSlot(video *constants.VideoWatched) (func(), error) {
+	if wd.Slots == nil {
+		return func() {}, nil
+	}
+	return wd.Slots.Acquire(wd.runContext, wd.scoreVideo(video))
+}
+
+// Open the repository, without starting the watchdog
+func (wd *Watchdog) Open() error {
+	return wd.Repository.Open()
+}
+
+func (wd *Watchdog) Close() error {
+	return wd.Repository.Close()
+}
+
+func (wd *Watchdog) Run() error {
+	if openError := wd.Open(); openError != nil {
+		return openError
+	}
+
+	if claimError := wd.ClaimOrphanVideos(); claimError != nil {
+		return claimError
+	}
+
+	wd.start()
+	metrics.QueueDepth.Set(func() float64 {
+		return float64(wd.Queues.DownloadQueue.Size())
+	}, wd.ChannelId)
+	wd.spawn("poller", wd.watchdogTwitchVideos)
+	wd.spawn("downloader", wd.watchdogDownloadQueue)
+	return nil
+}
+
+func (wd *Watchdog) Stop() error {
+	wd.drain()
+	metrics.QueueDepth.Delete(wd.ChannelId)
+	return wd.Close()
+}
+
+// Rows written before channels were recorded belong to the channel the database was used for
+func (wd *Watchdog) ClaimOrphanVideos() error {
+	return wd.Repository.ClaimOrphanVideos(wd.ChannelId)
+}
+
+func (wd *Watchdog) watchdogTwitchVideos() {
+	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	// Queue again the videos that were pending when the watchdog was last stopped, an interrupted download restarts
+	// from its first chunk
+	if restoreError := wd.restoreQueue(true); restoreError != nil {
+		logger.Error().Msg(restoreError.Error())
+	}
+
+	ticker := time.NewTicker(refreshInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		logger.Info().Msgf("synchronizing videos from twitch channel %s", wd.ChannelId)
+		errSyncVideos := wd.syncVideos()
+		if errSyncVideos != nil {
+			logger.Error().Msg(errSyncVideos.Error())
+		}
+		wd.syncDone(errSyncVideos)
+		for _, stats := range wd.Twitch.LimiterStats() {
+			logger.Debug().Msgf("twitch rate limit %s", stats)
+		}
+		// Pick up the videos queued from outside, like the command line
+		if restoreError := wd.restoreQueue(false); restoreError != nil {
+			logger.Error().Msg(restoreError.Error())
+		}
+		wd.heartbeat("poller")
+		select {
+		case <-wd.runContext.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (wd *Watchdog) watchdogDownloadQueue() {
+	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+	for {
+		video := wd.Queues.DownloadQueue.Dequeue()
+		if video == nil {
+			// The queue has been closed
+			return
+		}
+		wd.heartbeat("downloader")
+		// The video may have been lost while waiting in the queue
+		current, getVideoError := wd.GetVideo(video.Id)
+		if getVideoError != nil {
+			logger.Error().Msg(getVideoError.Error())
+			continue
+		}
+		if current.Status != constants.VideoStatusQueued {
+			logger.Info().Msgf("video %s skipped, its status is now %s", video.Id, current.Status)
+			continue
+		}
+		// The video stays queued in the repository when the watchdog stops while paused
+		if !wd.waitForSpace() {
+			return
+		}
+		// Or while waiting for the videos of other channels that expire sooner
+		releaseSlot, slotError := wd.acquireSlot(video)
+		if slotError != nil {
+			return
+		}
+		// Another instance sharing the repository may already be downloading it
+		leased, leaseError := wd.Repository.LeaseVideo(video.Id, instanceId, time.Now().Add(leaseDuration))
+		if leaseError != nil {
+			releaseSlot()
+			logger.Error().Msg(leaseError.Error())
+			continue
+		}
+		if !leased {
+			releaseSlot()
+			logger.Info().Msgf("video %s skipped, it is being downloaded by another instance", video.Id)
+			continue
+		}
+		logger.Info().Msgf("video %s is being downloaded", video.Id)
+		downloadContext, cancelDownload := wd.trackDownload(video.Id)
+		stopRenewal := wd.renewLease(downloadContext, video.Id)
+		video.Context = downloadContext
+		video.Client = wd.Twitch
+		downloadError := wd.download(video)
+		releaseSlot()
+		stopRenewal()
+		// Untracking cancels the download context, tell a requested cancellation apart before
+		cancelled := downloadContext.Err() != nil
+		wd.untrackDownload(video.Id, cancelDownload)
+		if downloadError != nil {
+			if wd.workContext.Err() != nil {
+				// Shutdown interrupted the download, keep it queued for the next run where it starts over, the chunks
+				// already downloaded are not kept
+				logger.Warn().Msgf("download of video %s interrupted, it will be downloaded again on next start", video.Id)
+				metrics.Downloads.Inc("interrupted")
+				wd.finishDownload(video, constants.VideoStatusQueued)
+				return
+			}
+			if cancelled {
+				// Cancelled on request, the status has already been updated
+				logger.Info().Msgf("download of video %s cancelled", video.Id)
+				metrics.Downloads.Inc("cancelled")
+				continue
+			}
+			if errors.Is(downloadError, twitch.ErrVideoInProgress) {
+				// Checked again once its length stops changing
+				logger.Info().Msgf("video %s belongs to an ongoing stream, download postponed", video.Id)
+				metrics.Downloads.Inc("postponed")
+				wd.finishDownload(video, constants.VideoStatusRecording)
+				continue
+			}
+			if errors.Is(downloadError, diskspace.ErrInsufficientSpace) {
+				// Queued again on the next synchronization, once space has been freed
+				logger.Warn().Msgf("video %s postponed: %s", video.Id, downloadError.Error())
+				metrics.Downloads.Inc("no_space")
+				wd.finishDownload(video, constants.VideoStatusQueued)
+				continue
+			}
+			if errors.Is(downloadError, twitch.ErrVideoRestricted) {
+				// Retried once the token of a subscriber is configured
+				logger.Warn().Msgf("video %s is restricted to subscribers, configure the oauth token of a subscriber of %s then retry it", video.Id, wd.ChannelId)
+				metrics.Downloads.Inc("restricted")
+				wd.finishDownload(video, constants.VideoStatusRestricted)
+				continue
+			}
+			logger.Error().Msg(downloadError.Error())
+			metrics.Downloads.Inc("failed")
+			wd.finishDownload(video, constants.VideoStatusExpired)
+			continue
+		}
+		metrics.Downloads.Inc("success")
+		if checksumError := wd.Repository.SetChecksum(video.Id, video.Checksum); checksumError != nil {
+			logger.Error().Msgf("checksum of video %s could not be recorded: %s", video.Id, checksumError.Error())
+		}
+		if wd.Storage != nil {
+			logger.Info().Msgf("video %s has been streamed to the storage (sha256 %s)", video.Id, video.Checksum)
+			wd.finishDownload(video, constants.VideoStatusArchived)
+			continue
+		}
+		logger.Info().Msgf("video %s has been downloaded (sha256 %s)", video.Id, video.Checksum)
+		wd.finishDownload(video, constants.VideoStatusDownloaded)
+	}
+}
+
+// Record the outcome of a download, only when the video is still queued as it was while being downloaded: a video
+// cancelled or changed in the meantime keeps the status given to it
+func (wd *Watchdog) finishDownload(video *constants.VideoWatched, status constants.VideoStatus) {
+	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	updateError := wd.updateVideoStatus(video.Video, status, constants.VideoStatusQueued)
+	if errors.Is(updateError, ErrInvalidTransition) {
+		logger.Warn().Msgf("video %s not moved to %s, its status changed during the download: %s", video.Id, status, updateError.Error())
+		return
+	}
+	if updateError != nil {
+		logger.Error().Msgf("video %s could not be moved to %s: %s", video.Id, status, updateError.Error())
+		return
+	}
+	video.Status = status
+}
+
+// Download the video to a local file named after its id, or straight to the storage when streaming
+func (wd *Watchdog) download(video *constants.VideoWatched) error {
+	if wd.Storage == nil {
+		return video.Download(video.Id)
+	}
+	return wd.Storage.SaveStream(&video.Video, func(w io.Writer) error {
+		return video.Stream(w, wd.StreamWindow)
+	})
+}
+
+// Extend the lease of a video until the returned function is called
+func (wd *Watchdog) renewLease(ctx context.Context, videoId string) func() {
+	logger := wd.Context.Value(constants.LoggerKey).(*zerolog.Logger)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(leaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if renewError := wd.Repository.RenewLease(videoId, instanceId, time.Now().Add(leaseDuration)); renewError != nil {
+					logger.Error().Msgf("lease of video %s could not be renewed: %s", videoId, renewError.Error())
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (wd *Watchdog) HealthChecks() []health.Check {
+	prefix := "channel/" + wd.ChannelId + "/"
+	return []health.Check{
+		{Name: prefix + "workers", Kind: health.Liveness, Probe: wd.probeWorkers},
+		{Name: prefix + "database", Kind: health.Readiness, Probe: wd.Repository.Ping},
+		{Name: prefix + "twitch", Kind: health.Readiness, Probe: wd.probeSync},
+	}
 }
 
 type Watchdoger interface {
@@ -37,9 +546,15 @@ func New(kind string, channelId string) Watchdoger {
 	return NewWithContext(context.Background(), kind, channelId)
 }
 
+// For the "postgres" kind, the connection string is read from the AUTOVODSAVER_POSTGRES_URL environment variable
 func NewWithContext(ctx context.Context, kind string, channelId string) Watchdoger {
-	if kind == "sqlite" {
+	switch kind {
+	case "sqlite":
 		return NewSQLiteWatchdogWithContext(ctx, channelId)
+	case "postgres":
+		return NewPostgresWatchdogWithContext(ctx, os.Getenv("AUTOVODSAVER_POSTGRES_URL"), channelId)
+	case "memory":
+		return NewWatchdogWithContext(ctx, channelId, NewMemoryRepositoryWithContext(ctx))
 	}
 	return nil
 }
@@ -0,0 +1,460 @@
+package watchdog_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"enssat.tv/autovodsaver/constants"
+	"enssat.tv/autovodsaver/events"
+	"enssat.tv/autovodsaver/health"
+	"enssat.tv/autovodsaver/metrics"
+	"enssat.tv/autovodsaver/storage"
+	"enssat.tv/autovodsaver/storage/s3test"
+	"enssat.tv/autovodsaver/twitch"
+	"enssat.tv/autovodsaver/twitch/twitchtest"
+	"enssat.tv/autovodsaver/watchdog"
+	"github.com/rs/zerolog"
+)
+
+// Watchdog of the channel "channel" backed by the fake server and an in-memory repository, downloads are written
+// to a temporary working directory
+func newTestWatchdog(t *testing.T, server *twitchtest.Server) *watchdog.Watchdog {
+	t.Helper()
+	logger := zerolog.Nop()
+	ctx := context.WithValue(context.Background(), constants.LoggerKey, &logger)
+
+	workingDirectory, getwdError := os.Getwd()
+	if getwdError != nil {
+		t.Fatal(getwdError)
+	}
+	if chdirError := os.Chdir(t.TempDir()); chdirError != nil {
+		t.Fatal(chdirError)
+	}
+	t.Cleanup(func() {
+		os.Chdir(workingDirectory)
+	})
+
+	wd := watchdog.NewWatchdogWithContext(ctx, "channel", watchdog.NewMemoryRepositoryWithContext(ctx))
+	wd.Twitch = server.Client()
+	wd.DrainTimeout = time.Second
+	return wd
+}
+
+// Wait until every video has the expected status
+func waitForStatus(t *testing.T, wd *watchdog.Watchdog, expected map[string]constants.VideoStatus) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		done := true
+		for videoId, status := range expected {
+			video, getVideoError := wd.GetVideo(videoId)
+			if getVideoError != nil || video.Status != status {
+				done = false
+				if time.Now().After(deadline) {
+					t.Fatalf("video %s is %s (error %v), want %s", videoId, video.Status, getVideoError, status)
+				}
+			}
+		}
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchdogDownloadsNewVideos(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "1", Title: "first", PublishedAt: time.Now().Add(-2 * time.Hour)})
+	server.AddVideo("channel", twitchtest.Video{Id: "2", Title: "second", PublishedAt: time.Now().Add(-time.Hour)})
+	wd := newTestWatchdog(t, server)
+
+	if runError := wd.Run(); runError != nil {
+		t.Fatal(runError)
+	}
+	waitForStatus(t, wd, map[string]constants.VideoStatus{
+		"1": constants.VideoStatusDownloaded,
+		"2": constants.VideoStatusDownloaded,
+	})
+	if stopError := wd.Stop(); stopError != nil {
+		t.Fatal(stopError)
+	}
+
+	for _, videoId := range []string{"1", "2"} {
+		content, readError := os.ReadFile(videoId)
+		if readError != nil {
+			t.Errorf("video %s has not been written: %v", videoId, readError)
+			continue
+		}
+		// The checksum recorded for the archival is the one of the written file
+		video, getVideoError := wd.GetVideo(videoId)
+		if checksum := sha256.Sum256(content); getVideoError != nil || video.Checksum != hex.EncodeToString(checksum[:]) {
+			t.Errorf("recorded checksum of video %s = %q, %v, want %x", videoId, video.Checksum, getVideoError, checksum)
+		}
+	}
+}
+
+func TestWatchdogDownloadOutcomes(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "live", Live: true})
+	server.AddVideo("channel", twitchtest.Video{Id: "subscriber", SubscriberOnly: true})
+	server.AddVideo("channel", twitchtest.Video{Id: "truncated"})
+	server.Fail(twitchtest.SegmentPath("truncated", 0), twitchtest.Failure{Truncate: true})
+	wd := newTestWatchdog(t, server)
+
+	if runError := wd.Run(); runError != nil {
+		t.Fatal(runError)
+	}
+	defer wd.Stop()
+	waitForStatus(t, wd, map[string]constants.VideoStatus{
+		"live":       constants.VideoStatusRecording,
+		"subscriber": constants.VideoStatusRestricted,
+		"truncated":  constants.VideoStatusExpired,
+	})
+}
+
+func TestReconcileMarksDisappearedVideosLost(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "1"})
+	server.AddVideo("channel", twitchtest.Video{Id: "2"})
+	wd := newTestWatchdog(t, server)
+
+	if reconcileError := wd.Reconcile(); reconcileError != nil {
+		t.Fatal(reconcileError)
+	}
+	waitForStatus(t, wd, map[string]constants.VideoStatus{
+		"1": constants.VideoStatusQueued,
+		"2": constants.VideoStatusQueued,
+	})
+	if queued := wd.QueuedVideos(); len(queued) != 2 {
+		t.Errorf("%d videos queued, want 2", len(queued))
+	}
+
+	server.RemoveVideo("1")
+	if reconcileError := wd.Reconcile(); reconcileError != nil {
+		t.Fatal(reconcileError)
+	}
+	waitForStatus(t, wd, map[string]constants.VideoStatus{
+		"1": constants.VideoStatusLost,
+		"2": constants.VideoStatusQueued,
+	})
+	lost, lostError := wd.GetLostVideos()
+	if lostError != nil {
+		t.Fatal(lostError)
+	}
+	if len(lost) != 1 || lost[0].Id != "1" {
+		t.Errorf("GetLostVideos() = %v, want video 1", lost)
+	}
+}
+
+func TestEnqueueRetryCancel(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "1"})
+	server.AddVideo("other", twitchtest.Video{Id: "2"})
+	wd := newTestWatchdog(t, server)
+
+	// Only the videos of the channel of the watchdog can be queued
+	if _, enqueueError := wd.EnqueueVideo("2"); !errors.Is(enqueueError, watchdog.ErrForeignVideo) {
+		t.Errorf("EnqueueVideo() of a video of another channel error = %v, want ErrForeignVideo", enqueueError)
+	}
+	if _, getVideoError := wd.GetVideo("2"); !errors.Is(getVideoError, watchdog.ErrVideoNotFound) {
+		t.Errorf("GetVideo() error = %v after a rejected enqueue, want ErrVideoNotFound", getVideoError)
+	}
+
+	video, enqueueError := wd.EnqueueVideo("1")
+	if enqueueError != nil || video.Status != constants.VideoStatusQueued {
+		t.Fatalf("EnqueueVideo() = %s, %v, want a queued video", video.Status, enqueueError)
+	}
+	if _, retryError := wd.RetryVideo("1"); retryError == nil {
+		t.Error("RetryVideo() of a queued video succeeded, want an error")
+	}
+	if video, cancelError := wd.CancelVideo("1"); cancelError != nil || video.Status != constants.VideoStatusCancelled {
+		t.Fatalf("CancelVideo() = %s, %v, want a cancelled video", video.Status, cancelError)
+	}
+	if queued := wd.QueuedVideos(); len(queued) != 0 {
+		t.Errorf("%d videos queued after cancellation, want 0", len(queued))
+	}
+	if video, retryError := wd.RetryVideo("1"); retryError != nil || video.Status != constants.VideoStatusQueued {
+		t.Errorf("RetryVideo() = %s, %v, want a queued video", video.Status, retryError)
+	}
+	if _, enqueueError := wd.EnqueueVideo("404"); enqueueError == nil {
+		t.Error("EnqueueVideo() of an unknown video succeeded, want an error")
+	}
+}
+
+func TestWatchdogDownloadsSubscriberOnlyVideosWithToken(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.OAuthToken = "subscriber-token"
+	server.AddVideo("channel", twitchtest.Video{Id: "subscriber", SubscriberOnly: true})
+	wd := newTestWatchdog(t, server)
+	wd.Twitch = server.Client().WithOAuthToken("subscriber-token")
+
+	if runError := wd.Run(); runError != nil {
+		t.Fatal(runError)
+	}
+	defer wd.Stop()
+	waitForStatus(t, wd, map[string]constants.VideoStatus{
+		"subscriber": constants.VideoStatusDownloaded,
+	})
+}
+
+func TestWatchdogStreamsVideosToStorage(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	segments := [][]byte{twitchtest.TSSegment(0, 4), twitchtest.TSSegment(1, 4), twitchtest.TSSegment(2, 4)}
+	server.AddVideo("channel", twitchtest.Video{Id: "1", Title: "first", Segments: segments})
+	server.AddVideo("channel", twitchtest.Video{Id: "subscriber", SubscriberOnly: true})
+	s3Server := s3test.NewServer("videos")
+	defer s3Server.Close()
+	wd := newTestWatchdog(t, server)
+	store, newStorageError := storage.NewS3StorageWithContext(wd.Context, s3Server.URL, "eu-west", "videos", storage.Credentials{AccessKey: "access", SecretKey: "secret"})
+	if newStorageError != nil {
+		t.Fatal(newStorageError)
+	}
+	wd.Storage = store
+	wd.StreamWindow = 2
+
+	if runError := wd.Run(); runError != nil {
+		t.Fatal(runError)
+	}
+	waitForStatus(t, wd, map[string]constants.VideoStatus{
+		"1":          constants.VideoStatusArchived,
+		"subscriber": constants.VideoStatusRestricted,
+	})
+	if stopError := wd.Stop(); stopError != nil {
+		t.Fatal(stopError)
+	}
+
+	// The video only exists in the storage
+	if _, statError := os.Stat("1"); !os.IsNotExist(statError) {
+		t.Errorf("local copy of the streamed video exists (stat error %v)", statError)
+	}
+	keys := s3Server.Keys("videos")
+	if len(keys) != 1 {
+		t.Fatalf("stored objects = %v, want only the streamed video", keys)
+	}
+	object, _ := s3Server.Object("videos", keys[0])
+	if !bytes.Equal(object.Body, bytes.Join(segments, nil)) {
+		t.Errorf("stored %d bytes, want the %d bytes of the concatenated segments", len(object.Body), len(bytes.Join(segments, nil)))
+	}
+	video, getVideoError := wd.GetVideo("1")
+	if checksum := sha256.Sum256(object.Body); getVideoError != nil || video.Checksum != hex.EncodeToString(checksum[:]) {
+		t.Errorf("recorded checksum = %q, %v, want %x", video.Checksum, getVideoError, checksum)
+	}
+	// The restricted video never started an upload
+	if pending := s3Server.PendingUploads(); pending != 0 {
+		t.Errorf("%d multipart uploads left pending, want 0", pending)
+	}
+}
+
+func TestWatchdogPausesWithoutFreeSpace(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "1"})
+	wd := newTestWatchdog(t, server)
+	// More than any disk has
+	wd.MinFreeSpace = 1 << 62
+	wd.SpaceCheckInterval = 10 * time.Millisecond
+
+	if runError := wd.Run(); runError != nil {
+		t.Fatal(runError)
+	}
+	waitForStatus(t, wd, map[string]constants.VideoStatus{"1": constants.VideoStatusQueued})
+	time.Sleep(200 * time.Millisecond)
+	if stopError := wd.Stop(); stopError != nil {
+		t.Fatal(stopError)
+	}
+
+	// The paused queue never started the download and the video is resumed on next start
+	if requests := server.Requests(twitchtest.UsherPath("1")); requests != 0 {
+		t.Errorf("playlist requested %d times while paused, want 0", requests)
+	}
+	if video, getVideoError := wd.GetVideo("1"); getVideoError != nil || video.Status != constants.VideoStatusQueued {
+		t.Errorf("video status = %s, %v, want %s", video.Status, getVideoError, constants.VideoStatusQueued)
+	}
+}
+
+func TestWatchdogPostponesVideosTooLargeForTheDisk(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "large", LengthSeconds: 1 << 40})
+	server.AddVideo("channel", twitchtest.Video{Id: "small", LengthSeconds: 30})
+	wd := newTestWatchdog(t, server)
+	updates := wd.Events.Subscribe("test", 64, events.DropOldest)
+
+	if runError := wd.Run(); runError != nil {
+		t.Fatal(runError)
+	}
+	defer wd.Stop()
+	waitForStatus(t, wd, map[string]constants.VideoStatus{"small": constants.VideoStatusDownloaded})
+
+	// The large video goes back to the queue instead of failing
+	timeout := time.After(10 * time.Second)
+	for requeued := false; !requeued; {
+		select {
+		case update := <-updates.C:
+			if update.Id == "large" && update.Kind == watchdog.UpdateKindStatus {
+				if update.Status != constants.VideoStatusQueued {
+					t.Fatalf("large video status = %s, want %s", update.Status, constants.VideoStatusQueued)
+				}
+				requeued = true
+			}
+		case <-timeout:
+			t.Fatal("large video has not been queued again")
+		}
+	}
+	if requests := server.Requests(twitchtest.SegmentPath("large", 0)); requests != 0 {
+		t.Errorf("segments of the large video requested %d times, want 0", requests)
+	}
+}
+
+func TestWatchdogReportsTwitchOutage(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("outage", twitchtest.Video{Id: "1"})
+	server.FailOperation("ChannelVideos", "service unavailable")
+	wd := newTestWatchdog(t, server)
+	wd.ChannelId = "outage"
+
+	if runError := wd.Run(); runError != nil {
+		t.Fatal(runError)
+	}
+	defer wd.Stop()
+	checks := make(map[string]health.Check)
+	for _, check := range wd.HealthChecks() {
+		checks[check.Name] = check
+	}
+
+	// The failed synchronization is reported by the readiness probe while the workers keep running
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		probeError := checks["channel/outage/twitch"].Probe(context.Background())
+		if probeError != nil && strings.Contains(probeError.Error(), "service unavailable") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("twitch probe error = %v, want the GraphQL error", probeError)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if probeError := checks["channel/outage/workers"].Probe(context.Background()); probeError != nil {
+		t.Errorf("workers probe error = %v, want the watchdog to keep running", probeError)
+	}
+	exposition := &strings.Builder{}
+	metrics.Syncs.Write(exposition)
+	if !strings.Contains(exposition.String(), `channel="outage",result="error"`) {
+		t.Errorf("sync errors of channel outage not counted:\n%s", exposition.String())
+	}
+}
+
+func TestReconcileConfirmsVideosOlderThanTheListing(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "expired", PublishedAt: time.Now().Add(-30 * time.Hour)})
+	server.AddVideo("channel", twitchtest.Video{Id: "paged", PublishedAt: time.Now().Add(-29 * time.Hour)})
+	wd := newTestWatchdog(t, server)
+	if reconcileError := wd.Reconcile(); reconcileError != nil {
+		t.Fatal(reconcileError)
+	}
+
+	// A busy channel lists a full page of newer videos, the older ones are no longer listed
+	for i := 0; i < twitch.VideosPageSize; i++ {
+		server.AddVideo("channel", twitchtest.Video{Id: fmt.Sprintf("new%d", i), PublishedAt: time.Now().Add(-time.Duration(20-i) * time.Hour)})
+	}
+	server.RemoveVideo("expired")
+	if reconcileError := wd.Reconcile(); reconcileError != nil {
+		t.Fatal(reconcileError)
+	}
+	waitForStatus(t, wd, map[string]constants.VideoStatus{
+		"expired": constants.VideoStatusLost,
+		"paged":   constants.VideoStatusQueued,
+	})
+}
+
+func TestReconcileKeepsEditedVideosQueued(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "edited", Title: "before", LengthSeconds: 60})
+	server.AddVideo("channel", twitchtest.Video{Id: "growing", Title: "live", LengthSeconds: 60})
+	wd := newTestWatchdog(t, server)
+	if reconcileError := wd.Reconcile(); reconcileError != nil {
+		t.Fatal(reconcileError)
+	}
+
+	server.UpdateVideo("edited", func(video *twitchtest.Video) {
+		video.Title = "after"
+	})
+	server.UpdateVideo("growing", func(video *twitchtest.Video) {
+		video.LengthSeconds = 120
+	})
+	if reconcileError := wd.Reconcile(); reconcileError != nil {
+		t.Fatal(reconcileError)
+	}
+	// Only a growing length tells the stream is still live
+	waitForStatus(t, wd, map[string]constants.VideoStatus{
+		"edited":  constants.VideoStatusQueued,
+		"growing": constants.VideoStatusRecording,
+	})
+	if video, getVideoError := wd.GetVideo("edited"); getVideoError != nil || video.Title != "after" {
+		t.Errorf("edited video title = %q, %v, want %q", video.Title, getVideoError, "after")
+	}
+}
+
+func TestStopNeverRunWatchdog(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	wd := newTestWatchdog(t, server)
+
+	if stopError := wd.Stop(); stopError != nil {
+		t.Errorf("Stop() of a watchdog that never ran error = %v", stopError)
+	}
+	if status := wd.Status(); status != watchdog.WatchdogStatusStop {
+		t.Errorf("Status() = %s, want %s", status, watchdog.WatchdogStatusStop)
+	}
+}
+
+func TestStopCancelsInFlightPoll(t *testing.T) {
+	server := twitchtest.NewServer()
+	defer server.Close()
+	server.AddVideo("channel", twitchtest.Video{Id: "1"})
+	// Twitch keeps asking to wait a minute before the next request
+	server.Fail("/gql", twitchtest.Failure{Status: http.StatusTooManyRequests, RetryAfter: "60"})
+	wd := newTestWatchdog(t, server)
+	wd.DrainTimeout = 5 * time.Second
+
+	if runError := wd.Run(); runError != nil {
+		t.Fatal(runError)
+	}
+	for server.Requests("/gql") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The health probes read the status while the watchdog stops
+	probed := make(chan struct{})
+	go func() {
+		defer close(probed)
+		for _, check := range wd.HealthChecks() {
+			check.Probe(context.Background())
+		}
+	}()
+	start := time.Now()
+	if stopError := wd.Stop(); stopError != nil {
+		t.Fatal(stopError)
+	}
+	<-probed
+	if elapsed := time.Since(start); elapsed >= wd.DrainTimeout {
+		t.Errorf("Stop() took %s, want the poll to be cancelled before the drain timeout", elapsed)
+	}
+}